@@ -0,0 +1,227 @@
+// Copyright 2017 Brian Starkey <stark3y@gmail.com>
+package datalink
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+type BatchConfig struct {
+	// Window is how long to wait for more packets after the first one
+	// of a batch arrives
+	Window time.Duration
+	// MaxFrames is the frame budget of a batch. A batch is sent as soon
+	// as it's full, and packets which would exceed it go in the next
+	// one. 0 means no limit.
+	MaxFrames int
+	// DataLen is the number of data bytes in a frame, used to count
+	// frames. It must be more than 0. For an SPIConn, use its DataLen
+	// method.
+	DataLen int
+	// Unclaimed, if set, is called with received packets which couldn't
+	// be matched to a caller, instead of keeping them for a later one
+	Unclaimed Handler
+}
+
+var DefaultBatchConfig = BatchConfig{
+	Window: time.Millisecond,
+	MaxFrames: 16,
+	DataLen: 32,
+}
+
+type batchReq struct {
+	ctx context.Context
+	pkts []Packet
+	rx []Packet
+	err error
+	done chan struct{}
+}
+
+type batch struct {
+	reqs []*batchReq
+	frames int
+}
+
+// Batcher is a Transactor which coalesces the packets from concurrent
+// callers into a single Transact on another Transactor.
+//
+// Received packets are returned to callers by endpoint: each goes to the
+// earliest caller in the batch which sent a packet on the same endpoint,
+// and hasn't yet been given a response for it. Packets which don't match
+// go to the first caller in the batch which sent no packets (a poll), or
+// else to cfg.Unclaimed. If that isn't set, they're kept, and returned to
+// the next caller for their endpoint, or the next poll. So peers which
+// respond in a later transaction work as they would without the Batcher,
+// e.g. under a Mux.
+type Batcher struct {
+	t Transactor
+	cfg BatchConfig
+
+	mu sync.Mutex
+	cur *batch
+
+	// Serialises transactions on t, and protects pending
+	send sync.Mutex
+	// Received packets which haven't been returned yet, oldest first
+	pending []Packet
+}
+
+// At most this many unmatched packets are kept. After that, the oldest
+// are dropped.
+const maxPending = 64
+
+func NewBatcher(t Transactor, cfg BatchConfig) (*Batcher, error) {
+	if cfg.DataLen <= 0 {
+		return nil, fmt.Errorf("Invalid data length %d", cfg.DataLen)
+	}
+	if cfg.MaxFrames < 0 {
+		return nil, fmt.Errorf("Invalid frame budget %d", cfg.MaxFrames)
+	}
+
+	return &Batcher{ t: t, cfg: cfg }, nil
+}
+
+// MaxPacketLen returns the wrapped Transactor's MaxPacketLen, or
+// math.MaxInt if it doesn't have one
+func (b *Batcher) MaxPacketLen() int {
+	if l, ok := b.t.(interface{ MaxPacketLen() int }); ok {
+		return l.MaxPacketLen()
+	}
+	return math.MaxInt
+}
+
+func (b *Batcher) frames(pkts []Packet) int {
+	n := 0
+	for _, p := range pkts {
+		f := (len(p.Data) + b.cfg.DataLen - 1) / b.cfg.DataLen
+		if f == 0 {
+			f = 1
+		}
+		n += f
+	}
+	return n
+}
+
+// take removes bt from b, so it's no longer open for new packets. It
+// returns false if it was already taken. b.mu must be held.
+func (b *Batcher) take(bt *batch) bool {
+	if b.cur != bt {
+		return false
+	}
+	b.cur = nil
+	return true
+}
+
+func (b *Batcher) Transact(pkts []Packet) ([]Packet, error) {
+	return b.TransactContext(context.Background(), pkts)
+}
+
+// TransactContext is Transact, passing ctx on to the wrapped Transactor.
+// A batch is sent with the context of the first caller in it, so traces
+// show the transaction under that caller.
+func (b *Batcher) TransactContext(ctx context.Context, pkts []Packet) ([]Packet, error) {
+	r := &batchReq{ ctx: ctx, pkts: pkts, done: make(chan struct{}) }
+	n := b.frames(pkts)
+	full := func(frames int) bool {
+		return b.cfg.MaxFrames > 0 && frames >= b.cfg.MaxFrames
+	}
+
+	var ready []*batch
+
+	b.mu.Lock()
+	if b.cur != nil && b.cfg.MaxFrames > 0 && b.cur.frames + n > b.cfg.MaxFrames {
+		// Doesn't fit, so send what we've got
+		ready = append(ready, b.cur)
+		b.take(b.cur)
+	}
+
+	if b.cur == nil {
+		bt := &batch{}
+		b.cur = bt
+		time.AfterFunc(b.cfg.Window, func() {
+			b.mu.Lock()
+			ok := b.take(bt)
+			b.mu.Unlock()
+
+			if ok {
+				b.transact(bt)
+			}
+		})
+	}
+
+	b.cur.reqs = append(b.cur.reqs, r)
+	b.cur.frames += n
+
+	if full(b.cur.frames) {
+		ready = append(ready, b.cur)
+		b.take(b.cur)
+	}
+	b.mu.Unlock()
+
+	for _, bt := range ready {
+		b.transact(bt)
+	}
+
+	<-r.done
+	return r.rx, r.err
+}
+
+func (b *Batcher) transact(bt *batch) {
+	b.send.Lock()
+
+	var tx []Packet
+	owners := make(map[uint8][]*batchReq)
+	for _, r := range bt.reqs {
+		tx = append(tx, r.pkts...)
+		for _, p := range r.pkts {
+			owners[p.Endpoint] = append(owners[p.Endpoint], r)
+		}
+	}
+
+	rx, err := TransactContext(bt.reqs[0].ctx, b.t, tx)
+
+	var poll *batchReq
+	for _, r := range bt.reqs {
+		if len(r.pkts) == 0 {
+			poll = r
+			break
+		}
+	}
+
+	var unclaimed []Packet
+	pending := b.pending
+	b.pending = nil
+	for _, p := range append(pending, rx...) {
+		q := owners[p.Endpoint]
+		switch {
+		case len(q) > 0:
+			q[0].rx = append(q[0].rx, p)
+			owners[p.Endpoint] = q[1:]
+		case poll != nil:
+			poll.rx = append(poll.rx, p)
+		case b.cfg.Unclaimed != nil:
+			unclaimed = append(unclaimed, p)
+		default:
+			b.pending = append(b.pending, p)
+		}
+	}
+
+	if n := len(b.pending) - maxPending; n > 0 {
+		b.pending = b.pending[n:]
+	}
+	b.send.Unlock()
+
+	if b.cfg.Unclaimed != nil {
+		for _, p := range unclaimed {
+			b.cfg.Unclaimed(p)
+		}
+	}
+
+	for _, r := range bt.reqs {
+		r.err = err
+		close(r.done)
+	}
+}
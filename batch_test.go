@@ -0,0 +1,223 @@
+// Copyright 2017 Brian Starkey <stark3y@gmail.com>
+package datalink
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingEcho answers each packet in the same transaction, with its data
+// inverted, and counts transactions
+type countingEcho struct {
+	mu sync.Mutex
+	calls int
+	extra []Packet
+}
+
+func (c *countingEcho) Transact(tx []Packet) ([]Packet, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.calls++
+
+	rx := []Packet{}
+	for _, p := range tx {
+		data := make([]byte, len(p.Data))
+		for i := range p.Data {
+			data[i] = ^p.Data[i]
+		}
+		rx = append(rx, Packet{ Endpoint: p.Endpoint, Data: data })
+	}
+
+	return append(rx, c.extra...), nil
+}
+
+// lateEcho answers each packet in the following transaction
+type lateEcho struct {
+	mu sync.Mutex
+	last []Packet
+}
+
+func (l *lateEcho) Transact(tx []Packet) ([]Packet, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rx := l.last
+	l.last = nil
+	for _, p := range tx {
+		l.last = append(l.last, Packet{ Endpoint: p.Endpoint, Data: []byte{ ^p.Data[0] } })
+	}
+
+	return rx, nil
+}
+
+func runConcurrent(t *testing.T, tr Transactor, n int) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			// Half share endpoint 1, to check ordering
+			ep := uint8(1)
+			if i % 2 == 1 {
+				ep = uint8(i)
+			}
+
+			rx, err := tr.Transact([]Packet{ { Endpoint: ep, Data: []byte{ byte(i) } } })
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			if len(rx) != 1 || rx[0].Endpoint != ep || rx[0].Data[0] != ^byte(i) {
+				t.Errorf("Caller %d got the wrong response: %v\n", i, rx)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestBatcherWindow(t *testing.T) {
+	peer := &countingEcho{}
+	b, err := NewBatcher(peer, BatchConfig{ Window: 50 * time.Millisecond, DataLen: 32 })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runConcurrent(t, b, 8)
+
+	if peer.calls != 1 {
+		t.Errorf("Expected 1 transaction, got %d\n", peer.calls)
+	}
+}
+
+func TestBatcherFrameBudget(t *testing.T) {
+	peer := &countingEcho{}
+	b, err := NewBatcher(peer, BatchConfig{
+		// Long enough that only the budget can cause a send
+		Window: time.Hour,
+		MaxFrames: 2,
+		DataLen: 32,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	runConcurrent(t, b, 8)
+
+	if peer.calls != 4 {
+		t.Errorf("Expected 4 transactions, got %d\n", peer.calls)
+	}
+
+	if time.Since(start) > time.Second {
+		t.Errorf("Batches weren't sent when full\n")
+	}
+}
+
+func TestBatcherUnclaimed(t *testing.T) {
+	peer := &countingEcho{ extra: []Packet{ { Endpoint: 7, Data: []byte{ 7 } } } }
+
+	var unclaimed []Packet
+	b, err := NewBatcher(peer, BatchConfig{
+		Window: time.Millisecond,
+		DataLen: 32,
+		Unclaimed: func(p Packet) {
+			unclaimed = append(unclaimed, p)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rx, err := b.Transact([]Packet{ { Endpoint: 1, Data: []byte{ 1 } } })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rx) != 1 || rx[0].Endpoint != 1 {
+		t.Errorf("Unexpected response: %v\n", rx)
+	}
+
+	if len(unclaimed) != 1 || unclaimed[0].Endpoint != 7 {
+		t.Errorf("Expected endpoint 7 to be unclaimed, got: %v\n", unclaimed)
+	}
+}
+
+func TestBatcherLate(t *testing.T) {
+	b, err := NewBatcher(&lateEcho{}, BatchConfig{ Window: time.Millisecond, DataLen: 32 })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		tx []Packet
+		rx []Packet
+	}{
+		{ []Packet{ { Endpoint: 2, Data: []byte{ 1 } } }, nil },
+		// Endpoint 2's response is kept
+		{ []Packet{ { Endpoint: 5, Data: []byte{ 5 } } }, nil },
+		// ...for the next caller on endpoint 2, and endpoint 5's kept
+		{
+			[]Packet{ { Endpoint: 2, Data: []byte{ 3 } } },
+			[]Packet{ { Endpoint: 2, Data: []byte{ ^byte(1) } } },
+		},
+		// A poll gets everything left
+		{
+			nil,
+			[]Packet{
+				{ Endpoint: 5, Data: []byte{ ^byte(5) } },
+				{ Endpoint: 2, Data: []byte{ ^byte(3) } },
+			},
+		},
+	}
+
+	for i, s := range steps {
+		rx, err := b.Transact(s.tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fmt.Sprint(rx) != fmt.Sprint(s.rx) {
+			t.Errorf("Step %d:\n  Expected: %v\n       Got: %v\n", i, s.rx, rx)
+		}
+	}
+}
+
+func TestBatcherMux(t *testing.T) {
+	b, err := NewBatcher(&lateEcho{}, BatchConfig{ Window: time.Millisecond, DataLen: 32 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMux(b, nil)
+
+	c, err := m.Register(3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rx, err := c.Request([]byte{ 0x0f })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rx) != 1 || rx[0] != 0xf0 {
+		t.Errorf("Unexpected response: %x\n", rx)
+	}
+}
+
+func TestBatcherConfig(t *testing.T) {
+	for _, cfg := range []BatchConfig{
+		{ Window: time.Millisecond, DataLen: 0 },
+		{ Window: time.Millisecond, DataLen: -1 },
+		{ Window: time.Millisecond, DataLen: 32, MaxFrames: -1 },
+	} {
+		_, err := NewBatcher(&countingEcho{}, cfg)
+		if err == nil {
+			t.Errorf("%+v: expected error, got none\n", cfg)
+		}
+	}
+}
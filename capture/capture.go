@@ -0,0 +1,324 @@
+// Copyright 2017 Brian Starkey <stark3y@gmail.com>
+
+// Package capture records datalink traffic to a file for offline
+// inspection.
+//
+// A capture file starts with a header:
+//
+//	[4]byte magic "DLCP"
+//	u16     version (1)
+//	u16     reserved
+//
+// followed by any number of records:
+//
+//	u8      type
+//	[3]byte reserved
+//	i64     timestamp, nanoseconds since the Unix epoch
+//	u32     payload length
+//	[]byte  payload
+//
+// For RecordTx and RecordRx, the payload is the raw bytes passed to or
+// returned from a Transport. For RecordTxPackets and RecordRxPackets, it
+// is a sequence of packets, each:
+//
+//	u8      endpoint
+//	u32     data length
+//	[]byte  data
+//
+// For RecordError, it is the error message. All values are little-endian.
+// Payloads are at most MaxRecordLen bytes.
+package capture
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/usedbytes/bot_matrix/datalink"
+)
+
+const Version = 1
+
+// MaxRecordLen is the largest record payload which can be written or read
+const MaxRecordLen = 16 * 1024 * 1024
+
+var magic = [4]byte{ 'D', 'L', 'C', 'P' }
+
+type RecordType uint8
+
+const (
+	RecordTx RecordType = iota + 1
+	RecordRx
+	RecordTxPackets
+	RecordRxPackets
+	RecordError
+)
+
+func (t RecordType) String() string {
+	switch t {
+	case RecordTx:
+		return "tx"
+	case RecordRx:
+		return "rx"
+	case RecordTxPackets:
+		return "tx packets"
+	case RecordRxPackets:
+		return "rx packets"
+	case RecordError:
+		return "error"
+	}
+	return fmt.Sprintf("RecordType(%d)", uint8(t))
+}
+
+type Record struct {
+	Type RecordType
+	Time time.Time
+	// Data is set for RecordTx and RecordRx
+	Data []byte
+	// Packets is set for RecordTxPackets and RecordRxPackets
+	Packets []datalink.Packet
+	// Err is set for RecordError
+	Err string
+}
+
+type header struct {
+	Magic [4]byte
+	Version uint16
+	Reserved uint16
+}
+
+type recordHeader struct {
+	Type RecordType
+	Reserved [3]byte
+	Time int64
+	Len uint32
+}
+
+// Writer writes records to a capture file. It is safe for concurrent use.
+// Each record is written with a single Write call.
+type Writer struct {
+	mu sync.Mutex
+	w io.Writer
+	err error
+}
+
+func NewWriter(w io.Writer) (*Writer, error) {
+	err := binary.Write(w, binary.LittleEndian, header{ Magic: magic, Version: Version })
+	if err != nil {
+		return nil, err
+	}
+
+	return &Writer{ w: w }, nil
+}
+
+func encodePackets(pkts []datalink.Packet) []byte {
+	buf := new(bytes.Buffer)
+	for _, pkt := range pkts {
+		binary.Write(buf, binary.LittleEndian, pkt.Endpoint)
+		binary.Write(buf, binary.LittleEndian, uint32(len(pkt.Data)))
+		buf.Write(pkt.Data)
+	}
+	return buf.Bytes()
+}
+
+func decodePackets(data []byte) ([]datalink.Packet, error) {
+	pkts := make([]datalink.Packet, 0)
+	for len(data) > 0 {
+		if len(data) < 5 {
+			return pkts, fmt.Errorf("Truncated packet")
+		}
+
+		n := binary.LittleEndian.Uint32(data[1:])
+		if uint32(len(data) - 5) < n {
+			return pkts, fmt.Errorf("Truncated packet")
+		}
+
+		pkts = append(pkts, datalink.Packet{
+			Endpoint: data[0],
+			Data: append([]byte{}, data[5:5 + n]...),
+		})
+		data = data[5 + n:]
+	}
+	return pkts, nil
+}
+
+// WriteRecord writes r. If r.Time is zero, the current time is used.
+func (w *Writer) WriteRecord(r *Record) error {
+	var payload []byte
+	switch r.Type {
+	case RecordTx, RecordRx:
+		payload = r.Data
+	case RecordTxPackets, RecordRxPackets:
+		payload = encodePackets(r.Packets)
+	case RecordError:
+		payload = []byte(r.Err)
+	default:
+		return fmt.Errorf("Unknown record type %d", r.Type)
+	}
+
+	if len(payload) > MaxRecordLen {
+		return fmt.Errorf("Record too large. %d bytes, maximum %d", len(payload), MaxRecordLen)
+	}
+
+	ts := r.Time
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, recordHeader{
+		Type: r.Type,
+		Time: ts.UnixNano(),
+		Len: uint32(len(payload)),
+	})
+	buf.Write(payload)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err != nil {
+		return w.err
+	}
+
+	_, w.err = w.w.Write(buf.Bytes())
+
+	return w.err
+}
+
+// Err returns the first error encountered while writing, if any
+func (w *Writer) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.err
+}
+
+type Reader struct {
+	r io.Reader
+}
+
+func NewReader(r io.Reader) (*Reader, error) {
+	var hdr header
+	err := binary.Read(r, binary.LittleEndian, &hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	if hdr.Magic != magic {
+		return nil, fmt.Errorf("Not a capture file")
+	}
+
+	if hdr.Version != Version {
+		return nil, fmt.Errorf("Unsupported capture version %d", hdr.Version)
+	}
+
+	return &Reader{ r }, nil
+}
+
+// Next returns the next record, or io.EOF at the end of the capture
+func (r *Reader) Next() (*Record, error) {
+	var hdr recordHeader
+	err := binary.Read(r.r, binary.LittleEndian, &hdr)
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("Truncated record header")
+		}
+		return nil, err
+	}
+
+	// Don't trust the length of a corrupt record
+	if hdr.Len > MaxRecordLen {
+		return nil, fmt.Errorf("Record too large. %d bytes, maximum %d", hdr.Len, MaxRecordLen)
+	}
+
+	payload := make([]byte, hdr.Len)
+	_, err = io.ReadFull(r.r, payload)
+	if err != nil {
+		return nil, fmt.Errorf("Truncated record: %v", err)
+	}
+
+	rec := &Record{
+		Type: hdr.Type,
+		Time: time.Unix(0, hdr.Time),
+	}
+
+	switch hdr.Type {
+	case RecordTx, RecordRx:
+		rec.Data = payload
+	case RecordTxPackets, RecordRxPackets:
+		rec.Packets, err = decodePackets(payload)
+	case RecordError:
+		rec.Err = string(payload)
+	default:
+		err = fmt.Errorf("Unknown record type %d", hdr.Type)
+	}
+
+	return rec, err
+}
+
+// Transport records all data passing through a datalink.Transport.
+// Errors writing the capture don't affect the transfer, and can be
+// checked with Writer.Err.
+type Transport struct {
+	t datalink.Transport
+	w *Writer
+}
+
+func NewTransport(t datalink.Transport, w *Writer) *Transport {
+	return &Transport{ t, w }
+}
+
+func (c *Transport) Transfer(tx []byte) ([]byte, error) {
+	c.w.WriteRecord(&Record{ Type: RecordTx, Data: tx })
+
+	rx, err := c.t.Transfer(tx)
+	if err != nil {
+		c.w.WriteRecord(&Record{ Type: RecordError, Err: err.Error() })
+	} else {
+		c.w.WriteRecord(&Record{ Type: RecordRx, Data: rx })
+	}
+
+	return rx, err
+}
+
+// Transactor records all packets passing through a datalink.Transactor
+type Transactor struct {
+	t datalink.Transactor
+	w *Writer
+}
+
+func NewTransactor(t datalink.Transactor, w *Writer) *Transactor {
+	return &Transactor{ t, w }
+}
+
+func (c *Transactor) Transact(tx []datalink.Packet) ([]datalink.Packet, error) {
+	return c.TransactContext(context.Background(), tx)
+}
+
+// TransactContext is Transact, passing ctx on to the wrapped Transactor
+func (c *Transactor) TransactContext(ctx context.Context, tx []datalink.Packet) ([]datalink.Packet, error) {
+	c.w.WriteRecord(&Record{ Type: RecordTxPackets, Packets: tx })
+
+	rx, err := datalink.TransactContext(ctx, c.t, tx)
+	if err != nil {
+		c.w.WriteRecord(&Record{ Type: RecordError, Err: err.Error() })
+	} else {
+		c.w.WriteRecord(&Record{ Type: RecordRxPackets, Packets: rx })
+	}
+
+	return rx, err
+}
+
+// MaxPacketLen returns the wrapped Transactor's MaxPacketLen, or
+// math.MaxInt if it doesn't have one
+func (c *Transactor) MaxPacketLen() int {
+	if l, ok := c.t.(interface{ MaxPacketLen() int }); ok {
+		return l.MaxPacketLen()
+	}
+	return math.MaxInt
+}
@@ -0,0 +1,206 @@
+// Copyright 2017 Brian Starkey <stark3y@gmail.com>
+
+package capture
+
+import (
+	"bytes"
+	"fmt"
+	"encoding/binary"
+	"io"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/usedbytes/bot_matrix/datalink"
+)
+
+type loopback struct {
+	fail bool
+}
+
+func (l *loopback) Transfer(tx []byte) ([]byte, error) {
+	if l.fail {
+		return nil, fmt.Errorf("transfer failed")
+	}
+	return append([]byte{}, tx...), nil
+}
+
+func (l *loopback) Transact(tx []datalink.Packet) ([]datalink.Packet, error) {
+	if l.fail {
+		return nil, fmt.Errorf("transact failed")
+	}
+	return tx, nil
+}
+
+func packetsEqual(a, b []datalink.Packet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i].Endpoint != b[i].Endpoint || !bytes.Equal(a[i].Data, b[i].Data) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestRoundTrip(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w, err := NewWriter(buf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	ts := time.Unix(1500000000, 12345)
+	pkts := []datalink.Packet{
+		{Endpoint: 1, Data: []byte{1}},
+		{Endpoint: 2, Data: []byte{}},
+		{Endpoint: 3, Data: []byte{0x0a, 0x0b, 0x0c}},
+	}
+	records := []*Record{
+		{Type: RecordTx, Time: ts, Data: []byte{0x01, 0x02}},
+		{Type: RecordRx, Time: ts, Data: []byte{0x03, 0x04}},
+		{Type: RecordTxPackets, Time: ts, Packets: pkts},
+		{Type: RecordRxPackets, Time: ts, Packets: []datalink.Packet{}},
+		{Type: RecordError, Time: ts, Err: "oops"},
+	}
+
+	for _, r := range records {
+		err = w.WriteRecord(r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	r, err := NewReader(buf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for i, expect := range records {
+		rec, err := r.Next()
+		if err != nil {
+			t.Errorf("Record %d: %v\n", i, err)
+			return
+		}
+
+		if rec.Type != expect.Type || !rec.Time.Equal(expect.Time) ||
+			!bytes.Equal(rec.Data, expect.Data) || rec.Err != expect.Err ||
+			!packetsEqual(rec.Packets, expect.Packets) {
+			t.Errorf("Record %d mismatch.\n  Expected: %v\n       Got: %v\n",
+				i, expect, rec)
+		}
+	}
+
+	_, err = r.Next()
+	if err != io.EOF {
+		t.Errorf("Expected EOF, got: %v\n", err)
+	}
+}
+
+func TestWrappers(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w, err := NewWriter(buf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	lb := &loopback{}
+	xport := NewTransport(lb, w)
+	conn := NewTransactor(lb, w)
+
+	xport.Transfer([]byte{0x0a})
+	conn.Transact([]datalink.Packet{{Endpoint: 4, Data: []byte{0x0b}}})
+	lb.fail = true
+	xport.Transfer([]byte{0x0c})
+
+	expect := []RecordType{RecordTx, RecordRx, RecordTxPackets, RecordRxPackets,
+		RecordTx, RecordError}
+
+	r, err := NewReader(buf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for i, typ := range expect {
+		rec, err := r.Next()
+		if err != nil {
+			t.Errorf("Record %d: %v\n", i, err)
+			return
+		}
+
+		if rec.Type != typ {
+			t.Errorf("Record %d: expected %v, got %v\n", i, typ, rec.Type)
+		}
+	}
+}
+
+func TestRecordTooLarge(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w, err := NewWriter(buf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// A corrupt length mustn't be allocated
+	binary.Write(buf, binary.LittleEndian, recordHeader{
+		Type: RecordTx,
+		Len: math.MaxUint32,
+	})
+
+	r, err := NewReader(buf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = r.Next()
+	if err == nil || !strings.HasPrefix(err.Error(), "Record too large") {
+		t.Errorf("Expected 'Record too large', got: %v\n", err)
+	}
+
+	err = w.WriteRecord(&Record{ Type: RecordTx, Data: make([]byte, MaxRecordLen + 1) })
+	if err == nil || !strings.HasPrefix(err.Error(), "Record too large") {
+		t.Errorf("Expected 'Record too large', got: %v\n", err)
+	}
+}
+
+type limited struct {
+	loopback
+}
+
+func (l *limited) MaxPacketLen() int {
+	return 32
+}
+
+func TestTransactorMaxPacketLen(t *testing.T) {
+	w, err := NewWriter(io.Discard)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if n := NewTransactor(&limited{}, w).MaxPacketLen(); n != 32 {
+		t.Errorf("Expected MaxPacketLen 32, got %d\n", n)
+	}
+
+	if n := NewTransactor(&loopback{}, w).MaxPacketLen(); n != math.MaxInt {
+		t.Errorf("Expected no limit, got %d\n", n)
+	}
+}
+
+func TestBadMagic(t *testing.T) {
+	_, err := NewReader(bytes.NewReader([]byte("NOPE\x01\x00\x00\x00")))
+	if err == nil {
+		t.Errorf("Expected error, got none.\n")
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2017 Brian Starkey <stark3y@gmail.com>
+package capture
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// LinkTypeUser0 is the pcap link type used for exported transfers, which
+// the dissector generated by cmd/dissector is registered for
+const LinkTypeUser0 = 147
+
+// pcap file header, for nanosecond timestamps
+type pcapHeader struct {
+	Magic uint32
+	VersionMajor uint16
+	VersionMinor uint16
+	ThisZone int32
+	SigFigs uint32
+	SnapLen uint32
+	LinkType uint32
+}
+
+type pcapRecord struct {
+	Sec uint32
+	Nsec uint32
+	InclLen uint32
+	OrigLen uint32
+}
+
+// ExportPcap copies the RecordTx and RecordRx records from r to w as a
+// pcap file with LinkTypeUser0, one transfer per packet, so that the SPI
+// frames can be dissected in Wireshark. Other records aren't SPI frames,
+// and are skipped. It returns the number of packets written.
+func ExportPcap(w io.Writer, r *Reader) (int, error) {
+	err := binary.Write(w, binary.LittleEndian, pcapHeader{
+		Magic: 0xa1b23c4d,
+		VersionMajor: 2,
+		VersionMinor: 4,
+		SnapLen: MaxRecordLen,
+		LinkType: LinkTypeUser0,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+
+		if rec.Type != RecordTx && rec.Type != RecordRx {
+			continue
+		}
+
+		ts := rec.Time.UnixNano()
+		err = binary.Write(w, binary.LittleEndian, pcapRecord{
+			Sec: uint32(ts / 1e9),
+			Nsec: uint32(ts % 1e9),
+			InclLen: uint32(len(rec.Data)),
+			OrigLen: uint32(len(rec.Data)),
+		})
+		if err != nil {
+			return n, err
+		}
+
+		_, err = w.Write(rec.Data)
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2017 Brian Starkey <stark3y@gmail.com>
+
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/usedbytes/bot_matrix/datalink"
+)
+
+func TestExportPcap(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w, err := NewWriter(buf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	ts := time.Unix(1500000000, 123456789)
+	w.WriteRecord(&Record{ Type: RecordTx, Time: ts, Data: []byte{ 0x01, 0x02 } })
+	w.WriteRecord(&Record{ Type: RecordTxPackets, Time: ts,
+		Packets: []datalink.Packet{ { Endpoint: 1, Data: []byte{ 0x0a } } } })
+	w.WriteRecord(&Record{ Type: RecordError, Time: ts, Err: "oops" })
+	w.WriteRecord(&Record{ Type: RecordRx, Time: ts, Data: []byte{ 0x03 } })
+
+	r, err := NewReader(buf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	out := new(bytes.Buffer)
+	n, err := ExportPcap(out, r)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if n != 2 {
+		t.Errorf("Expected 2 packets, got %d\n", n)
+	}
+
+	var hdr pcapHeader
+	binary.Read(out, binary.LittleEndian, &hdr)
+	if hdr.Magic != 0xa1b23c4d || hdr.LinkType != LinkTypeUser0 {
+		t.Errorf("Unexpected header: %+v\n", hdr)
+	}
+
+	for _, expect := range [][]byte{ { 0x01, 0x02 }, { 0x03 } } {
+		var rec pcapRecord
+		binary.Read(out, binary.LittleEndian, &rec)
+		if rec.Sec != 1500000000 || rec.Nsec != 123456789 || rec.InclLen != uint32(len(expect)) {
+			t.Errorf("Unexpected record header: %+v\n", rec)
+			return
+		}
+
+		data := out.Next(int(rec.InclLen))
+		if !bytes.Equal(data, expect) {
+			t.Errorf("Data mismatch:\n  Expected: %x\n       Got: %x\n", expect, data)
+		}
+	}
+
+	if out.Len() != 0 {
+		t.Errorf("%d trailing bytes\n", out.Len())
+	}
+}
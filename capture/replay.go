@@ -0,0 +1,157 @@
+// Copyright 2017 Brian Starkey <stark3y@gmail.com>
+package capture
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+type MatchMode int
+
+const (
+	// MatchStrict requires every transfer to match the next recorded one
+	MatchStrict MatchMode = iota
+	// MatchLenient skips ahead to the next recorded transfer which
+	// matches, or if there isn't one, serves the next recorded response
+	// anyway
+	MatchLenient
+)
+
+type ReplayConfig struct {
+	Mode MatchMode
+	// Timing reproduces the recorded timing: each transfer takes as
+	// long as it did when recorded, and responses aren't returned
+	// earlier (relative to the first transfer) than they were recorded.
+	Timing bool
+	// Match, if set, is used to compare recorded and actual transmit
+	// data, instead of requiring them to be identical
+	Match func(recorded, tx []byte) bool
+}
+
+type exchange struct {
+	tx, rx []byte
+	err string
+	txTime, rxTime time.Time
+}
+
+// Replay is a datalink.Transport which serves the responses from a
+// capture made with Transport
+type Replay struct {
+	cfg ReplayConfig
+	exchanges []exchange
+	pos int
+	start time.Time
+
+	// Mismatches counts transfers which didn't match, in MatchLenient
+	// mode
+	Mismatches int
+}
+
+// NewReplay reads the whole of r. Packet records are ignored, as are
+// errors outside a transfer, which come from a Transactor sharing the
+// Writer (e.g. a CRC error after the transfer was recorded).
+func NewReplay(r *Reader, cfg ReplayConfig) (*Replay, error) {
+	rp := &Replay{ cfg: cfg }
+
+	var cur *exchange
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch rec.Type {
+		case RecordTx:
+			rp.exchanges = append(rp.exchanges, exchange{
+				tx: rec.Data,
+				txTime: rec.Time,
+			})
+			cur = &rp.exchanges[len(rp.exchanges) - 1]
+		case RecordError:
+			if cur == nil {
+				continue
+			}
+			cur.err = rec.Err
+			cur.rxTime = rec.Time
+			cur = nil
+		case RecordRx:
+			if cur == nil {
+				return nil, fmt.Errorf("Response without transfer at %v", rec.Time)
+			}
+			cur.rx = rec.Data
+			cur.rxTime = rec.Time
+			cur = nil
+		}
+	}
+
+	if cur != nil {
+		// The capture was cut off mid-transfer
+		rp.exchanges = rp.exchanges[:len(rp.exchanges) - 1]
+	}
+
+	if cfg.Match == nil {
+		rp.cfg.Match = bytes.Equal
+	}
+
+	return rp, nil
+}
+
+// Remaining returns the number of recorded transfers not yet served
+func (r *Replay) Remaining() int {
+	return len(r.exchanges) - r.pos
+}
+
+func (r *Replay) wait(ex *exchange) {
+	if r.start.IsZero() {
+		r.start = time.Now()
+	}
+
+	d := ex.rxTime.Sub(ex.txTime)
+	since := ex.rxTime.Sub(r.exchanges[0].txTime)
+	if until := time.Until(r.start.Add(since)); until > d {
+		d = until
+	}
+
+	time.Sleep(d)
+}
+
+func (r *Replay) Transfer(tx []byte) ([]byte, error) {
+	if r.pos >= len(r.exchanges) {
+		return nil, fmt.Errorf("Replay exhausted after %d transfers", r.pos)
+	}
+
+	if !r.cfg.Match(r.exchanges[r.pos].tx, tx) {
+		if r.cfg.Mode == MatchStrict {
+			return nil, fmt.Errorf("Replay mismatch at transfer %d", r.pos)
+		}
+
+		r.Mismatches++
+		for i := r.pos + 1; i < len(r.exchanges); i++ {
+			if r.cfg.Match(r.exchanges[i].tx, tx) {
+				r.pos = i
+				break
+			}
+		}
+	}
+
+	ex := &r.exchanges[r.pos]
+	r.pos++
+
+	if r.cfg.Timing {
+		r.wait(ex)
+	}
+
+	if len(ex.err) > 0 {
+		return nil, errors.New(ex.err)
+	}
+
+	rx := make([]byte, len(tx))
+	copy(rx, ex.rx)
+
+	return rx, nil
+}
@@ -0,0 +1,205 @@
+// Copyright 2017 Brian Starkey <stark3y@gmail.com>
+
+package capture
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/usedbytes/bot_matrix/datalink"
+)
+
+type inverter struct {
+	delay time.Duration
+}
+
+func (v *inverter) Transfer(tx []byte) ([]byte, error) {
+	time.Sleep(v.delay)
+
+	rx := make([]byte, len(tx))
+	for i := range tx {
+		rx[i] = ^tx[i]
+	}
+	return rx, nil
+}
+
+func record(t *testing.T, delay time.Duration, txs ...[]byte) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	w, err := NewWriter(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	xport := NewTransport(&inverter{delay}, w)
+	for _, tx := range txs {
+		xport.Transfer(tx)
+	}
+
+	return buf
+}
+
+func newReplay(t *testing.T, buf *bytes.Buffer, cfg ReplayConfig) *Replay {
+	r, err := NewReader(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rp, err := NewReplay(r, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rp
+}
+
+func TestReplayStrict(t *testing.T) {
+	buf := record(t, 0, []byte{0x01}, []byte{0x02}, []byte{0x03})
+	rp := newReplay(t, buf, ReplayConfig{Mode: MatchStrict})
+
+	for _, b := range []byte{0x01, 0x02} {
+		rx, err := rp.Transfer([]byte{b})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if !bytes.Equal(rx, []byte{^b}) {
+			t.Errorf("Data mismatch:\n  Expected: %x\n       Got: %x\n",
+				[]byte{^b}, rx)
+		}
+	}
+
+	_, err := rp.Transfer([]byte{0x04})
+	if err == nil || !strings.HasPrefix(err.Error(), "Replay mismatch") {
+		t.Errorf("Expected mismatch error, got: %v\n", err)
+	}
+}
+
+func TestReplayLenient(t *testing.T) {
+	buf := record(t, 0, []byte{0x01}, []byte{0x02}, []byte{0x03}, []byte{0x04})
+	rp := newReplay(t, buf, ReplayConfig{Mode: MatchLenient})
+
+	// Skips ahead to the match
+	rx, err := rp.Transfer([]byte{0x03})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !bytes.Equal(rx, []byte{^byte(0x03)}) {
+		t.Errorf("Data mismatch:\n  Expected: %x\n       Got: %x\n",
+			[]byte{^byte(0x03)}, rx)
+	}
+
+	// No match, so serves the next one
+	rx, err = rp.Transfer([]byte{0x09})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !bytes.Equal(rx, []byte{^byte(0x04)}) {
+		t.Errorf("Data mismatch:\n  Expected: %x\n       Got: %x\n",
+			[]byte{^byte(0x04)}, rx)
+	}
+
+	if rp.Mismatches != 2 {
+		t.Errorf("Expected 2 mismatches, got %d\n", rp.Mismatches)
+	}
+
+	_, err = rp.Transfer([]byte{0x05})
+	if err == nil || !strings.HasPrefix(err.Error(), "Replay exhausted") {
+		t.Errorf("Expected exhausted error, got: %v\n", err)
+	}
+}
+
+func TestReplayTiming(t *testing.T) {
+	delay := 20 * time.Millisecond
+	buf := record(t, delay, []byte{0x01}, []byte{0x02})
+	rp := newReplay(t, buf, ReplayConfig{Timing: true})
+
+	start := time.Now()
+	rp.Transfer([]byte{0x01})
+	rp.Transfer([]byte{0x02})
+
+	if elapsed := time.Since(start); elapsed < 2*delay {
+		t.Errorf("Replay too fast. Expected at least %v, took %v\n",
+			2*delay, elapsed)
+	}
+}
+
+// sumProtocol sends one packet per transfer, as endpoint, data and a
+// checksum
+type sumProtocol struct{}
+
+func (p sumProtocol) Serialise(pkts []datalink.Packet) []byte {
+	buf := []byte{ pkts[0].Endpoint }
+	buf = append(buf, pkts[0].Data...)
+
+	var sum byte
+	for _, b := range buf {
+		sum += b
+	}
+	return append(buf, sum)
+}
+
+func (p sumProtocol) DeSerialise(buf []byte) ([]datalink.Packet, error) {
+	var sum byte
+	for _, b := range buf[:len(buf) - 1] {
+		sum += b
+	}
+	if sum != buf[len(buf) - 1] {
+		return nil, fmt.Errorf("CRC mismatch")
+	}
+
+	return []datalink.Packet{{ Endpoint: buf[0], Data: buf[1:len(buf) - 1] }}, nil
+}
+
+// corrupter echoes, flipping the last byte when corrupt is set
+type corrupter struct {
+	corrupt bool
+}
+
+func (c *corrupter) Transfer(tx []byte) ([]byte, error) {
+	rx := append([]byte{}, tx...)
+	if c.corrupt {
+		rx[len(rx) - 1] ^= 0xff
+	}
+	return rx, nil
+}
+
+func TestReplayTransactorError(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w, err := NewWriter(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Wrapped like the shell and spibridge do, with one Writer
+	c := &corrupter{}
+	conn := NewTransactor(datalink.NewConnection(sumProtocol{}, NewTransport(c, w)), w)
+
+	pkts := []datalink.Packet{{ Endpoint: 1, Data: []byte{ 0x10 } }}
+	for _, corrupt := range []bool{ false, true, false } {
+		c.corrupt = corrupt
+		conn.Transact(pkts)
+	}
+
+	rp := newReplay(t, buf, ReplayConfig{})
+	if rp.Remaining() != 3 {
+		t.Fatalf("Expected 3 transfers, got %d\n", rp.Remaining())
+	}
+
+	replay := datalink.NewConnection(sumProtocol{}, rp)
+	for i, fail := range []bool{ false, true, false } {
+		_, err := replay.Transact(pkts)
+		if fail && (err == nil || !strings.HasPrefix(err.Error(), "CRC mismatch")) {
+			t.Errorf("Transfer %d: expected CRC error, got: %v\n", i, err)
+		} else if !fail && err != nil {
+			t.Errorf("Transfer %d: %v\n", i, err)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"text/template"
+)
+
+var luaTemplate = template.Must(template.New("lua").Funcs(template.FuncMap{
+	"hex": func(v uint8) string {
+		return fmt.Sprintf("0x%02x", v)
+	},
+}).Parse(`-- Code generated by cmd/dissector. DO NOT EDIT.
+--
+-- Wireshark dissectors for the bot_matrix datalink SPI frame format
+-- (spi_pl_packet), and the spibridge RPC protocol.
+
+--
+-- SPI frames. Each captured packet holds one transfer, with link type
+-- USER0. Convert capture files with "dissector -export".
+--
+
+local spi = Proto("datalink_spi", "bot_matrix datalink SPI")
+
+local HDR_LEN = {{.HdrLen}}
+
+local crc_types = {
+{{- range .CRCs}}
+	{ name = "{{.Name}}", poly = {{hex .Poly}}, init = {{hex .Init}}, refin = {{.RefIn}}, refout = {{.RefOut}}, xorout = {{hex .XorOut}} },
+{{- end}}
+}
+
+local crc_enum = {}
+for i, c in ipairs(crc_types) do
+	crc_enum[i] = { i, c.name, i - 1 }
+end
+
+spi.prefs.datalen = Pref.uint("Data length", {{.DataLen}}, "Number of data bytes in each frame")
+spi.prefs.crc = Pref.enum("CRC type", 0, "CRC algorithm agreed in the handshake", crc_enum, false)
+
+local f = spi.fields
+{{- range .Fields}}
+{{- if eq .Name "data"}}
+f.{{.Name}} = ProtoField.bytes("datalink_spi.{{.Name}}", "{{.Desc}}")
+{{- else}}
+f.{{.Name}} = ProtoField.uint8("datalink_spi.{{.Name}}", "{{.Desc}}", base.{{if or (eq .Name "flags") (eq .Name "crc")}}HEX{{else}}DEC{{end}})
+{{- end}}
+{{- end}}
+{{- range .Flags}}
+f.flag_{{.Name}} = ProtoField.bool("datalink_spi.flags.{{.Name}}", "{{.Desc}}", 8, nil, {{hex .Mask}})
+{{- end}}
+f.length = ProtoField.uint8("datalink_spi.length", "Data length", base.DEC)
+
+local FLAG_LENGTH = {{range .Flags}}{{if eq .Name "length"}}{{hex .Mask}}{{end}}{{end}}
+
+local crc_error = ProtoExpert.new("datalink_spi.crc_error", "CRC error", expert.group.CHECKSUM, expert.severity.ERROR)
+local trailing = ProtoExpert.new("datalink_spi.trailing", "Trailing bytes", expert.group.MALFORMED, expert.severity.ERROR)
+spi.experts = { crc_error, trailing }
+
+local function reflect8(v)
+	local r = 0
+	for _ = 1, 8 do
+		r = bit.bor(bit.lshift(r, 1), bit.band(v, 1))
+		v = bit.rshift(v, 1)
+	end
+	return r
+end
+
+local function crc8(tvb, offset, len, c)
+	local crc = c.init
+	for i = offset, offset + len - 1 do
+		local b = tvb(i, 1):uint()
+		if c.refin then
+			b = reflect8(b)
+		end
+		crc = bit.bxor(crc, b)
+		for _ = 1, 8 do
+			if bit.band(crc, 0x80) ~= 0 then
+				crc = bit.band(bit.bxor(bit.lshift(crc, 1), c.poly), 0xff)
+			else
+				crc = bit.band(bit.lshift(crc, 1), 0xff)
+			end
+		end
+	end
+	if c.refout then
+		crc = reflect8(crc)
+	end
+	return bit.bxor(crc, c.xorout)
+end
+
+function spi.dissector(tvb, pinfo, tree)
+	pinfo.cols.protocol = "DATALINK"
+
+	local datalen = spi.prefs.datalen
+	local flen = HDR_LEN + datalen + 1
+	local c = crc_types[spi.prefs.crc + 1]
+	local nframes = math.floor(tvb:len() / flen)
+
+	local root = tree:add(spi, tvb(), "bot_matrix datalink SPI, " .. nframes .. " frames")
+	pinfo.cols.info = nframes .. " frames"
+
+	for i = 0, nframes - 1 do
+		local off = i * flen
+		local id = tvb(off, 1):uint()
+
+		if id == 0 then
+			root:add(tvb(off, flen), "Null frame")
+		else
+			local ft = root:add(tvb(off, flen), "Frame " .. id)
+{{- range .Fields}}
+{{- if eq .Name "flags"}}
+{{- $off := .Offset}}
+			local flags = tvb(off + {{.Offset}}, {{.Size}}):uint()
+			local ftree = ft:add(f.flags, tvb(off + {{.Offset}}, {{.Size}}))
+{{- range $.Flags}}
+			ftree:add(f.flag_{{.Name}}, tvb(off + {{$off}}, 1))
+{{- end}}
+			if bit.band(flags, FLAG_LENGTH) ~= 0 then
+				ft:add(f.length, tvb(off + HDR_LEN + datalen - 1, 1))
+			end
+{{- else if eq .Name "crc"}}
+			local crc = tvb(off + {{.Offset}}, {{.Size}}):uint()
+			local citem = ft:add(f.crc, tvb(off + {{.Offset}}, {{.Size}}))
+			if crc8(tvb, off, {{.Offset}}, c) == crc then
+				citem:append_text(" [correct]")
+			else
+				citem:add_proto_expert_info(crc_error)
+			end
+{{- else}}
+			ft:add(f.{{.Name}}, tvb(off + {{.Offset}}, {{.Size}}))
+{{- end}}
+{{- end}}
+		end
+	end
+
+	if tvb:len() % flen ~= 0 then
+		root:add_proto_expert_info(trailing)
+	end
+end
+
+DissectorTable.get("wtap_encap"):add((wtap_encaps or wtap).USER0, spi)
+
+--
+-- spibridge RPC. This is Go's net/rpc, which sends a stream of gob
+-- messages, each prefixed with its length.
+--
+
+local rpc = Proto("datalink_rpc", "bot_matrix datalink RPC")
+
+rpc.fields.len = ProtoField.uint32("datalink_rpc.len", "Message length", base.DEC)
+rpc.fields.type_id = ProtoField.int32("datalink_rpc.type_id", "Gob type ID", base.DEC)
+rpc.fields.method = ProtoField.string("datalink_rpc.method", "Method")
+rpc.fields.payload = ProtoField.bytes("datalink_rpc.payload", "Payload")
+
+local methods = {
+{{- range .Methods}}
+	"{{.}}",
+{{- end}}
+}
+
+-- Returns a gob unsigned integer and its size, or nil if incomplete
+local function gob_uint(tvb, off)
+	if tvb:len() <= off then
+		return nil
+	end
+
+	local b = tvb(off, 1):uint()
+	if b < 128 then
+		return b, 1
+	end
+
+	local n = 256 - b
+	if tvb:len() < off + 1 + n then
+		return nil
+	end
+
+	local v = 0
+	for i = 1, n do
+		v = v * 256 + tvb(off + i, 1):uint()
+	end
+	return v, n + 1
+end
+
+local function gob_int(tvb, off)
+	local u, n = gob_uint(tvb, off)
+	if u == nil then
+		return nil
+	end
+
+	if u % 2 == 1 then
+		return -math.floor(u / 2) - 1, n
+	end
+	return math.floor(u / 2), n
+end
+
+local function rpc_pdu_len(tvb, pinfo, off)
+	local v, n = gob_uint(tvb, off)
+	if v == nil then
+		return -DESEGMENT_ONE_MORE_SEGMENT
+	end
+	return v + n
+end
+
+local function rpc_pdu(tvb, pinfo, tree)
+	local v, n = gob_uint(tvb, 0)
+	local t = tree:add(rpc, tvb(), "bot_matrix datalink RPC message")
+	t:add(rpc.fields.len, tvb(0, n), v)
+
+	local tid, tn = gob_int(tvb, n)
+	if tid ~= nil then
+		local item = t:add(rpc.fields.type_id, tvb(n, tn), tid)
+		if tid < 0 then
+			item:append_text(" (type definition)")
+		end
+	end
+
+	-- methods is longest first, so prefixes of other names don't match
+	local raw = tvb():raw()
+	for _, m in ipairs(methods) do
+		if string.find(raw, m, 1, true) then
+			t:add(rpc.fields.method, m)
+			pinfo.cols.info:append(" " .. m)
+			break
+		end
+	end
+
+	if tvb:len() > n then
+		t:add(rpc.fields.payload, tvb(n))
+	end
+
+	return tvb:len()
+end
+
+function rpc.dissector(tvb, pinfo, tree)
+	pinfo.cols.protocol = "DATALINK-RPC"
+	dissect_tcp_pdus(tvb, tree, 1, rpc_pdu_len, rpc_pdu)
+	return tvb:len()
+end
+
+DissectorTable.get("tcp.port"):add({{.Port}}, rpc)
+`))
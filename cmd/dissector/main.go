@@ -0,0 +1,172 @@
+// Command dissector generates a Wireshark Lua dissector for the SPI frame
+// format and the spibridge RPC protocol, from the definitions in spiconn
+// and rpcconn.
+//
+// Install the output in Wireshark's personal plugins directory. SPI
+// transfers are dissected from pcap files with link type USER0 (147), one
+// transfer per packet.
+//
+// Captures recorded with the shell's -capture flag are in the capture
+// package's own format. Convert them with -export, then open the result
+// in Wireshark:
+//
+//	dissector -export spi.dlcp -o spi.pcap
+//
+// Only the transfers are exported, so the capture must have been recorded
+// at the Transport, as the shell does for a SPI device.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/usedbytes/bot_matrix/datalink/capture"
+	"github.com/usedbytes/bot_matrix/datalink/rpcconn"
+	"github.com/usedbytes/bot_matrix/datalink/spiconn"
+)
+
+type field struct {
+	spiconn.FrameField
+	// Lua expressions for the field's offset within a frame, and size
+	Offset string
+	Size string
+}
+
+type crcType struct {
+	Name string
+	Poly, Init, XorOut uint8
+	RefIn, RefOut bool
+}
+
+type params struct {
+	Fields []field
+	Flags []spiconn.FrameFlag
+	HdrLen int
+	DataLen int
+	CRCs []crcType
+	Methods []string
+	Port int
+}
+
+func getParams() (*params, error) {
+	p := &params{
+		Flags: spiconn.FrameFlags,
+		DataLen: spiconn.DefaultConfig.DataLen,
+		Methods: append([]string{}, rpcconn.Methods...),
+		Port: rpcconn.DefaultPort,
+	}
+
+	sort.SliceStable(p.Methods, func(i, j int) bool {
+		return len(p.Methods[i]) > len(p.Methods[j])
+	})
+
+	// Offsets are a constant, plus datalen once we're past the data
+	offset, pastData := 0, false
+	for _, f := range spiconn.FrameFields {
+		off := fmt.Sprint(offset)
+		if pastData {
+			off += " + datalen"
+		}
+
+		size := fmt.Sprint(f.Size)
+		if f.Size == 0 {
+			size = "datalen"
+			pastData = true
+		} else if f.Name != "crc" {
+			p.HdrLen += f.Size
+		}
+
+		p.Fields = append(p.Fields, field{ f, off, size })
+		offset += f.Size
+	}
+
+	for _, name := range []string{ "id", "flags", "data", "crc" } {
+		found := false
+		for _, f := range p.Fields {
+			found = found || f.Name == name
+		}
+		if !found {
+			return nil, fmt.Errorf("spiconn.FrameFields has no %q field", name)
+		}
+	}
+
+	for _, c := range spiconn.CRCTypes {
+		p.CRCs = append(p.CRCs, crcType{
+			Name: c.Name,
+			Poly: c.Poly,
+			Init: c.Init,
+			XorOut: c.XorOut,
+			RefIn: c.RefIn,
+			RefOut: c.RefOut,
+		})
+	}
+
+	return p, nil
+}
+
+func generate(w io.Writer) error {
+	p, err := getParams()
+	if err != nil {
+		return err
+	}
+
+	return luaTemplate.Execute(w, p)
+}
+
+// export converts the capture file at path to pcap
+func export(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := capture.NewReader(f)
+	if err != nil {
+		return err
+	}
+
+	n, err := capture.ExportPcap(w, r)
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return fmt.Errorf("No transfers in %s", path)
+	}
+
+	return nil
+}
+
+func main() {
+	var out, in string
+
+	flag.StringVar(&out, "o", "", "Output file (default stdout)")
+	flag.StringVar(&in, "export", "", "Convert this capture file to pcap, instead of generating the dissector")
+	flag.Parse()
+
+	w := os.Stdout
+	if len(out) > 0 {
+		f, err := os.Create(out)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	var err error
+	if len(in) > 0 {
+		err = export(w, in)
+	} else {
+		err = generate(w)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
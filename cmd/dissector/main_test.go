@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden file")
+
+const golden = "testdata/datalink.lua"
+
+func TestGolden(t *testing.T) {
+	buf := new(bytes.Buffer)
+	err := generate(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *update {
+		err = os.WriteFile(golden, buf.Bytes(), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expect, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(buf.Bytes(), expect) {
+		t.Errorf("Generated dissector doesn't match %s. Run go test -update to regenerate it.\n",
+			golden)
+	}
+}
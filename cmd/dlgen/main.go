@@ -0,0 +1,166 @@
+// Command dlgen generates code from an endpoint schema (see package
+// schema): a typed Go client, and a C header for the firmware.
+//
+// It's intended for go:generate, for example:
+//
+//	//go:generate go run github.com/usedbytes/bot_matrix/datalink/cmd/dlgen -schema motor.json -go motor_gen.go -c motor.h
+//
+// The Go package name defaults to $GOPACKAGE, which go generate sets.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/usedbytes/bot_matrix/datalink/schema"
+)
+
+type params struct {
+	*schema.Schema
+	Source string
+	Package string
+}
+
+// snake converts a Go style name to snake case, e.g. SetPoint to
+// set_point, and LEDState to led_state
+func snake(s string) string {
+	r := []rune(s)
+	out := []rune{}
+	for i, c := range r {
+		if i > 0 && unicode.IsUpper(c) {
+			prev := r[i - 1]
+			next := i + 1 < len(r) && unicode.IsLower(r[i + 1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && next) {
+				out = append(out, '_')
+			}
+		}
+		out = append(out, unicode.ToLower(c))
+	}
+	return string(out)
+}
+
+func upper(s string) string {
+	return strings.ToUpper(snake(s))
+}
+
+func goType(f schema.Field) string {
+	if f.Count > 0 {
+		return fmt.Sprintf("[%d]%s", f.Count, f.Type)
+	}
+	return f.Type
+}
+
+var cTypes = map[string]string{
+	"bool": "uint8_t",
+	"uint8": "uint8_t", "int8": "int8_t",
+	"uint16": "uint16_t", "int16": "int16_t",
+	"uint32": "uint32_t", "int32": "int32_t",
+	"uint64": "uint64_t", "int64": "int64_t",
+	"float32": "float", "float64": "double",
+}
+
+func cType(f schema.Field) string {
+	if f.Fixed > 0 {
+		return "int32_t"
+	}
+	return cTypes[f.Type]
+}
+
+// notes describes a field's units and encoding, for comments
+func notes(f schema.Field) string {
+	n := []string{}
+	if f.Doc != "" {
+		n = append(n, f.Doc)
+	}
+	if f.Units != "" {
+		n = append(n, "units: " + f.Units)
+	}
+	if f.Fixed > 0 {
+		n = append(n, fmt.Sprintf("%d.%d fixed point", 32 - f.Fixed, f.Fixed))
+	}
+	if f.Endian == "be" {
+		n = append(n, "big endian")
+	}
+	return strings.Join(n, ", ")
+}
+
+func generateGo(w io.Writer, p *params) error {
+	buf := new(bytes.Buffer)
+	err := goTemplate.Execute(buf, p)
+	if err != nil {
+		return err
+	}
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("Generated invalid Go: %v", err)
+	}
+
+	_, err = w.Write(src)
+	return err
+}
+
+func generateC(w io.Writer, p *params) error {
+	return cTemplate.Execute(w, p)
+}
+
+func writeFile(path string, p *params, gen func(io.Writer, *params) error) error {
+	buf := new(bytes.Buffer)
+	err := gen(buf, p)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, buf.Bytes(), 0644)
+}
+
+func main() {
+	var schemaPath, goOut, cOut, pkg string
+
+	flag.StringVar(&schemaPath, "schema", "", "Schema file")
+	flag.StringVar(&goOut, "go", "", "Go output file")
+	flag.StringVar(&cOut, "c", "", "C header output file")
+	flag.StringVar(&pkg, "pkg", os.Getenv("GOPACKAGE"), "Go package name")
+	flag.Parse()
+
+	fail := func(err error) {
+		fmt.Fprintln(os.Stderr, "dlgen:", err)
+		os.Exit(1)
+	}
+
+	if schemaPath == "" || (goOut == "" && cOut == "") {
+		fail(fmt.Errorf("Need -schema, and at least one of -go and -c"))
+	}
+
+	s, err := schema.Load(schemaPath)
+	if err != nil {
+		fail(err)
+	}
+
+	p := &params{ Schema: s, Source: filepath.Base(schemaPath), Package: pkg }
+
+	if goOut != "" {
+		if pkg == "" {
+			fail(fmt.Errorf("No package name. Use -pkg, or run from go generate"))
+		}
+
+		err = writeFile(goOut, p, generateGo)
+		if err != nil {
+			fail(err)
+		}
+	}
+
+	if cOut != "" {
+		err = writeFile(cOut, p, generateC)
+		if err != nil {
+			fail(err)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/usedbytes/bot_matrix/datalink/schema"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+func TestSnake(t *testing.T) {
+	for in, expected := range map[string]string{
+		"SetPoint": "set_point",
+		"LED": "led",
+		"LEDState": "led_state",
+		"Kc": "kc",
+		"Ch2Duty": "ch2_duty",
+	} {
+		if s := snake(in); s != expected {
+			t.Errorf("snake(%q): expected %q, got %q\n", in, expected, s)
+		}
+	}
+}
+
+func TestGolden(t *testing.T) {
+	s, err := schema.Load("testdata/example.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &params{ Schema: s, Source: "example.json", Package: "example" }
+
+	for golden, gen := range map[string]func(io.Writer, *params) error{
+		"testdata/example.go.golden": generateGo,
+		"testdata/example.h.golden": generateC,
+	} {
+		buf := new(bytes.Buffer)
+		err := gen(buf, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if *update {
+			err = os.WriteFile(golden, buf.Bytes(), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		expect, err := os.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(buf.Bytes(), expect) {
+			t.Errorf("Generated code doesn't match %s. Run go test -update to regenerate it.\n",
+				golden)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"text/template"
+)
+
+var funcs = template.FuncMap{
+	"snake": snake,
+	"upper": upper,
+	"goType": goType,
+	"cType": cType,
+	"notes": notes,
+}
+
+var goTemplate = template.Must(template.New("go").Funcs(funcs).Parse(`// Code generated by dlgen from {{.Source}}. DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+	"github.com/usedbytes/bot_matrix/datalink"
+	"github.com/usedbytes/bot_matrix/datalink/codec"
+)
+
+const (
+{{- range .Endpoints}}
+	Endpoint{{.Name}} uint8 = {{.Endpoint}}
+{{- end}}
+)
+{{- define "fields"}}
+{{- range .}}
+	{{.Name}} {{goType .}} {{.Tag}}{{with notes .}} // {{.}}{{end}}
+{{- end}}
+{{- end}}
+{{range .Endpoints}}
+{{- if .Fields}}
+// {{.Name}} is the request to Endpoint{{.Name}}{{with .Doc}}: {{.}}{{end}}
+type {{.Name}} struct {
+{{- template "fields" .Fields}}
+}
+{{end}}
+{{- if .Response}}
+// {{.Name}}Response is the response from Endpoint{{.Name}}
+type {{.Name}}Response struct {
+{{- template "fields" .Response}}
+}
+{{end}}
+{{- end}}
+// {{.Name}}Client has a method for each endpoint{{with .Doc}} of the {{.}}{{end}}
+type {{.Name}}Client struct {
+{{- range .Endpoints}}
+	ep{{.Name}} *datalink.Client
+{{- end}}
+}
+
+// New{{.Name}}Client creates a client with its own Mux over t
+func New{{.Name}}Client(t datalink.Transactor) (*{{.Name}}Client, error) {
+	return New{{.Name}}ClientMux(datalink.NewMux(t, nil))
+}
+
+// New{{.Name}}ClientMux creates a client which registers its endpoints
+// with m
+func New{{.Name}}ClientMux(m *datalink.Mux) (*{{.Name}}Client, error) {
+	c := &{{.Name}}Client{}
+
+	var err error
+{{- range .Endpoints}}
+	c.ep{{.Name}}, err = m.Register(Endpoint{{.Name}}, nil)
+	if err != nil {
+		return nil, err
+	}
+{{- end}}
+
+	return c, nil
+}
+{{range .Endpoints}}
+{{- if eq .Direction "out"}}
+{{- if .Fields}}
+// Set{{.Name}} sends v to Endpoint{{.Name}}
+func (c *{{$.Name}}Client) Set{{.Name}}(v {{.Name}}) error {
+	data, err := codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return c.ep{{.Name}}.Send(data)
+}
+{{else}}
+// {{.Name}} sends an empty packet to Endpoint{{.Name}}
+func (c *{{$.Name}}Client) {{.Name}}() error {
+	return c.ep{{.Name}}.Send(nil)
+}
+{{end}}
+{{- else if eq .Direction "in"}}
+// Get{{.Name}} reads from Endpoint{{.Name}}
+func (c *{{$.Name}}Client) Get{{.Name}}() ({{.Name}}Response, error) {
+	var resp {{.Name}}Response
+	err := codec.Request(c.ep{{.Name}}, struct{}{}, &resp)
+
+	return resp, err
+}
+{{else}}
+// {{.Name}} sends v to Endpoint{{.Name}}, and returns the response
+func (c *{{$.Name}}Client) {{.Name}}(v {{.Name}}) ({{.Name}}Response, error) {
+	var resp {{.Name}}Response
+	err := codec.Request(c.ep{{.Name}}, v, &resp)
+
+	return resp, err
+}
+{{end}}
+{{- end}}`))
+
+var cTemplate = template.Must(template.New("c").Funcs(funcs).Parse(`/* Code generated by dlgen from {{.Source}}. DO NOT EDIT. */
+{{- $prefix := upper .Name}}
+{{- $struct := snake .Name}}
+#ifndef __{{$prefix}}_H__
+#define __{{$prefix}}_H__
+
+#include <stdint.h>
+{{- define "cfields"}}
+{{- range .}}
+	{{cType .}} {{snake .Name}}{{if .Count}}[{{.Count}}]{{end}};{{with notes .}} /* {{.}} */{{end}}
+{{- if .Pad}}
+	uint8_t _pad_{{snake .Name}}[{{.Pad}}];
+{{- end}}
+{{- end}}
+{{- end}}
+
+/* Multi-byte fields are little endian unless noted */
+{{range .Endpoints}}
+#define {{$prefix}}_EP_{{upper .Name}} {{.Endpoint}}
+{{- end}}
+{{range .Endpoints}}
+{{- if .Fields}}
+/* {{.Name}} request ({{.Direction}}){{with .Doc}}: {{.}}{{end}} */
+struct {{$struct}}_{{snake .Name}} {
+{{- template "cfields" .Fields}}
+} __attribute__((packed));
+{{end}}
+{{- if .Response}}
+/* {{.Name}} response{{if not .Fields}} ({{.Direction}}){{with .Doc}}: {{.}}{{end}}{{end}} */
+struct {{$struct}}_{{snake .Name}}_response {
+{{- template "cfields" .Response}}
+} __attribute__((packed));
+{{end}}
+{{- end}}
+#endif /* __{{$prefix}}_H__ */
+`))
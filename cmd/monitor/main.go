@@ -0,0 +1,132 @@
+// Command monitor polls a device's In endpoints, and shows the values in a
+// terminal, with their recent history, error counts and link statistics.
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/usedbytes/bot_matrix/datalink"
+	"github.com/usedbytes/bot_matrix/datalink/discovery"
+	"github.com/usedbytes/bot_matrix/datalink/motor"
+	"github.com/usedbytes/bot_matrix/datalink/rpcconn"
+	"github.com/usedbytes/bot_matrix/datalink/schema"
+	"github.com/usedbytes/bot_matrix/datalink/sim"
+	"github.com/usedbytes/bot_matrix/datalink/spiconn"
+)
+
+const (
+	home = "\x1b[H"
+	clearLine = "\x1b[K"
+	clearBelow = "\x1b[J"
+	hideCursor = "\x1b[?25l"
+	showCursor = "\x1b[?25h"
+)
+
+func main() {
+	var devname string
+	var legacy bool
+	var schemaFile string
+	var discover bool
+	var endpoints string
+	var interval time.Duration
+	var history int
+	var c datalink.Transactor
+	var stats func() (datalink.Stats, error)
+	var err error
+
+	flag.StringVar(&devname, "devname", "/dev/spidev0.0", "Device to use for communication. Use tcp:.... for RPCConn, sim for a simulated motor controller")
+	flag.BoolVar(&legacy, "legacy", false, "Use the legacy SPI protocol, for old firmware")
+	flag.StringVar(&schemaFile, "schema", "", "Schema file describing the endpoints. The default is the motor controller's")
+	flag.BoolVar(&discover, "discover", false, "Ask the device for its schema")
+	flag.StringVar(&endpoints, "endpoints", "", "Comma separated names of the endpoints to poll. The default is all In endpoints")
+	flag.DurationVar(&interval, "interval", 200 * time.Millisecond, "Time between polls")
+	flag.IntVar(&history, "history", 40, "Number of samples to show in each sparkline")
+	flag.Parse()
+
+	if history < 1 {
+		fmt.Println("-history must be at least 1")
+		os.Exit(1)
+	}
+
+	if strings.HasPrefix(devname, "tcp:") {
+		var client *rpcconn.RPCClient
+		client, err = rpcconn.NewRPCClient(devname[len("tcp:"):])
+		if err == nil {
+			c, stats = client, client.Stats
+		}
+	} else if devname == "sim" {
+		c, err = sim.NewMotor(sim.DefaultMotorConfig)
+	} else {
+		cfg := spiconn.DefaultConfig
+		if legacy {
+			cfg = spiconn.LegacyConfig
+		}
+
+		var conn *spiconn.SPIConn
+		conn, err = spiconn.NewSPIConnConfig(devname, cfg)
+		if err == nil {
+			c = conn
+			stats = func() (datalink.Stats, error) {
+				return conn.Stats(), nil
+			}
+		}
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	sc := motor.Schema()
+	if len(schemaFile) > 0 {
+		sc, err = schema.Load(schemaFile)
+	} else if discover {
+		sc, err = discovery.Discover(c)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	var names []string
+	if len(endpoints) > 0 {
+		names = strings.Split(endpoints, ",")
+	}
+
+	m, err := newMonitor(c, sc, names, history, interval)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	m.stats = stats
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	m.poll()
+	go m.periodic.Run(ctx)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	fmt.Print(hideCursor)
+	buf := new(bytes.Buffer)
+	for {
+		buf.Reset()
+		m.render(buf)
+		fmt.Print(home + strings.ReplaceAll(buf.String(), "\n", clearLine + "\n") + clearBelow)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			fmt.Print(showCursor)
+			return
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/usedbytes/bot_matrix/datalink"
+	"github.com/usedbytes/bot_matrix/datalink/motor"
+	"github.com/usedbytes/bot_matrix/datalink/schema"
+	"github.com/usedbytes/bot_matrix/datalink/sim"
+)
+
+func TestSparkline(t *testing.T) {
+	for _, tc := range []struct{
+		values []float64
+		expected string
+	}{
+		{ nil, "" },
+		{ []float64{ 3, 3 }, "▁▁" },
+		{ []float64{ 0, 1, 2, 3, 4, 5, 6, 7 }, "▁▂▃▄▅▆▇█" },
+		{ []float64{ -10, 10, 0 }, "▁█▅" },
+	} {
+		if s := sparkline(tc.values); s != tc.expected {
+			t.Errorf("%v: expected %q, got %q\n", tc.values, tc.expected, s)
+		}
+	}
+}
+
+var ansi = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+func TestMonitor(t *testing.T) {
+	// Without dead time, so the response starts at once
+	cfg := sim.DefaultMotorConfig
+	cfg.Delay = 0
+
+	now := time.Unix(0, 0)
+	sm, err := sim.NewMotor(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.Now = func() time.Time { return now }
+
+	m, err := newMonitor(sm, motor.Schema(), nil, 4, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.stats = func() (datalink.Stats, error) {
+		return datalink.Stats{}, fmt.Errorf("No stats")
+	}
+
+	mc, err := motor.NewMotorController(sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc.SetDuty(0, motor.Forward, 1)
+
+	for i := 0; i < 5; i++ {
+		m.poll()
+		now = now.Add(cfg.Tau)
+	}
+
+	buf := new(bytes.Buffer)
+	m.render(buf)
+	out := ansi.ReplaceAllString(buf.String(), "")
+
+	for _, line := range []string{
+		"Telemetry (endpoint 7)  polls 5  errors 0",
+		"  Speed               982          ▁▆▇█  632 .. 982",
+		"  Current              86 mA       █▃▂▁  86 .. 785",
+		"  Duty              65535 1/65536  ▁▁▁▁  65535 .. 65535",
+		"Link: No stats",
+	} {
+		if !strings.Contains(out, line + "\n") {
+			t.Errorf("Expected line %q in:\n%s\n", line, out)
+		}
+	}
+
+	// Without a handler the request goes unanswered
+	sm.Handle(motor.EndpointTelemetry, nil)
+	m.poll()
+
+	buf.Reset()
+	m.render(buf)
+	if !strings.Contains(buf.String(), "errors 1") || !strings.Contains(buf.String(), "last error: No response on endpoint 7") {
+		t.Errorf("Expected an error in:\n%s\n", buf.String())
+	}
+}
+
+func TestMonitorEndpoints(t *testing.T) {
+	sc := motor.Schema()
+
+	for _, tc := range []struct{
+		names []string
+		prefix string
+	}{
+		{ []string{ "telemetry", "bogus" }, "No endpoint called bogus" },
+		{ []string{ "freq" }, "Endpoint Freq can't be polled" },
+		{ nil, "" },
+	} {
+		_, err := newMonitor(sim.NewPeer(), sc, tc.names, 10, time.Second)
+		if tc.prefix == "" {
+			if err != nil {
+				t.Errorf("%v: unexpected error %v\n", tc.names, err)
+			}
+			continue
+		}
+		if err == nil || !strings.HasPrefix(err.Error(), tc.prefix) {
+			t.Errorf("%v: expected '%s' error, got: %v\n", tc.names, tc.prefix, err)
+		}
+	}
+
+	_, err := newMonitor(sim.NewPeer(), &schema.Schema{ Name: "Empty" }, nil, 10, time.Second)
+	if err == nil || err.Error() != "No endpoints to monitor" {
+		t.Errorf("Expected no endpoints error, got: %v\n", err)
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/usedbytes/bot_matrix/datalink"
+	"github.com/usedbytes/bot_matrix/datalink/codec"
+	"github.com/usedbytes/bot_matrix/datalink/schema"
+	"github.com/usedbytes/bot_matrix/datalink/sched"
+)
+
+const (
+	red = "\x1b[31m"
+	bold = "\x1b[1m"
+	reset = "\x1b[0m"
+)
+
+var sparks = []rune("▁▂▃▄▅▆▇█")
+
+// sparkline draws values, scaled between their minimum and maximum
+func sparkline(values []float64) string {
+	if len(values) == 0 {
+		return ""
+	}
+
+	min, max := values[0], values[0]
+	for _, v := range values {
+		min, max = math.Min(min, v), math.Max(max, v)
+	}
+
+	out := make([]rune, len(values))
+	for i, v := range values {
+		idx := 0
+		if max > min {
+			idx = int((v - min) / (max - min) * float64(len(sparks) - 1) + 0.5)
+		}
+		out[i] = sparks[idx]
+	}
+
+	return string(out)
+}
+
+// series is the history of one value in a response
+type series struct {
+	name string
+	units string
+	integer bool
+	values []float64
+}
+
+func (s *series) add(v float64, history int) {
+	s.values = append(s.values, v)
+	if len(s.values) > history {
+		s.values = s.values[len(s.values) - history:]
+	}
+}
+
+func (s *series) format(v float64) string {
+	if s.integer {
+		return fmt.Sprintf("%.0f", v)
+	}
+	return fmt.Sprintf("%.4g", v)
+}
+
+// watched is an endpoint being polled
+type watched struct {
+	ep schema.Endpoint
+	typ reflect.Type
+	series []*series
+
+	polls, errors int
+	lastErr error
+
+	// Set while a request is waiting for its response, for misses polls
+	waiting bool
+	misses int
+}
+
+// A request is given up on if there's no response after this many polls
+const maxPolls = 8
+
+// flatten appends the numeric values in v, which may be a struct or array
+func flatten(v reflect.Value, out []float64) []float64 {
+	switch v.Kind() {
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			out = flatten(v.Field(i), out)
+		}
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			out = flatten(v.Index(i), out)
+		}
+	case reflect.Bool:
+		b := 0.0
+		if v.Bool() {
+			b = 1
+		}
+		out = append(out, b)
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		out = append(out, float64(v.Int()))
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		out = append(out, float64(v.Uint()))
+	case reflect.Float32, reflect.Float64:
+		out = append(out, v.Float())
+	}
+	return out
+}
+
+func newWatched(ep schema.Endpoint) *watched {
+	w := &watched{
+		ep: ep,
+		typ: schema.StructOf(ep.Response),
+	}
+
+	for _, f := range ep.Response {
+		integer := f.Fixed == 0 && f.Type != "float32" && f.Type != "float64"
+		names := []string{ f.Name }
+		if f.Count > 0 {
+			names = names[:0]
+			for i := 0; i < f.Count; i++ {
+				names = append(names, fmt.Sprintf("%s[%d]", f.Name, i))
+			}
+		}
+
+		for _, n := range names {
+			w.series = append(w.series, &series{ name: n, units: f.Units, integer: integer })
+		}
+	}
+
+	return w
+}
+
+// request returns the packets to send: a request, unless the last one is
+// still waiting for its response
+func (w *watched) request() []datalink.Packet {
+	if w.waiting {
+		return nil
+	}
+
+	w.polls++
+	w.waiting = true
+	w.misses = 0
+
+	return []datalink.Packet{ { Endpoint: w.ep.Endpoint } }
+}
+
+// response records the result of a transaction. The peer may respond to
+// a request in a later transaction.
+func (w *watched) response(rx []datalink.Packet, err error, history int) {
+	if err == nil && len(rx) == 0 {
+		if !w.waiting {
+			return
+		}
+
+		w.misses++
+		if w.misses <= maxPolls {
+			return
+		}
+		err = fmt.Errorf("No response on endpoint %d", w.ep.Endpoint)
+	}
+	w.waiting = false
+
+	for _, p := range rx {
+		if err != nil {
+			break
+		}
+
+		resp := reflect.New(w.typ)
+		err = codec.Unmarshal(p.Data, resp.Interface())
+		if err == nil {
+			for i, v := range flatten(resp.Elem(), nil) {
+				w.series[i].add(v, history)
+			}
+		}
+	}
+
+	if err != nil {
+		w.errors++
+		w.lastErr = err
+	}
+}
+
+type monitor struct {
+	t datalink.Transactor
+	periodic *sched.Periodic
+
+	title string
+	history int
+	stats func() (datalink.Stats, error)
+
+	// Protects the watched endpoints' state, which is updated by the
+	// Periodic's jobs
+	mu sync.Mutex
+	watched []*watched
+	eps map[uint8]bool
+	unsolicited uint64
+}
+
+// newMonitor watches the endpoints in sc with the given names, or all of
+// its In endpoints if names is empty, polling them every interval
+func newMonitor(t datalink.Transactor, sc *schema.Schema, names []string, history int, interval time.Duration) (*monitor, error) {
+	m := &monitor{
+		t: t,
+		title: sc.Name,
+		history: history,
+		eps: make(map[uint8]bool),
+	}
+	if sc.Doc != "" {
+		m.title += ": " + sc.Doc
+	}
+
+	// All the jobs have the same period, so are always merged
+	var err error
+	m.periodic, err = sched.NewPeriodic(m, interval / 10)
+	if err != nil {
+		return nil, err
+	}
+
+	want := make(map[string]bool)
+	for _, n := range names {
+		want[strings.ToLower(n)] = true
+	}
+
+	for _, e := range sc.Endpoints {
+		if len(names) > 0 && !want[strings.ToLower(e.Name)] {
+			continue
+		}
+		delete(want, strings.ToLower(e.Name))
+
+		if e.Direction == schema.Out || len(e.Fields) > 0 {
+			if len(names) > 0 {
+				return nil, fmt.Errorf("Endpoint %s can't be polled, it needs a request", e.Name)
+			}
+			continue
+		}
+
+		w := newWatched(e)
+		err := m.periodic.Add(sched.Job{
+			Name: e.Name,
+			Period: interval,
+			Packets: func() []datalink.Packet {
+				m.mu.Lock()
+				defer m.mu.Unlock()
+
+				return w.request()
+			},
+			Response: func(rx []datalink.Packet, err error) {
+				m.mu.Lock()
+				defer m.mu.Unlock()
+
+				w.response(rx, err, m.history)
+			},
+			Endpoints: []uint8{ e.Endpoint },
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		m.watched = append(m.watched, w)
+		m.eps[e.Endpoint] = true
+	}
+
+	for n := range want {
+		return nil, fmt.Errorf("No endpoint called %s", n)
+	}
+
+	if len(m.watched) == 0 {
+		return nil, fmt.Errorf("No endpoints to monitor")
+	}
+
+	return m, nil
+}
+
+// Transact is used by m.periodic, to count the packets received on
+// endpoints which aren't being watched
+func (m *monitor) Transact(tx []datalink.Packet) ([]datalink.Packet, error) {
+	rx, err := m.t.Transact(tx)
+
+	m.mu.Lock()
+	for _, p := range rx {
+		if !m.eps[p.Endpoint] {
+			m.unsolicited++
+		}
+	}
+	m.mu.Unlock()
+
+	return rx, err
+}
+
+func (m *monitor) waiting() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, w := range m.watched {
+		if w.waiting {
+			return true
+		}
+	}
+	return false
+}
+
+// poll requests all the endpoints now, and polls until each has responded
+// or been given up on
+func (m *monitor) poll() {
+	m.periodic.RunNow()
+	for m.waiting() {
+		m.periodic.RunNow()
+	}
+}
+
+// render draws the current state as text, with ANSI colours
+func (m *monitor) render(out io.Writer) {
+	// Stats may need a transaction, so mustn't hold up the polls
+	var s datalink.Stats
+	var statsErr error
+	if m.stats != nil {
+		s, statsErr = m.stats()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(out, "%s%s%s\n", bold, m.title, reset)
+
+	for _, w := range m.watched {
+		errColour := ""
+		if w.errors > 0 {
+			errColour = red
+		}
+
+		fmt.Fprintf(out, "\n%s%s%s (endpoint %d)  polls %d  %serrors %d%s\n",
+			bold, w.ep.Name, reset, w.ep.Endpoint, w.polls, errColour, w.errors, reset)
+
+		for _, s := range w.series {
+			cur, rng := "-", ""
+			if n := len(s.values); n > 0 {
+				min, max := s.values[0], s.values[0]
+				for _, v := range s.values {
+					min, max = math.Min(min, v), math.Max(max, v)
+				}
+				cur = s.format(s.values[n - 1])
+				rng = fmt.Sprintf("%s .. %s", s.format(min), s.format(max))
+			}
+
+			spark := sparkline(s.values)
+			spark += strings.Repeat(" ", m.history - utf8.RuneCountInString(spark))
+
+			fmt.Fprintf(out, "  %-12s %10s %-8s %s  %s\n", s.name, cur, s.units, spark, rng)
+		}
+
+		if w.lastErr != nil {
+			fmt.Fprintf(out, "  %slast error: %v%s\n", red, w.lastErr, reset)
+		}
+	}
+
+	fmt.Fprintln(out)
+	if n := m.unsolicited; n > 0 {
+		fmt.Fprintf(out, "Unsolicited packets: %d\n", n)
+	}
+
+	if m.stats == nil {
+		return
+	}
+
+	if statsErr != nil {
+		fmt.Fprintf(out, "Link: %s%v%s\n", red, statsErr, reset)
+		return
+	}
+
+	errColour := ""
+	if s.TransferErrors + s.ProtocolErrors > 0 {
+		errColour = red
+	}
+
+	fmt.Fprintf(out, "Link: %d transfers, %s%d transfer errors, %d protocol errors%s, %d retries\n",
+		s.Transfers, errColour, s.TransferErrors, s.ProtocolErrors, reset, s.Retries)
+	fmt.Fprintf(out, "      %.0f B/s, latency p50 %v, p99 %v, up %v\n",
+		s.Throughput(), s.Latency.P50, s.Latency.P99, s.Uptime.Round(time.Second))
+}
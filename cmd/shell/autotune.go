@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/usedbytes/bot_matrix/datalink/motor"
+)
+
+/*
+autotune runs an experiment on the motor, computes PID gains from the
+result, and sets them:
+
+	autotune method=relay setpoint=500
+	autotune method=step duty=0.5 rule=cc out=step.csv
+
+The relay method sets the set point with a very high gain, so that the PID
+switches between full forward and full reverse, and measures the
+oscillation. The gains are restored afterwards, so they must have been set
+with g first. The Ziegler-Nichols rule gives gains from its amplitude and
+period. The step method drives the motor open loop at duty from rest, and
+fits a first order plus dead time model to the response, for the
+Ziegler-Nichols or Cohen-Coon rules.
+*/
+
+const autotuneUsage = "autotune [method=<relay|step>] [setpoint=<n>] [duty=<fraction>] [ch=<n>] " +
+	"[rule=<zn|cc>] [duration=<duration>] [interval=<duration>] [apply=<on|off>] [out=<file.csv>]"
+
+const autotuneLong = "Usage: " + autotuneUsage + `
+
+method=relay needs a set point and gains set with g, which are restored
+afterwards, and only supports rule=zn. method=step
+drives channel ch at duty. The speed is recorded every interval for
+duration, and can be saved to out. The gains are printed, and set unless
+apply=off.
+
+Defaults: method=relay ch=0 duty=0.5 rule=zn duration=2s interval=5ms
+apply=on`
+
+type autotune struct {
+	relay bool
+	setpoint uint32
+	ch uint8
+	duty float64
+	rule motor.Rule
+	exp motor.Experiment
+	apply bool
+	out string
+}
+
+func parseAutotune(args []string) (autotune, error) {
+	at := autotune{
+		relay: true,
+		duty: 0.5,
+		rule: motor.ZieglerNichols,
+		exp: motor.Experiment{ Duration: 2 * time.Second, Interval: 5 * time.Millisecond },
+		apply: true,
+	}
+	haveSetpoint := false
+
+	for _, a := range args {
+		name, val, ok := strings.Cut(a, "=")
+		if !ok {
+			return at, fmt.Errorf("Usage: %s", autotuneUsage)
+		}
+
+		var err error
+		switch name {
+		case "method":
+			switch val {
+			case "relay", "step":
+				at.relay = val == "relay"
+			default:
+				err = fmt.Errorf("Invalid method %q", val)
+			}
+		case "setpoint":
+			var sp uint64
+			sp, err = parseUint("set point", val, 32)
+			at.setpoint, haveSetpoint = uint32(sp), true
+		case "duty":
+			at.duty, err = strconv.ParseFloat(val, 64)
+		case "ch":
+			var ch uint64
+			ch, err = parseUint("channel", val, 8)
+			at.ch = uint8(ch)
+		case "rule":
+			switch val {
+			case "zn":
+				at.rule = motor.ZieglerNichols
+			case "cc":
+				at.rule = motor.CohenCoon
+			default:
+				err = fmt.Errorf("Invalid rule %q", val)
+			}
+		case "duration":
+			at.exp.Duration, err = time.ParseDuration(val)
+		case "interval":
+			at.exp.Interval, err = time.ParseDuration(val)
+		case "apply":
+			at.apply, err = parseBool(val)
+		case "out":
+			at.out = val
+		default:
+			err = fmt.Errorf("Unknown option %q", name)
+		}
+		if err != nil {
+			return at, fmt.Errorf("%s: %v", name, err)
+		}
+	}
+
+	if at.relay && !haveSetpoint {
+		return at, fmt.Errorf("The relay method needs a set point")
+	}
+	if at.relay && at.rule != motor.ZieglerNichols {
+		return at, fmt.Errorf("The relay method only supports rule=zn")
+	}
+
+	return at, nil
+}
+
+func writeSamples(path string, samples []motor.Sample) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	cw := csv.NewWriter(f)
+	cw.Write([]string{ "t_s", "speed" })
+	for _, s := range samples {
+		cw.Write([]string{ formatFloat(s.T.Seconds()), formatFloat(s.Speed) })
+	}
+	cw.Flush()
+
+	if err = cw.Error(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (s *session) autotune(args []string) error {
+	at, err := parseAutotune(args)
+	if err != nil {
+		return err
+	}
+	at.exp.Now = s.now
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	var samples []motor.Sample
+	if at.relay {
+		samples, err = s.motor.RelayTest(ctx, at.exp, at.setpoint)
+	} else {
+		samples, err = s.motor.StepTest(ctx, at.exp, at.ch, at.duty)
+	}
+	if err != nil {
+		return fmt.Errorf("Experiment failed after %d samples: %v", len(samples), err)
+	}
+
+	if at.out != "" {
+		if err = writeSamples(at.out, samples); err != nil {
+			return err
+		}
+	}
+
+	var gains motor.Gains
+	if at.relay {
+		ku, pu, err := motor.Ultimate(samples, at.setpoint)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(s.out, "Relay test: %d samples, ultimate gain %.4g, period %v\n",
+			len(samples), ku, pu.Round(time.Millisecond / 10))
+		gains = motor.UltimateGains(ku, pu)
+	} else {
+		p, err := motor.FitStep(samples, at.duty)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(s.out, "Step test: %d samples, K %.4g, tau %v, theta %v\n",
+			len(samples), p.K, p.Tau.Round(time.Millisecond / 10), p.Theta.Round(time.Millisecond / 10))
+		gains, err = p.Gains(at.rule)
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(s.out, "%v gains: Kc %.4g, Kd %.4g, Ki %.4g\n", at.rule, gains.Kc, gains.Kd, gains.Ki)
+	if !at.apply {
+		return nil
+	}
+
+	err = s.motor.SetGains(gains)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(s.out, "Gains set")
+
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/usedbytes/bot_matrix/datalink/motor"
+	"github.com/usedbytes/bot_matrix/datalink/sim"
+)
+
+// newSimSession returns a session driving a simulated motor, with some
+// dead time for the step test to measure, whose clock moves on by step
+// each time autotune takes a sample
+func newSimSession(t *testing.T, step time.Duration) (*session, *sim.Motor, *time.Time, *bytes.Buffer) {
+	now := time.Unix(0, 0)
+	m, err := sim.NewMotor(sim.DefaultMotorConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Now = func() time.Time { return now }
+
+	out := new(bytes.Buffer)
+	s, err := newSession(out, m, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.addSchema(motor.Schema()); err != nil {
+		t.Fatal(err)
+	}
+
+	s.now = func() time.Time {
+		now = now.Add(step)
+		return now
+	}
+
+	return s, m, &now, out
+}
+
+func TestAutotune(t *testing.T) {
+	for _, args := range []string{
+		"method=step interval=0",
+		"method=step interval=0 rule=cc",
+		"method=relay setpoint=500 interval=0",
+	} {
+		s, m, now, out := newSimSession(t, time.Millisecond)
+
+		// The relay test restores the gains, so needs to know them
+		err := s.exec([]string{ "g", "0", "0", "0" })
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		path := filepath.Join(t.TempDir(), "samples.csv")
+		err = s.exec(append([]string{ "autotune", "out=" + path }, strings.Fields(args)...))
+		if err != nil {
+			t.Errorf("%s: %v\n", args, err)
+			continue
+		}
+
+		if tel := m.Telemetry(); tel.Duty != 0 {
+			t.Errorf("%s: expected the motor to be stopped, got %+v\n", args, tel)
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil || !strings.HasPrefix(string(data), "t_s,speed\n0,0\n0.001,") {
+			t.Errorf("%s: unexpected samples %.40q (%v)\n", args, data, err)
+		}
+
+		lines := strings.Split(out.String(), "\n")
+		if len(lines) != 4 || lines[2] != "Gains set" {
+			t.Errorf("%s: unexpected output:\n%s\n", args, out.String())
+		}
+
+		// The gains should hold the speed at the set point
+		err = s.exec([]string{ "sp", "300" })
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		*now = now.Add(time.Second)
+		if tel := m.Telemetry(); tel.Speed < 299 || tel.Speed > 301 {
+			t.Errorf("%s: expected the speed to settle at 300, got %+v\n", args, tel)
+		}
+
+		// and can be adjusted by hand from there
+		out.Reset()
+		err = s.exec([]string{ "settings" })
+		if err != nil || !strings.Contains(out.String(), "Gains:    Kc ") || s.lookup("g") == nil {
+			t.Errorf("%s: expected the gains in the settings, got %q (%v)\n", args, out.String(), err)
+		}
+	}
+}
+
+func TestAutotuneErrors(t *testing.T) {
+	s, m, _, out := newSimSession(t, time.Millisecond)
+
+	for _, tc := range []struct{
+		args string
+		prefix string
+	}{
+		{ "autotune", "The relay method needs a set point" },
+		{ "autotune setpoint=500 rule=cc", "The relay method only supports rule=zn" },
+		{ "autotune method=step duty=2", "Experiment failed after 1 samples: Invalid setting" },
+		{ "autotune method=bogus", "method: Invalid method" },
+		{ "autotune 500", "Usage: autotune" },
+		{ "autotune setpoint=500", "Experiment failed after 0 samples: The current gains aren't known" },
+	} {
+		err := s.exec(strings.Fields(tc.args))
+		if err == nil || !strings.HasPrefix(err.Error(), tc.prefix) {
+			t.Errorf("%q: expected '%s' error, got: %v\n", tc.args, tc.prefix, err)
+		}
+	}
+
+	// Too short to see any oscillation
+	if err := s.exec([]string{ "g", "0", "0", "0" }); err != nil {
+		t.Fatal(err)
+	}
+	err := s.exec(strings.Fields("autotune setpoint=500 duration=10ms interval=0"))
+	if err == nil || !strings.HasPrefix(err.Error(), "Too few oscillations") {
+		t.Errorf("Expected 'Too few oscillations' error, got: %v\n", err)
+	}
+
+	// Nothing is set with apply=off. The motor must be at rest for a
+	// step test, so start again.
+	s, m, _, out = newSimSession(t, time.Millisecond)
+	err = s.exec(strings.Fields("autotune method=step interval=0 apply=off"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g := s.motor.Settings().Gains; g != (motor.Gains{}) || strings.Contains(out.String(), "Gains set") {
+		t.Errorf("Gains set with apply=off: %+v\n%s\n", g, out.String())
+	}
+
+	// Without telemetry the experiment fails at once
+	m.Handle(motor.EndpointTelemetry, nil)
+	err = s.exec(strings.Fields("autotune method=step interval=0"))
+	if err == nil || !strings.HasPrefix(err.Error(), "Experiment failed after 0 samples") {
+		t.Errorf("Expected the experiment to fail, got %v\n", err)
+	}
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/usedbytes/bot_matrix/datalink"
+	"github.com/usedbytes/bot_matrix/datalink/dfu"
+	"github.com/usedbytes/bot_matrix/datalink/discovery"
+	"github.com/usedbytes/bot_matrix/datalink/motor"
+	"github.com/usedbytes/bot_matrix/datalink/schema"
+)
+
+// command is a shell command. run is passed the arguments after the
+// command's name.
+type command struct {
+	name string
+	args string
+	help string
+	run func(args []string) error
+
+	// Optional, for the interactive shell
+	long string
+	complete func(args []string) []string
+}
+
+// session holds everything the commands work on, so that they can be run
+// from the interactive shell or elsewhere
+type session struct {
+	out io.Writer
+
+	// t is the raw connection, for commands which bypass the Mux
+	t datalink.Transactor
+	mux *datalink.Mux
+	motor *motor.MotorController
+	disc *datalink.Client
+	stats func() (datalink.Stats, error)
+	// now timestamps the samples taken by autotune
+	now func() time.Time
+
+	// polls is the number of empty transactions send will make while
+	// waiting for a response
+	polls int
+	// last holds the packets received by the last send, poll or endpoint
+	// command, for expect
+	last []datalink.Packet
+
+	cmds []command
+}
+
+func newSession(out io.Writer, t datalink.Transactor, stats func() (datalink.Stats, error),
+		unsolicited datalink.Handler) (*session, error) {
+	s := &session{
+		out: out,
+		t: t,
+		mux: datalink.NewMux(t, unsolicited),
+		stats: stats,
+		now: time.Now,
+		polls: 8,
+	}
+
+	var err error
+	s.motor, err = motor.NewMotorControllerMux(s.mux)
+	if err != nil {
+		return nil, err
+	}
+
+	s.disc, err = s.mux.Register(discovery.Endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	s.cmds = s.commands()
+
+	return s, nil
+}
+
+func (s *session) commands() []command {
+	return []command{
+		{ name: "sp", args: "<setpoint>", help: "set the PID set point", run: s.setpoint },
+		{ name: "il", args: "<ilimit>", help: "set the PID integral limit", run: s.ilimit },
+		{ name: "g", args: "<Kc> <Kd> <Ki>", help: "set the PID gains", run: s.gains },
+		{ name: "led", args: "<on|off>", help: "set the LED", run: s.led },
+		{ name: "freq", args: "<Hz>", help: "set the PWM frequency", run: s.freq },
+		{ name: "duty", args: "<channel> <fwd|rev> <percent>", help: "set a PWM duty cycle", run: s.duty },
+		{ name: "stop", help: "set all duty cycles to zero", run: s.stop },
+		{ name: "settings", help: "print the motor settings sent so far", run: s.settings },
+		{
+			name: "sweep", args: "[name=value...]",
+			help: "step the motor through frequencies, directions and duty cycles, and write the telemetry as CSV",
+			long: sweepLong,
+			run: s.sweep,
+		},
+		{
+			name: "autotune", args: "[name=value...]",
+			help: "measure the motor's response, and set PID gains to suit",
+			long: autotuneLong,
+			run: s.autotune,
+		},
+		{
+			name: "send", args: "<ep> [data...]",
+			help: "send a raw packet, and dump the response. " +
+				"Data is a string of hex digits, or separate bytes (e.g. 1 0x2 0b11)",
+			run: s.send,
+		},
+		{ name: "poll", help: "poll for packets, and dump any received", run: s.poll },
+		{
+			name: "expect", args: "<none|ep [data...]>",
+			help: "check that the last send, poll or endpoint command received a packet",
+			run: s.expect,
+		},
+		{
+			name: "repeat", args: "<count> [interval] <command> [args...]",
+			help: "run a command count times",
+			run: s.repeat,
+		},
+		{ name: "wait", args: "<duration>", help: "do nothing for a while, e.g. wait 100ms", run: s.wait },
+		{ name: "dfu", args: "<file.bin|file.hex> [load address]", help: "firmware update", run: s.dfu },
+		{ name: "endpoints", help: "list the device's endpoints", run: s.endpoints },
+		{ name: "stats", help: "print link statistics", run: s.printStats },
+	}
+}
+
+func (s *session) lookup(name string) *command {
+	for i := range s.cmds {
+		if s.cmds[i].name == name {
+			return &s.cmds[i]
+		}
+	}
+	return nil
+}
+
+// exec runs the command named by args[0]
+func (s *session) exec(args []string) error {
+	if len(args) == 0 {
+		return nil
+	}
+
+	cmd := s.lookup(args[0])
+	if cmd == nil {
+		return fmt.Errorf("Unknown command %q", args[0])
+	}
+
+	return cmd.run(args[1:])
+}
+
+func nargs(args []string, min, max int, usage string) error {
+	if len(args) < min || len(args) > max {
+		return fmt.Errorf("Usage: %s", usage)
+	}
+	return nil
+}
+
+func parseUint(what, arg string, bits int) (uint64, error) {
+	v, err := strconv.ParseUint(arg, 0, bits)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %s %q", what, arg)
+	}
+	return v, nil
+}
+
+func (s *session) setpoint(args []string) error {
+	if err := nargs(args, 1, 1, "sp <setpoint>"); err != nil {
+		return err
+	}
+
+	sp, err := parseUint("setpoint", args[0], 32)
+	if err != nil {
+		return err
+	}
+
+	return s.motor.SetSetpoint(uint32(sp))
+}
+
+func (s *session) ilimit(args []string) error {
+	if err := nargs(args, 1, 1, "il <ilimit>"); err != nil {
+		return err
+	}
+
+	il, err := parseUint("ilimit", args[0], 32)
+	if err != nil {
+		return err
+	}
+
+	return s.motor.SetIlimit(uint32(il))
+}
+
+func (s *session) gains(args []string) error {
+	if err := nargs(args, 3, 3, "g <Kc> <Kd> <Ki>"); err != nil {
+		return err
+	}
+
+	var k [3]float64
+	for i, name := range []string{ "Kc", "Kd", "Ki" } {
+		var err error
+		k[i], err = strconv.ParseFloat(args[i], 64)
+		if err != nil {
+			return fmt.Errorf("Invalid %s %q", name, args[i])
+		}
+	}
+
+	return s.motor.SetGains(motor.Gains{ Kc: k[0], Kd: k[1], Ki: k[2] })
+}
+
+func (s *session) led(args []string) error {
+	if err := nargs(args, 1, 1, "led <on|off>"); err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "on", "1":
+		return s.motor.SetLED(true)
+	case "off", "0":
+		return s.motor.SetLED(false)
+	}
+	return fmt.Errorf("Expected on or off, not %q", args[0])
+}
+
+func (s *session) freq(args []string) error {
+	if err := nargs(args, 1, 1, "freq <Hz>"); err != nil {
+		return err
+	}
+
+	f, err := parseUint("frequency", args[0], 32)
+	if err != nil {
+		return err
+	}
+
+	return s.motor.SetFreq(uint32(f))
+}
+
+func (s *session) duty(args []string) error {
+	if err := nargs(args, 3, 3, "duty <channel> <fwd|rev> <percent>"); err != nil {
+		return err
+	}
+
+	ch, err := parseUint("channel", args[0], 8)
+	if err != nil {
+		return err
+	}
+
+	var dir motor.Direction
+	switch args[1] {
+	case "fwd", "forward":
+		dir = motor.Forward
+	case "rev", "reverse":
+		dir = motor.Reverse
+	default:
+		return fmt.Errorf("Expected fwd or rev, not %q", args[1])
+	}
+
+	pc, err := strconv.ParseFloat(strings.TrimSuffix(args[2], "%"), 64)
+	if err != nil {
+		return fmt.Errorf("Invalid duty %q", args[2])
+	}
+
+	return s.motor.SetDuty(uint8(ch), dir, pc / 100)
+}
+
+func (s *session) stop(args []string) error {
+	return s.motor.Stop()
+}
+
+func (s *session) settings(args []string) error {
+	printSettings(s.out, s.motor.Settings())
+	return nil
+}
+
+// parseData parses packet data, given either as a single string of hex
+// digits ("01ff"), or as separate bytes in Go syntax ("1 0xff 0b10")
+func parseData(args []string) ([]byte, error) {
+	if len(args) == 1 {
+		if data, err := hex.DecodeString(args[0]); err == nil {
+			return data, nil
+		}
+	}
+
+	data := make([]byte, 0, len(args))
+	for _, a := range args {
+		b, err := parseUint("byte", a, 8)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, byte(b))
+	}
+
+	return data, nil
+}
+
+func dumpPackets(w io.Writer, pkts []datalink.Packet) {
+	for _, p := range pkts {
+		fmt.Fprintf(w, "Endpoint %d, %d bytes\n", p.Endpoint, len(p.Data))
+		if len(p.Data) > 0 {
+			fmt.Fprint(w, hex.Dump(p.Data))
+		}
+	}
+}
+
+func (s *session) send(args []string) error {
+	if err := nargs(args, 1, 1 << 16, "send <ep> [data...]"); err != nil {
+		return err
+	}
+
+	ep, err := parseUint("endpoint", args[0], 8)
+	if err != nil {
+		return err
+	}
+
+	data, err := parseData(args[1:])
+	if err != nil {
+		return err
+	}
+
+	rx, err := s.t.Transact([]datalink.Packet{ { Endpoint: uint8(ep), Data: data } })
+	for i := 0; err == nil && len(rx) == 0 && i < s.polls; i++ {
+		rx, err = s.t.Transact(nil)
+	}
+	if err != nil {
+		return err
+	}
+	s.last = rx
+
+	if len(rx) == 0 {
+		fmt.Fprintln(s.out, "No response")
+	}
+	dumpPackets(s.out, rx)
+
+	return nil
+}
+
+func (s *session) poll(args []string) error {
+	rx, err := s.t.Transact(nil)
+	if err != nil {
+		return err
+	}
+	s.last = rx
+
+	dumpPackets(s.out, rx)
+	return nil
+}
+
+func (s *session) repeat(args []string) error {
+	usage := "repeat <count> [interval] <command> [args...]"
+	if err := nargs(args, 2, 1 << 16, usage); err != nil {
+		return err
+	}
+
+	n, err := parseUint("count", args[0], 32)
+	if err != nil {
+		return err
+	}
+	args = args[1:]
+
+	interval, err := time.ParseDuration(args[0])
+	if err == nil {
+		args = args[1:]
+		if len(args) == 0 {
+			return fmt.Errorf("Usage: %s", usage)
+		}
+	}
+
+	for i := uint64(0); i < n; i++ {
+		if i > 0 {
+			time.Sleep(interval)
+		}
+
+		err = s.exec(args)
+		if err != nil {
+			return fmt.Errorf("Iteration %d: %v", i + 1, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *session) dfu(args []string) error {
+	if err := nargs(args, 1, 2, "dfu <file.bin|file.hex> [load address]"); err != nil {
+		return err
+	}
+
+	addr := uint64(0)
+	if len(args) == 2 {
+		a, err := parseUint("load address", args[1], 32)
+		if err != nil {
+			return err
+		}
+		addr = a
+	}
+
+	img, err := dfu.LoadImage(args[0], uint32(addr))
+	if err != nil {
+		return err
+	}
+
+	u := dfu.NewUpdater(s.t)
+	u.Progress = func(done, total int) {
+		fmt.Fprintf(s.out, "\r%d / %d bytes", done, total)
+	}
+
+	err = u.Update(img)
+	fmt.Fprintln(s.out)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(s.out, "Wrote %d bytes at 0x%08x\n", len(img.Data), img.Addr)
+	return nil
+}
+
+func (s *session) endpoints(args []string) error {
+	sc, err := discovery.DiscoverClient(s.disc)
+	if err != nil {
+		return err
+	}
+
+	printEndpoints(s.out, sc)
+	return nil
+}
+
+func (s *session) printStats(args []string) error {
+	st, err := s.stats()
+	if err != nil {
+		return err
+	}
+
+	printStats(s.out, st)
+	return nil
+}
+
+func printStats(w io.Writer, s datalink.Stats) {
+	fmt.Fprintf(w, "Uptime:          %v\n", s.Uptime.Round(time.Second))
+	fmt.Fprintf(w, "Transfers:       %d\n", s.Transfers)
+	fmt.Fprintf(w, "Transfer errors: %d\n", s.TransferErrors)
+	fmt.Fprintf(w, "Protocol errors: %d\n", s.ProtocolErrors)
+	fmt.Fprintf(w, "Retries:         %d\n", s.Retries)
+	fmt.Fprintf(w, "Bytes:           %d sent, %d received\n", s.TxBytes, s.RxBytes)
+	fmt.Fprintf(w, "Throughput:      %.0f B/s\n", s.Throughput())
+	fmt.Fprintf(w, "Latency:         p50 %v, p90 %v, p99 %v, max %v (%d samples)\n",
+		s.Latency.P50, s.Latency.P90, s.Latency.P99, s.Latency.Max, s.Latency.Samples)
+}
+
+func printSettings(w io.Writer, s motor.Settings) {
+	fmt.Fprintf(w, "LED:      %v\n", s.LED)
+	fmt.Fprintf(w, "Freq:     %d Hz\n", s.Freq)
+	for ch := uint8(0); ch < motor.DefaultLimits.Channels; ch++ {
+		if d, ok := s.Duty[ch]; ok {
+			fmt.Fprintf(w, "Duty %d:   %.1f%% %v\n", ch, d.Duty * 100, d.Dir)
+		}
+	}
+	fmt.Fprintf(w, "Gains:    Kc %v, Kd %v, Ki %v\n", s.Gains.Kc, s.Gains.Kd, s.Gains.Ki)
+	fmt.Fprintf(w, "Setpoint: %d\n", s.Setpoint)
+	fmt.Fprintf(w, "Ilimit:   %d\n", s.Ilimit)
+}
+
+func printFields(w io.Writer, prefix string, fields []schema.Field) {
+	for _, f := range fields {
+		typ := f.Type
+		if f.Count > 0 {
+			typ = fmt.Sprintf("[%d]%s", f.Count, typ)
+		}
+		if f.Fixed > 0 {
+			typ += fmt.Sprintf(" (%d.%d fixed)", 32 - f.Fixed, f.Fixed)
+		}
+		if f.Endian == "be" {
+			typ += " (be)"
+		}
+
+		units := ""
+		if f.Units != "" {
+			units = " " + f.Units
+		}
+
+		fmt.Fprintf(w, "      %s %-10s %s%s\n", prefix, f.Name, typ, units)
+	}
+}
+
+func printEndpoints(w io.Writer, s *schema.Schema) {
+	fmt.Fprintf(w, "%s v%d", s.Name, s.Version)
+	if s.Doc != "" {
+		fmt.Fprintf(w, ": %s", s.Doc)
+	}
+	fmt.Fprintln(w)
+
+	for _, e := range s.Endpoints {
+		fmt.Fprintf(w, "  %3d %-12s %-5s v%d", e.Endpoint, e.Name, e.Direction, e.Version)
+		if e.Doc != "" {
+			fmt.Fprintf(w, "  %s", e.Doc)
+		}
+		fmt.Fprintln(w)
+
+		printFields(w, ">", e.Fields)
+		printFields(w, "<", e.Response)
+	}
+}
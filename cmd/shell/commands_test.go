@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/usedbytes/bot_matrix/datalink"
+	"github.com/usedbytes/bot_matrix/datalink/motor"
+	"github.com/usedbytes/bot_matrix/datalink/schema"
+	"github.com/usedbytes/bot_matrix/datalink/sim"
+)
+
+func TestParseData(t *testing.T) {
+	for _, tc := range []struct{
+		args string
+		expected []byte
+	}{
+		{ "", []byte{} },
+		{ "01ff", []byte{ 0x01, 0xff } },
+		{ "10", []byte{ 0x10 } },
+		{ "1", []byte{ 1 } },
+		{ "1 0x10 0b11 255", []byte{ 1, 0x10, 3, 255 } },
+	} {
+		data, err := parseData(strings.Fields(tc.args))
+		if err != nil || !bytes.Equal(data, tc.expected) {
+			t.Errorf("%q: expected %x, got %x (%v)\n", tc.args, tc.expected, data, err)
+		}
+	}
+
+	_, err := parseData([]string{ "1", "256" })
+	if err == nil {
+		t.Errorf("Expected an error for an out of range byte\n")
+	}
+}
+
+func newTestSession(t *testing.T, sc *schema.Schema) (*session, *sim.Peer, *bytes.Buffer) {
+	peer := sim.NewPeer()
+	out := new(bytes.Buffer)
+
+	s, err := newSession(out, peer, func() (datalink.Stats, error) {
+		return datalink.Stats{}, fmt.Errorf("No stats")
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.addSchema(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s, peer, out
+}
+
+func TestSend(t *testing.T) {
+	s, peer, out := newTestSession(t, motor.Schema())
+
+	n := 0
+	peer.Handle(9, func(data []byte) []byte {
+		n++
+		return append([]byte{ 0xaa }, data...)
+	})
+
+	err := s.exec([]string{ "repeat", "3", "1ms", "send", "9", "01ff" })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 3 {
+		t.Errorf("Expected 3 sends, got %d\n", n)
+	}
+
+	if c := strings.Count(out.String(), "Endpoint 9, 3 bytes\n00000000  aa 01 ff"); c != 3 {
+		t.Errorf("Expected 3 dumps, got %d:\n%s\n", c, out.String())
+	}
+
+	out.Reset()
+	err = s.exec([]string{ "send", "10" })
+	if err != nil || out.String() != "No response\n" {
+		t.Errorf("Expected no response, got %q %v\n", out.String(), err)
+	}
+}
+
+func TestExecErrors(t *testing.T) {
+	s, _, _ := newTestSession(t, motor.Schema())
+
+	for _, tc := range []struct{
+		args string
+		prefix string
+	}{
+		{ "bogus", "Unknown command" },
+		{ "freq", "Usage: freq <Hz>" },
+		{ "freq 1", "Invalid setting" },
+		{ "duty 0 sideways 50", "Expected fwd or rev" },
+		{ "duty 5 fwd 100", "Invalid setting" },
+		{ "repeat 2 1ms", "Usage: repeat" },
+		{ "repeat 2 freq x", "Iteration 1: Invalid frequency" },
+	} {
+		err := s.exec(strings.Fields(tc.args))
+		if err == nil || !strings.HasPrefix(err.Error(), tc.prefix) {
+			t.Errorf("%q: expected '%s' error, got: %v\n", tc.args, tc.prefix, err)
+		}
+	}
+}
+
+func TestMotorCommands(t *testing.T) {
+	s, _, out := newTestSession(t, motor.Schema())
+
+	for _, line := range []string{ "freq 1000", "duty 0 fwd 50", "g 1 0.5 0.25", "settings" } {
+		err := s.exec(strings.Fields(line))
+		if err != nil {
+			t.Fatalf("%q: %v\n", line, err)
+		}
+	}
+
+	for _, line := range []string{
+		"Freq:     1000 Hz",
+		"Duty 0:   50.0% forward",
+		"Gains:    Kc 1, Kd 0.5, Ki 0.25",
+	} {
+		if !strings.Contains(out.String(), line + "\n") {
+			t.Errorf("Expected line %q in:\n%s\n", line, out.String())
+		}
+	}
+}
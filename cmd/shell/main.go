@@ -1,223 +1,239 @@
 package main
 
 import (
-	"bytes"
-	"encoding/binary"
+	"context"
 	"flag"
 	"fmt"
-	"strconv"
+	"io"
+	"os"
 	"strings"
-	"time"
 
 	"github.com/abiosoft/ishell"
 	"github.com/usedbytes/bot_matrix/datalink"
+	"github.com/usedbytes/bot_matrix/datalink/capture"
+	"github.com/usedbytes/bot_matrix/datalink/discovery"
+	"github.com/usedbytes/bot_matrix/datalink/motor"
+	"github.com/usedbytes/bot_matrix/datalink/schema"
+	"github.com/usedbytes/bot_matrix/datalink/sim"
 	"github.com/usedbytes/bot_matrix/datalink/spiconn"
 	"github.com/usedbytes/bot_matrix/datalink/rpcconn"
+	"github.com/usedbytes/bot_matrix/datalink/tracing"
 )
 
-func ledOn(c datalink.Transactor) {
-	data := []datalink.Packet{
-		{ 1, []byte{1} },
+func openReplay(path string, lenient, timing bool) (*capture.Replay, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
 	}
-	c.Transact(data)
-}
+	defer f.Close()
 
-func ledOff(c datalink.Transactor) {
-	data := []datalink.Packet{
-		{ 1, []byte{0} },
+	r, err := capture.NewReader(f)
+	if err != nil {
+		return nil, err
 	}
-	c.Transact(data)
-}
 
-func setFreq(c datalink.Transactor, freq uint32) {
-	data := []datalink.Packet{
-		{ Endpoint: 2, },
+	cfg := capture.ReplayConfig{ Timing: timing }
+	if lenient {
+		cfg.Mode = capture.MatchLenient
 	}
 
-	buf := &bytes.Buffer{}
-	binary.Write(buf, binary.LittleEndian, freq)
-
-	data[0].Data = buf.Bytes()
-
-	c.Transact(data)
+	return capture.NewReplay(r, cfg)
 }
 
-func setDuty(c datalink.Transactor, ch byte, dir byte, duty uint16) {
-	data := []datalink.Packet{
-		{ Endpoint: 3, },
-	}
-
-	buf := &bytes.Buffer{}
-	binary.Write(buf, binary.LittleEndian, ch)
-	binary.Write(buf, binary.LittleEndian, dir)
-	binary.Write(buf, binary.LittleEndian, duty)
-
-	data[0].Data = buf.Bytes()
-
-	c.Transact(data)
-}
+func run() int {
+	var devname string
+	var legacy bool
+	var capfile string
+	var lenient, timing bool
+	var otlp string
+	var script string
+	var schemaFile string
+	var discover bool
+	var c datalink.Transactor
+	var stats func() (datalink.Stats, error)
+	var err error
 
-func setGains(c datalink.Transactor, Kc, Kd, Ki float64) {
-	data := []datalink.Packet{
-		{ Endpoint: 4, },
+	flag.StringVar(&devname, "devname", "/dev/spidev0.0", "Device to use for communication. Use tcp:.... for RPCConn, replay:<file> to replay a capture, sim for a simulated motor controller")
+	flag.BoolVar(&legacy, "legacy", false, "Use the legacy SPI protocol, for old firmware")
+	flag.StringVar(&capfile, "capture", "", "Record all traffic to this file")
+	flag.BoolVar(&lenient, "lenient", false, "Tolerate differences from the capture when replaying")
+	flag.BoolVar(&timing, "timing", false, "Reproduce the capture's timing when replaying")
+	flag.StringVar(&otlp, "otlp", "", "Send traces to this OTLP HTTP collector, e.g. localhost:4318")
+	flag.StringVar(&schemaFile, "schema", "", "Build the endpoint commands from this schema file, instead of the motor controller's")
+	flag.BoolVar(&discover, "discover", false, "Build the endpoint commands from the schema discovered from the device")
+	flag.StringVar(&script, "script", "", "Run the commands in this file (- for stdin) and exit, instead of starting the shell")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [command...]\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "Each command argument is run as one line of a script.")
+		flag.PrintDefaults()
 	}
+	flag.Parse()
 
-	iKc := int32(Kc * 65536)
-	iKd := int32(Kd * 65536)
-	iKi := int32(Ki * 65536)
-
-	buf := &bytes.Buffer{}
-	binary.Write(buf, binary.LittleEndian, iKc)
-	binary.Write(buf, binary.LittleEndian, iKd)
-	binary.Write(buf, binary.LittleEndian, iKi)
-
-	data[0].Data = buf.Bytes()
-
-	c.Transact(data)
-}
-
-func setPoint(c datalink.Transactor, sp uint32) {
-	data := []datalink.Packet{
-		{ Endpoint: 5, },
+	if len(schemaFile) > 0 && discover {
+		fmt.Fprintln(os.Stderr, "Use -schema or -discover, not both")
+		return 2
 	}
 
-	buf := &bytes.Buffer{}
-	binary.Write(buf, binary.LittleEndian, sp)
-
-	data[0].Data = buf.Bytes()
-
-	c.Transact(data)
-}
-
-func setIlimit(c datalink.Transactor, il uint32) {
-	data := []datalink.Packet{
-		{ Endpoint: 6, },
+	if len(script) > 0 && flag.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "Use -script or command arguments, not both")
+		return 2
 	}
 
-	buf := &bytes.Buffer{}
-	binary.Write(buf, binary.LittleEndian, il)
+	if len(otlp) > 0 {
+		shutdown, err := tracing.Setup(context.Background(), "shell", otlp)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		defer shutdown(context.Background())
+	}
 
-	data[0].Data = buf.Bytes()
+	var w *capture.Writer
+	if len(capfile) > 0 {
+		f, err := os.Create(capfile)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		defer f.Close()
 
-	c.Transact(data)
-}
+		w, err = capture.NewWriter(f)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+	}
 
-func main() {
-	var on bool
-	var devname string
-	var c datalink.Transactor
-	var err error
+	cfg := spiconn.DefaultConfig
+	if legacy {
+		cfg = spiconn.LegacyConfig
+	}
 
-	flag.StringVar(&devname, "devname", "/dev/spidev0.0", "Device to use for communication. Use tcp:.... for RPCConn")
-	flag.Parse()
+	if w != nil {
+		cfg.WrapTransport = func(t datalink.Transport) datalink.Transport {
+			return capture.NewTransport(t, w)
+		}
+	}
 
+	var conn *spiconn.SPIConn
 	if strings.HasPrefix(devname, "tcp:") {
-		c, err = rpcconn.NewRPCClient(devname[len("tcp:"):])
+		var client *rpcconn.RPCClient
+		client, err = rpcconn.NewRPCClient(devname[len("tcp:"):])
+		if err == nil {
+			c, stats = client, client.Stats
+		}
+	} else if devname == "sim" {
+		c, err = sim.NewMotor(sim.DefaultMotorConfig)
+		stats = func() (datalink.Stats, error) {
+			return datalink.Stats{}, fmt.Errorf("No statistics for the simulator")
+		}
+	} else if strings.HasPrefix(devname, "replay:") {
+		var rp *capture.Replay
+		rp, err = openReplay(devname[len("replay:"):], lenient, timing)
+		if err == nil {
+			conn, err = spiconn.NewSPIConnTransport(rp, cfg)
+		}
 	} else {
-		c, err = spiconn.NewSPIConn(devname)
+		conn, err = spiconn.NewSPIConnConfig(devname, cfg)
 	}
 	if err != nil {
 		fmt.Println(err)
-		return
+		return 1
 	}
 
-	// create new shell.
-	// by default, new shell includes 'exit', 'help' and 'clear' commands.
-	shell := ishell.New()
-
-	// display welcome info.
-	shell.Println("Driver...")
-
-	// register a function for "greet" command.
-	shell.AddCmd(&ishell.Cmd{
-		Name: "sp",
-		Help: "set_point",
-		Func: func(ctx *ishell.Context) {
-			if len(ctx.Args) != 1 {
-				ctx.Err(fmt.Errorf("Expected one argument (setpoint uint32)"))
-				return
-			}
+	if conn != nil {
+		c = conn
+		stats = func() (datalink.Stats, error) {
+			return conn.Stats(), nil
+		}
+	}
 
-			sp, err := strconv.ParseUint(ctx.Args[0], 0, 32)
-			if err != nil {
-				ctx.Err(err)
-				return
-			}
+	if w != nil {
+		c = capture.NewTransactor(c, w)
+	}
 
-			setPoint(c, uint32(sp))
-		},
+	sess, err := newSession(os.Stdout, c, stats, func(p datalink.Packet) {
+		fmt.Printf("Unsolicited packet on endpoint %d: %x\n", p.Endpoint, p.Data)
 	})
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
 
-	shell.AddCmd(&ishell.Cmd{
-		Name: "il",
-		Help: "ilimit",
-		Func: func(ctx *ishell.Context) {
-			if len(ctx.Args) != 1 {
-				ctx.Err(fmt.Errorf("Expected one argument (ilimi int32)"))
-				return
-			}
+	sc := motor.Schema()
+	if len(schemaFile) > 0 {
+		sc, err = schema.Load(schemaFile)
+	} else if discover {
+		sc, err = discovery.DiscoverClient(sess.disc)
+	}
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	err = sess.addSchema(sc)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
 
-			il, err := strconv.ParseUint(ctx.Args[0], 0, 32)
+	if len(script) > 0 || flag.NArg() > 0 {
+		name := "arguments"
+		var r io.Reader = strings.NewReader(strings.Join(flag.Args(), "\n"))
+		if script == "-" {
+			name, r = "stdin", os.Stdin
+		} else if len(script) > 0 {
+			f, err := os.Open(script)
 			if err != nil {
-				ctx.Err(err)
-				return
+				fmt.Fprintln(os.Stderr, err)
+				return 1
 			}
+			defer f.Close()
+			name, r = script, f
+		}
 
-			setIlimit(c, uint32(il))
-		},
-	})
-
-	shell.AddCmd(&ishell.Cmd{
-		Name: "g",
-		Help: "gains",
-		Func: func(ctx *ishell.Context) {
-			if len(ctx.Args) != 3 {
-				ctx.Err(fmt.Errorf("Expected three arguments (Kc, Kd, Ki)"))
-				return
-			}
+		err = sess.runScript(r)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+			return 1
+		}
+		return 0
+	}
 
-			Kc, err := strconv.ParseFloat(ctx.Args[0], 64)
-			if err != nil {
-				ctx.Err(err)
-				return
-			}
+	// create new shell.
+	// by default, new shell includes 'exit', 'help' and 'clear' commands.
+	shell := ishell.New()
 
-			Kd, err := strconv.ParseFloat(ctx.Args[1], 64)
-			if err != nil {
-				ctx.Err(err)
-				return
-			}
+	// display welcome info.
+	shell.Println("Driver...")
 
-			Ki, err := strconv.ParseFloat(ctx.Args[2], 64)
-			if err != nil {
-				ctx.Err(err)
-				return
-			}
+	for _, cmd := range sess.cmds {
+		cmd := cmd
+		help := cmd.help
+		if cmd.args != "" {
+			help = cmd.args + ": " + help
+		}
 
-			setGains(c, Kc, Kd, Ki)
-		},
-	})
+		shell.AddCmd(&ishell.Cmd{
+			Name: cmd.name,
+			Help: help,
+			LongHelp: cmd.long,
+			Completer: cmd.complete,
+			Func: func(ctx *ishell.Context) {
+				err := cmd.run(ctx.Args)
+				if err != nil {
+					ctx.Err(err)
+				}
+			},
+		})
+	}
 
 	// run shell
 	shell.Run()
 
-	for {
-		for f := uint32(2000); f < 20000; f += 1000 {
-			setFreq(c, f);
-			for rev := byte(0); rev <= 1; rev++ {
-				fmt.Printf("rev: %d\n", rev)
-				for d := uint16(0); d < 65535 - 300; d+=300 {
-					setDuty(c, 0, rev, d)
-					time.Sleep(30 * time.Millisecond)
-				}
-			}
+	return 0
+}
 
-			if on {
-				ledOn(c)
-			} else {
-				ledOff(c)
-			}
-			on = !on
-		}
-	}
+func main() {
+	os.Exit(run())
 }
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/usedbytes/bot_matrix/datalink"
+	"github.com/usedbytes/bot_matrix/datalink/codec"
+	"github.com/usedbytes/bot_matrix/datalink/motor"
+	"github.com/usedbytes/bot_matrix/datalink/schema"
+)
+
+/*
+Each endpoint in the schema gets a command, named after the endpoint in
+lower case, which takes a value for each request field. Values can be
+given in order ("move 100 -1"), or by name ("move speed=100 turn=-1").
+Array fields take comma separated values. Commands for in and inout
+endpoints print the response.
+
+The motor controller's endpoints keep their own commands (sp, duty and so
+on), which check the values before sending them.
+*/
+
+func parseBool(arg string) (bool, error) {
+	switch strings.ToLower(arg) {
+	case "1", "true", "on":
+		return true, nil
+	case "0", "false", "off":
+		return false, nil
+	}
+	return false, fmt.Errorf("Expected on or off, not %q", arg)
+}
+
+// setValue parses arg into v, according to v's type
+func setValue(v reflect.Value, arg string) error {
+	if v.Kind() == reflect.Array {
+		parts := strings.Split(arg, ",")
+		if len(parts) != v.Len() {
+			return fmt.Errorf("Expected %d comma separated values, got %d", v.Len(), len(parts))
+		}
+
+		for i, p := range parts {
+			err := setValue(v.Index(i), p)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var err error
+	switch v.Kind() {
+	case reflect.Bool:
+		var b bool
+		b, err = parseBool(arg)
+		v.SetBool(b)
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var n int64
+		n, err = strconv.ParseInt(arg, 0, v.Type().Bits())
+		v.SetInt(n)
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		var n uint64
+		n, err = strconv.ParseUint(arg, 0, v.Type().Bits())
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		var f float64
+		f, err = strconv.ParseFloat(arg, v.Type().Bits())
+		v.SetFloat(f)
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid %v %q", v.Type(), arg)
+	}
+
+	return nil
+}
+
+func fieldIndex(fields []schema.Field, name string) int {
+	for i, f := range fields {
+		if strings.EqualFold(f.Name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// parseFields parses args into v, which is a struct built by
+// schema.StructOf(fields)
+func parseFields(fields []schema.Field, v reflect.Value, args []string) error {
+	named := len(args) > 0 && strings.Contains(args[0], "=")
+	if !named {
+		if len(args) != len(fields) {
+			return fmt.Errorf("Expected %d values, got %d", len(fields), len(args))
+		}
+
+		for i, a := range args {
+			err := setValue(v.Field(i), a)
+			if err != nil {
+				return fmt.Errorf("%s: %v", fields[i].Name, err)
+			}
+		}
+		return nil
+	}
+
+	set := make([]bool, len(fields))
+	for _, a := range args {
+		name, val, ok := strings.Cut(a, "=")
+		if !ok {
+			return fmt.Errorf("Expected name=value, not %q", a)
+		}
+
+		i := fieldIndex(fields, name)
+		if i < 0 {
+			return fmt.Errorf("Unknown field %q", name)
+		}
+
+		err := setValue(v.Field(i), val)
+		if err != nil {
+			return fmt.Errorf("%s: %v", fields[i].Name, err)
+		}
+		set[i] = true
+	}
+
+	for i, f := range fields {
+		if !set[i] {
+			return fmt.Errorf("Missing value for %s", f.Name)
+		}
+	}
+
+	return nil
+}
+
+func printValues(w io.Writer, fields []schema.Field, v reflect.Value) {
+	for i, f := range fields {
+		units := ""
+		if f.Units != "" {
+			units = " " + f.Units
+		}
+		fmt.Fprintf(w, "%s: %v%s\n", f.Name, v.Field(i).Interface(), units)
+	}
+}
+
+// describeField is used in help text, e.g. "Freq uint32, Hz"
+func describeField(f schema.Field) string {
+	desc := f.Name + " " + f.GoType().String()
+	if f.Units != "" {
+		desc += ", " + f.Units
+	}
+	if f.Doc != "" {
+		desc += ": " + f.Doc
+	}
+	return desc
+}
+
+func endpointCommand(e schema.Endpoint, c *datalink.Client, last *[]datalink.Packet, out io.Writer) command {
+	reqType := schema.StructOf(e.Fields)
+	respType := schema.StructOf(e.Response)
+
+	names := make([]string, 0, len(e.Fields))
+	for _, f := range e.Fields {
+		names = append(names, "<" + strings.ToLower(f.Name) + ">")
+	}
+
+	help := e.Doc
+	if help == "" {
+		help = fmt.Sprintf("endpoint %d", e.Endpoint)
+	}
+	if e.Direction != schema.Out {
+		help += ", prints the response"
+	}
+
+	long := fmt.Sprintf("%s (endpoint %d, %s)\n", help, e.Endpoint, e.Direction)
+	for _, f := range e.Fields {
+		long += "\n  " + describeField(f)
+	}
+	if len(e.Response) > 0 {
+		long += "\n\nResponse:"
+		for _, f := range e.Response {
+			long += "\n  " + describeField(f)
+		}
+	}
+
+	run := func(args []string) error {
+		req := reflect.New(reqType)
+		err := parseFields(e.Fields, req.Elem(), args)
+		if err != nil {
+			return err
+		}
+
+		data, err := codec.Marshal(req.Interface())
+		if err != nil {
+			return err
+		}
+
+		if e.Direction == schema.Out {
+			return c.Send(data)
+		}
+
+		data, err = c.Request(data)
+		if err != nil {
+			return err
+		}
+		*last = []datalink.Packet{ { Endpoint: e.Endpoint, Data: data } }
+
+		resp := reflect.New(respType)
+		err = codec.Unmarshal(data, resp.Interface())
+		if err != nil {
+			return fmt.Errorf("Bad response: %v", err)
+		}
+
+		printValues(out, e.Response, resp.Elem())
+		return nil
+	}
+
+	// Offer the names of the fields which haven't been given yet
+	complete := func(args []string) []string {
+		if len(args) > 0 && !strings.Contains(args[0], "=") {
+			return nil
+		}
+
+		opts := []string{}
+		for _, f := range e.Fields {
+			name := strings.ToLower(f.Name) + "="
+			given := false
+			for _, a := range args {
+				given = given || strings.HasPrefix(strings.ToLower(a), name)
+			}
+			if !given {
+				opts = append(opts, name)
+			}
+		}
+		return opts
+	}
+
+	return command{
+		name: strings.ToLower(e.Name),
+		args: strings.Join(names, " "),
+		help: help,
+		long: long,
+		complete: complete,
+		run: run,
+	}
+}
+
+// motorCommands are the motor controller's endpoints which have their own
+// commands (led, freq, duty, g, sp and il), going through the
+// MotorController to validate their arguments
+var motorCommands = map[uint8]bool{
+	motor.EndpointLED: true,
+	motor.EndpointFreq: true,
+	motor.EndpointDuty: true,
+	motor.EndpointGains: true,
+	motor.EndpointSetpoint: true,
+	motor.EndpointIlimit: true,
+}
+
+// motorEndpoint returns true if e is exactly the motor controller's
+// endpoint, and so has its own command
+func motorEndpoint(e schema.Endpoint) bool {
+	if !motorCommands[e.Endpoint] {
+		return false
+	}
+
+	for _, m := range motor.Schema().Endpoints {
+		if m.Endpoint == e.Endpoint {
+			return reflect.DeepEqual(m, e)
+		}
+	}
+	return false
+}
+
+// addSchema adds a command for each of sc's endpoints. The motor
+// controller's endpoints are left to their own commands, and endpoints whose
+// names clash with an existing command are skipped, with a warning.
+func (s *session) addSchema(sc *schema.Schema) error {
+	for _, e := range sc.Endpoints {
+		if motorEndpoint(e) {
+			continue
+		}
+
+		name := strings.ToLower(e.Name)
+		if s.lookup(name) != nil {
+			fmt.Fprintf(s.out, "No command for endpoint %s: %s is already a command\n", e.Name, name)
+			continue
+		}
+
+		c := s.mux.Client(e.Endpoint)
+		if c == nil {
+			var err error
+			c, err = s.mux.Register(e.Endpoint, nil)
+			if err != nil {
+				return err
+			}
+		}
+
+		s.cmds = append(s.cmds, endpointCommand(e, c, &s.last, s.out))
+	}
+
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/usedbytes/bot_matrix/datalink/motor"
+	"github.com/usedbytes/bot_matrix/datalink/schema"
+)
+
+const testSchema = `{
+	"name": "Test",
+	"endpoints": [
+		{ "name": "Gains", "endpoint": 4, "direction": "out",
+		  "fields": [
+			{ "name": "Kc", "type": "float64", "fixed": 16 },
+			{ "name": "On", "type": "bool" },
+			{ "name": "Arr", "type": "int8", "count": 2 }
+		  ] },
+		{ "name": "Telemetry", "endpoint": 7, "direction": "in",
+		  "response": [
+			{ "name": "Speed", "type": "int16", "units": "rpm" },
+			{ "name": "Current", "type": "float32", "fixed": 8, "units": "A" }
+		  ] },
+		{ "name": "Stop", "endpoint": 8, "direction": "out" }
+	]
+}`
+
+func TestSchemaCommands(t *testing.T) {
+	sc, err := schema.Parse(strings.NewReader(testSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, _, out := newTestSession(t, motor.Schema())
+	err = s.addSchema(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The motor schema already has Telemetry, and stop is built in
+	if !strings.Contains(out.String(), "No command for endpoint Telemetry") ||
+	   !strings.Contains(out.String(), "No command for endpoint Stop") {
+		t.Errorf("Expected clash warnings, got %q\n", out.String())
+	}
+
+	// The motor controller's own endpoints are left to its commands
+	if s.lookup("duty") == nil || s.lookup("setpoint") != nil {
+		t.Errorf("Expected commands for only the MotorController's endpoints\n")
+	}
+
+	s, peer, out := newTestSession(t, sc)
+	out.Reset()
+
+	var got []byte
+	peer.Handle(4, func(data []byte) []byte {
+		got = data
+		return nil
+	})
+	peer.Handle(7, func(data []byte) []byte {
+		return []byte{ 0xfe, 0xff, 0x80, 0x01, 0x00, 0x00 }
+	})
+
+	for _, args := range []string{ "gains 1.5 on -1,2", "gains arr=-1,2 on=true kc=1.5" } {
+		got = nil
+		err = s.exec(strings.Fields(args))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []byte{ 0x00, 0x80, 0x01, 0x00, 0x01, 0xff, 0x02 }
+		if !bytes.Equal(got, expected) {
+			t.Errorf("%q: expected %x, got %x\n", args, expected, got)
+		}
+	}
+
+	err = s.exec([]string{ "telemetry" })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out.String() != "Speed: -2 rpm\nCurrent: 1.5 A\n" {
+		t.Errorf("Unexpected output %q\n", out.String())
+	}
+
+	if opts := s.lookup("gains").complete([]string{ "kc=1" }); strings.Join(opts, " ") != "on= arr=" {
+		t.Errorf("Unexpected completions %v\n", opts)
+	}
+}
+
+func TestSchemaCommandErrors(t *testing.T) {
+	sc, err := schema.Parse(strings.NewReader(testSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, _, _ := newTestSession(t, sc)
+
+	for _, tc := range []struct{
+		args string
+		prefix string
+	}{
+		{ "gains 1.5 on", "Expected 3 values, got 2" },
+		{ "gains 1.5 maybe -1,2", "On: Invalid bool" },
+		{ "gains 1.5 on -1,200", "Arr: Invalid int8" },
+		{ "gains kc=1.5 on=1", "Missing value for Arr" },
+		{ "gains kc=1.5 speed=1", "Unknown field \"speed\"" },
+		{ "repeat 2 gains x on 1,2", "Iteration 1: Kc: Invalid float64" },
+	} {
+		err := s.exec(strings.Fields(tc.args))
+		if err == nil || !strings.HasPrefix(err.Error(), tc.prefix) {
+			t.Errorf("%q: expected '%s' error, got: %v\n", tc.args, tc.prefix, err)
+		}
+	}
+}
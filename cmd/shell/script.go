@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/usedbytes/bot_matrix/datalink"
+)
+
+/*
+A script is a list of shell commands, one per line. Blank lines, and
+anything after a '#', are ignored. As well as the shell's commands,
+scripts can use:
+
+	loop [count]
+		...
+	end
+
+which runs the commands in between count times, or forever if there's
+no count. Loops can be nested.
+
+The script stops at the first command which fails. "expect" fails if the
+last send or poll didn't receive the packet it describes, so scripts can
+check responses. For example:
+
+	send 9 01
+	expect 9 aa01
+	loop 10
+		duty 0 fwd 50
+		wait 100ms
+		stop
+		wait 100ms
+	end
+*/
+
+// step is a line of a script, or a loop
+type step struct {
+	line int
+	args []string
+
+	// For loops, count is the number of iterations, or 0 for forever
+	loop bool
+	count uint64
+	body []step
+}
+
+func parseScript(r io.Reader) ([]step, error) {
+	type frame struct {
+		loop *step
+		steps []step
+	}
+	stack := []frame{ {} }
+
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		text, _, _ := strings.Cut(sc.Text(), "#")
+		args := strings.Fields(text)
+		if len(args) == 0 {
+			continue
+		}
+
+		top := &stack[len(stack) - 1]
+
+		switch args[0] {
+		case "loop":
+			st := &step{ line: n, loop: true }
+			if len(args) > 2 {
+				return nil, fmt.Errorf("line %d: Usage: loop [count]", n)
+			} else if len(args) == 2 {
+				c, err := parseUint("count", args[1], 32)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %v", n, err)
+				}
+				st.count = c
+			}
+			stack = append(stack, frame{ loop: st })
+		case "end":
+			if top.loop == nil {
+				return nil, fmt.Errorf("line %d: end without loop", n)
+			}
+			if len(args) > 1 {
+				return nil, fmt.Errorf("line %d: Unexpected arguments after end", n)
+			}
+
+			top.loop.body = top.steps
+			stack = stack[:len(stack) - 1]
+			parent := &stack[len(stack) - 1]
+			parent.steps = append(parent.steps, *top.loop)
+		default:
+			top.steps = append(top.steps, step{ line: n, args: args })
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(stack) > 1 {
+		return nil, fmt.Errorf("line %d: loop without end", stack[len(stack) - 1].loop.line)
+	}
+
+	return stack[0].steps, nil
+}
+
+func (s *session) runSteps(steps []step) error {
+	for _, st := range steps {
+		if !st.loop {
+			err := s.exec(st.args)
+			if err != nil {
+				return fmt.Errorf("line %d: %v", st.line, err)
+			}
+			continue
+		}
+
+		for i := uint64(0); st.count == 0 || i < st.count; i++ {
+			err := s.runSteps(st.body)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// runScript parses all of r, and then runs it
+func (s *session) runScript(r io.Reader) error {
+	steps, err := parseScript(r)
+	if err != nil {
+		return err
+	}
+
+	return s.runSteps(steps)
+}
+
+func (s *session) wait(args []string) error {
+	if err := nargs(args, 1, 1, "wait <duration>"); err != nil {
+		return err
+	}
+
+	d, err := time.ParseDuration(args[0])
+	if err != nil {
+		return fmt.Errorf("Invalid duration %q", args[0])
+	}
+
+	time.Sleep(d)
+	return nil
+}
+
+func describePackets(pkts []datalink.Packet) string {
+	if len(pkts) == 0 {
+		return "nothing"
+	}
+
+	desc := make([]string, 0, len(pkts))
+	for _, p := range pkts {
+		desc = append(desc, strconv.Itoa(int(p.Endpoint)) + ":" + fmt.Sprintf("%x", p.Data))
+	}
+	return strings.Join(desc, ", ")
+}
+
+func (s *session) expect(args []string) error {
+	if err := nargs(args, 1, 1 << 16, "expect <none|ep [data...]>"); err != nil {
+		return err
+	}
+
+	if args[0] == "none" {
+		if len(args) > 1 || len(s.last) > 0 {
+			return fmt.Errorf("Expected nothing, received %s", describePackets(s.last))
+		}
+		return nil
+	}
+
+	ep, err := parseUint("endpoint", args[0], 8)
+	if err != nil {
+		return err
+	}
+
+	data, err := parseData(args[1:])
+	if err != nil {
+		return err
+	}
+
+	for _, p := range s.last {
+		if p.Endpoint == uint8(ep) && bytes.Equal(p.Data, data) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Expected %d:%x, received %s", ep, data, describePackets(s.last))
+}
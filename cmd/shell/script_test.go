@@ -0,0 +1,86 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/usedbytes/bot_matrix/datalink/motor"
+)
+
+func TestParseScript(t *testing.T) {
+	steps, err := parseScript(strings.NewReader(`
+# comment
+freq 1000
+loop 3 # three times
+	loop
+		wait 1ms
+	end
+end
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(steps) != 2 || steps[0].line != 3 || steps[0].args[0] != "freq" {
+		t.Fatalf("Unexpected steps %+v\n", steps)
+	}
+
+	outer := steps[1]
+	if !outer.loop || outer.count != 3 || len(outer.body) != 1 {
+		t.Fatalf("Unexpected outer loop %+v\n", outer)
+	}
+
+	inner := outer.body[0]
+	if !inner.loop || inner.count != 0 || len(inner.body) != 1 || inner.body[0].line != 6 {
+		t.Errorf("Unexpected inner loop %+v\n", inner)
+	}
+
+	for _, tc := range []struct{
+		script string
+		prefix string
+	}{
+		{ "end", "line 1: end without loop" },
+		{ "freq 1\nloop 2\nwait 1ms", "line 2: loop without end" },
+		{ "loop x\nend", "line 1: Invalid count" },
+	} {
+		_, err := parseScript(strings.NewReader(tc.script))
+		if err == nil || !strings.HasPrefix(err.Error(), tc.prefix) {
+			t.Errorf("%q: expected '%s' error, got: %v\n", tc.script, tc.prefix, err)
+		}
+	}
+}
+
+func TestRunScript(t *testing.T) {
+	s, peer, _ := newTestSession(t, motor.Schema())
+
+	n := 0
+	peer.Handle(9, func(data []byte) []byte {
+		n++
+		return append([]byte{ 0xaa }, data...)
+	})
+
+	err := s.runScript(strings.NewReader(`
+loop 2
+	send 9 1 2
+	expect 9 aa0102
+end
+send 10
+expect none
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 2 {
+		t.Errorf("Expected 2 sends, got %d\n", n)
+	}
+
+	err = s.runScript(strings.NewReader("send 9 01\nexpect 9 ab01\nfreq 1000"))
+	if err == nil || err.Error() != "line 2: Expected 9:ab01, received 9:aa01" {
+		t.Errorf("Expected failed expect, got: %v\n", err)
+	}
+
+	if s.motor.Settings().Freq != 0 {
+		t.Errorf("Script continued after a failure\n")
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/usedbytes/bot_matrix/datalink/motor"
+)
+
+/*
+sweep steps the motor through ranges of PWM frequency, direction and duty
+cycle, and writes the speed and current measured at each step as CSV:
+
+	sweep freq=1000:20000:1000 dir=both duty=0:1:0.05 settle=1s out=motor.csv
+
+Ranges are a single value, a comma separated list, or from:to:step. The
+duty cycle is a fraction from 0 to 1. The motor is stopped at the end, or
+as soon as anything fails, or Ctrl-C is pressed.
+*/
+
+const sweepUsage = "sweep [ch=<n>] [freq=<range>] [dir=<forward|reverse|both>] [duty=<range>] " +
+	"[settle=<duration>] [samples=<n>] [interval=<duration>] [out=<file.csv>]"
+
+const sweepLong = "Usage: " + sweepUsage + `
+
+Ranges are a value, a comma separated list, or from:to:step. Duty is a
+fraction from 0 to 1. Each step waits settle, then averages samples
+readings, interval apart. The frequency isn't changed unless freq is given.
+
+Defaults: ch=0 dir=forward duty=0:1:0.1 settle=500ms samples=1
+interval=20ms, and the CSV is printed.`
+
+// parseRange parses a, a,b,c or from:to:step
+func parseRange(arg string) ([]float64, error) {
+	parts := strings.Split(arg, ":")
+	if len(parts) == 1 {
+		parts = strings.Split(arg, ",")
+
+		vals := make([]float64, 0, len(parts))
+		for _, p := range parts {
+			v, err := strconv.ParseFloat(p, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid value %q", p)
+			}
+			vals = append(vals, v)
+		}
+		return vals, nil
+	}
+
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("Expected from:to:step, not %q", arg)
+	}
+
+	var lim [3]float64
+	for i, p := range parts {
+		v, err := strconv.ParseFloat(p, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value %q", p)
+		}
+		lim[i] = v
+	}
+	from, to, step := lim[0], lim[1], lim[2]
+
+	if step == 0 || (to - from) / step < 0 {
+		return nil, fmt.Errorf("Step %v doesn't go from %v to %v", step, from, to)
+	}
+
+	// Compute each value from the start, rather than accumulating
+	// rounding errors
+	n := int(math.Floor((to - from) / step + 1e-9))
+	vals := make([]float64, 0, n + 1)
+	for i := 0; i <= n; i++ {
+		vals = append(vals, from + float64(i) * step)
+	}
+
+	return vals, nil
+}
+
+func parseSweep(args []string) (motor.Sweep, string, error) {
+	sw := motor.Sweep{
+		Dirs: []motor.Direction{ motor.Forward },
+		Settle: 500 * time.Millisecond,
+		Samples: 1,
+		Interval: 20 * time.Millisecond,
+	}
+	sw.Duties, _ = parseRange("0:1:0.1")
+	out := ""
+
+	for _, a := range args {
+		name, val, ok := strings.Cut(a, "=")
+		if !ok {
+			return sw, "", fmt.Errorf("Usage: %s", sweepUsage)
+		}
+
+		var err error
+		switch name {
+		case "ch":
+			var ch uint64
+			ch, err = parseUint("channel", val, 8)
+			sw.Channel = uint8(ch)
+		case "freq":
+			var freqs []float64
+			freqs, err = parseRange(val)
+			sw.Freqs = sw.Freqs[:0]
+			for _, f := range freqs {
+				if f != math.Trunc(f) || f < 0 || f > math.MaxUint32 {
+					return sw, "", fmt.Errorf("Invalid frequency %v", f)
+				}
+				sw.Freqs = append(sw.Freqs, uint32(f))
+			}
+		case "dir":
+			switch val {
+			case "forward":
+				sw.Dirs = []motor.Direction{ motor.Forward }
+			case "reverse":
+				sw.Dirs = []motor.Direction{ motor.Reverse }
+			case "both":
+				sw.Dirs = []motor.Direction{ motor.Forward, motor.Reverse }
+			default:
+				err = fmt.Errorf("Invalid direction %q", val)
+			}
+		case "duty":
+			sw.Duties, err = parseRange(val)
+		case "settle":
+			sw.Settle, err = time.ParseDuration(val)
+		case "samples":
+			var n uint64
+			n, err = parseUint("sample count", val, 16)
+			sw.Samples = int(n)
+		case "interval":
+			sw.Interval, err = time.ParseDuration(val)
+		case "out":
+			out = val
+		default:
+			err = fmt.Errorf("Unknown option %q", name)
+		}
+		if err != nil {
+			return sw, "", fmt.Errorf("%s: %v", name, err)
+		}
+	}
+
+	return sw, out, nil
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func (s *session) sweep(args []string) error {
+	sw, path, err := parseSweep(args)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = s.out
+	if path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	cw := csv.NewWriter(w)
+	// Flush each row, so that everything up to an abort is kept
+	cw.Write([]string{ "freq_hz", "dir", "duty", "speed", "current_ma" })
+	cw.Flush()
+
+	n := 0
+	err = s.motor.Sweep(ctx, sw, func(p motor.SweepPoint) error {
+		freq := ""
+		if p.Freq != 0 {
+			freq = strconv.FormatUint(uint64(p.Freq), 10)
+		}
+
+		cw.Write([]string{ freq, p.Dir.String(), formatFloat(p.Duty),
+			formatFloat(p.Speed), formatFloat(p.Current) })
+		cw.Flush()
+		n++
+
+		return cw.Error()
+	})
+
+	if path != "" {
+		fmt.Fprintf(s.out, "Wrote %d steps to %s\n", n, path)
+	}
+
+	return err
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/usedbytes/bot_matrix/datalink/motor"
+	"github.com/usedbytes/bot_matrix/datalink/sim"
+)
+
+func TestParseRange(t *testing.T) {
+	for _, tc := range []struct{
+		arg string
+		expected []float64
+	}{
+		{ "5", []float64{ 5 } },
+		{ "1,2.5,4", []float64{ 1, 2.5, 4 } },
+		{ "0:1:0.25", []float64{ 0, 0.25, 0.5, 0.75, 1 } },
+		{ "0:1:0.3", []float64{ 0, 0.3, 0.6, 0.8999999999999999 } },
+		{ "0:0.3:0.1", []float64{ 0, 0.1, 0.2, 0.30000000000000004 } },
+		{ "20:10:-5", []float64{ 20, 15, 10 } },
+	} {
+		vals, err := parseRange(tc.arg)
+		if err != nil || !reflect.DeepEqual(vals, tc.expected) {
+			t.Errorf("%q: expected %v, got %v (%v)\n", tc.arg, tc.expected, vals, err)
+		}
+	}
+
+	for _, arg := range []string{ "", "1,x", "1:2", "0:1:0", "0:1:-1" } {
+		if _, err := parseRange(arg); err == nil {
+			t.Errorf("%q: expected an error\n", arg)
+		}
+	}
+}
+
+func TestSweep(t *testing.T) {
+	// Each reading of the clock moves it on far enough for the motor to
+	// settle
+	now := time.Unix(0, 0)
+	m, err := sim.NewMotor(sim.DefaultMotorConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Now = func() time.Time {
+		now = now.Add(10 * time.Second)
+		return now
+	}
+
+	out := new(bytes.Buffer)
+	s, err := newSession(out, m, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.addSchema(motor.Schema()); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "sweep.csv")
+	err = s.exec(strings.Fields("sweep freq=1000,2000 dir=both duty=0:1:0.5 settle=0 samples=2 interval=0 out=" + path))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "freq_hz,dir,duty,speed,current_ma\n"
+	for _, f := range []string{ "1000", "2000" } {
+		for _, d := range []string{ "forward", "reverse" } {
+			expected += f + "," + d + ",0,0,0\n" +
+				f + "," + d + ",0.5,500,50\n" +
+				f + "," + d + ",1,1000,50\n"
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s\n", expected, data)
+	}
+	if out.String() != "Wrote 12 steps to " + path + "\n" {
+		t.Errorf("Unexpected output: %q\n", out.String())
+	}
+
+	// Without telemetry the sweep fails at the first step, leaving the
+	// motor stopped
+	m.Handle(motor.EndpointTelemetry, nil)
+	out.Reset()
+	err = s.exec([]string{ "sweep", "duty=1", "settle=0" })
+	if err == nil || !strings.HasPrefix(err.Error(), "Sweep aborted: ") {
+		t.Errorf("Expected the sweep to abort, got %v\n", err)
+	}
+	if tel := m.Telemetry(); tel.Duty != 0 {
+		t.Errorf("Expected the motor to be stopped, got %v\n", tel)
+	}
+	if out.String() != "freq_hz,dir,duty,speed,current_ma\n" {
+		t.Errorf("Unexpected output: %q\n", out.String())
+	}
+
+	for _, args := range []string{ "sweep bogus", "sweep x=1", "sweep dir=up", "sweep freq=1.5", "sweep duty=2" } {
+		if err := s.exec(strings.Fields(args)); err == nil {
+			t.Errorf("%q: expected an error\n", args)
+		}
+	}
+}
@@ -1,25 +1,132 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"log"
+	"log/slog"
 	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/usedbytes/bot_matrix/datalink"
+	"github.com/usedbytes/bot_matrix/datalink/capture"
+	"github.com/usedbytes/bot_matrix/datalink/metrics"
 	"github.com/usedbytes/bot_matrix/datalink/spiconn"
 	"github.com/usedbytes/bot_matrix/datalink/rpcconn"
+	"github.com/usedbytes/bot_matrix/datalink/tracing"
 )
 
-var addr string = ":9000"
+var addr string = fmt.Sprintf(":%d", rpcconn.DefaultPort)
 
 func main() {
-	c, err := spiconn.NewSPIConn("/dev/spidev0.0")
+	var legacy bool
+	var capfile string
+	var verbose bool
+	var metricsAddr string
+	var otlp string
+	var batch time.Duration
+	var c datalink.Transactor
+
+	flag.BoolVar(&legacy, "legacy", false, "Use the legacy SPI protocol, for old firmware")
+	flag.StringVar(&capfile, "capture", "", "Record all traffic to this file")
+	flag.BoolVar(&verbose, "v", false, "Log all traffic")
+	flag.StringVar(&metricsAddr, "metrics", "", "Serve Prometheus metrics on /metrics at this address, e.g. :9100")
+	flag.StringVar(&otlp, "otlp", "", "Send traces to this OTLP HTTP collector, e.g. localhost:4318")
+	flag.DurationVar(&batch, "batch", 0, "Coalesce packets from concurrent clients for up to this long, e.g. 1ms")
+	flag.Parse()
+
+	if len(otlp) > 0 {
+		shutdown, err := tracing.Setup(context.Background(), "spibridge", otlp)
+		if err != nil {
+			panic(err)
+		}
+		defer shutdown(context.Background())
+	}
+
+	var obs datalink.Observer
+	if verbose {
+		h := slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{ Level: slog.LevelDebug })
+		obs = datalink.NewLogObserver(slog.New(h))
+	}
+
+	cfg := spiconn.DefaultConfig
+	if legacy {
+		cfg = spiconn.LegacyConfig
+	}
+
+	var w *capture.Writer
+	if len(capfile) > 0 {
+		f, err := os.Create(capfile)
+		if err != nil {
+			panic(err)
+		}
+		defer f.Close()
+
+		w, err = capture.NewWriter(f)
+		if err != nil {
+			panic(err)
+		}
+
+		cfg.WrapTransport = func(t datalink.Transport) datalink.Transport {
+			return capture.NewTransport(t, w)
+		}
+	}
+
+	conn, err := spiconn.NewSPIConnConfig("/dev/spidev0.0", cfg)
 	if err != nil {
 		panic(err)
 	}
+	c = conn
+
+	if obs != nil {
+		conn.AddObserver(obs)
+	}
+
+	if len(metricsAddr) > 0 {
+		m := metrics.NewLink("datalink")
+		m.FrameLen = conn.FrameLen
+		conn.AddObserver(m)
+		prometheus.MustRegister(m)
+
+		http.Handle("/metrics", promhttp.Handler())
+		go func() {
+			log.Fatal(http.ListenAndServe(metricsAddr, nil))
+		}()
+
+		log.Printf("Serving metrics on %s...\n", metricsAddr)
+	}
+
+	if w != nil {
+		c = capture.NewTransactor(c, w)
+	}
+
+	if batch > 0 {
+		bcfg := datalink.DefaultBatchConfig
+		bcfg.Window = batch
+		bcfg.DataLen = conn.DataLen()
+		c, err = datalink.NewBatcher(c, bcfg)
+		if err != nil {
+			panic(err)
+		}
+	}
 
 	srv, err := rpcconn.NewRPCServ(c)
 	if err != nil {
 		panic(err)
 	}
 
+	if obs != nil {
+		srv.AddObserver(obs)
+	}
+
+	// c might be wrapped for capture
+	srv.SetStats(conn)
+
 	l, err := net.Listen("tcp", addr)
 	if err != nil {
 		panic(err)
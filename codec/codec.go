@@ -0,0 +1,395 @@
+// Copyright 2017 Brian Starkey <stark3y@gmail.com>
+
+// Package codec marshals Go structs to and from Packet data.
+//
+// Fields are packed in order, with no alignment. Supported field types are
+// bool (one byte), fixed-size integers, float32 and float64, arrays of
+// those, and nested structs. A []byte may be the last field, in which case
+// it takes whatever data is left. Unexported fields are ignored.
+//
+// Fields can be tagged with a comma separated list of options:
+//
+//	le       little endian (the default)
+//	be       big endian
+//	fixed=N  a float, sent as a signed 32-bit fixed point value with N
+//	         fractional bits. e.g. fixed=16 for 16.16
+//	pad=N    N zero bytes follow the field
+//	-        the field is ignored
+//
+// For example:
+//
+//	type Gains struct {
+//		Kc, Kd, Ki float64 `datalink:"fixed=16"`
+//	}
+package codec
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/usedbytes/bot_matrix/datalink"
+)
+
+type options struct {
+	order binary.ByteOrder
+	fixed int
+	pad int
+	skip bool
+}
+
+func parseTag(tag string) (options, error) {
+	opts := options{ order: binary.LittleEndian, fixed: -1 }
+	if tag == "" {
+		return opts, nil
+	}
+
+	for _, o := range strings.Split(tag, ",") {
+		key, val, _ := strings.Cut(strings.TrimSpace(o), "=")
+		switch key {
+		case "le":
+			opts.order = binary.LittleEndian
+		case "be":
+			opts.order = binary.BigEndian
+		case "-":
+			opts.skip = true
+		case "fixed", "pad":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 0 {
+				return opts, fmt.Errorf("Invalid %s value %q", key, val)
+			}
+			if key == "fixed" {
+				opts.fixed = n
+			} else {
+				opts.pad = n
+			}
+		default:
+			return opts, fmt.Errorf("Unknown option %q", key)
+		}
+	}
+
+	if opts.fixed > 31 {
+		return opts, fmt.Errorf("Invalid fixed value %d", opts.fixed)
+	}
+
+	return opts, nil
+}
+
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) uint(order binary.ByteOrder, size int, v uint64) {
+	var b [8]byte
+	switch size {
+	case 1:
+		b[0] = uint8(v)
+	case 2:
+		order.PutUint16(b[:], uint16(v))
+	case 4:
+		order.PutUint32(b[:], uint32(v))
+	case 8:
+		order.PutUint64(b[:], v)
+	}
+	e.buf = append(e.buf, b[:size]...)
+}
+
+func (e *encoder) value(name string, v reflect.Value, opts options) error {
+	if v.Kind() == reflect.Array {
+		for i := 0; i < v.Len(); i++ {
+			err := e.value(fmt.Sprintf("%s[%d]", name, i), v.Index(i), opts)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if opts.fixed >= 0 {
+		if v.Kind() != reflect.Float32 && v.Kind() != reflect.Float64 {
+			return fmt.Errorf("Field %s: fixed needs a float, not %v", name, v.Type())
+		}
+
+		f := math.Round(v.Float() * float64(int64(1) << opts.fixed))
+		if f > math.MaxInt32 || f < math.MinInt32 {
+			return fmt.Errorf("Field %s: %v out of range for fixed=%d", name, v.Float(), opts.fixed)
+		}
+		e.uint(opts.order, 4, uint64(uint32(int32(f))))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		b := uint64(0)
+		if v.Bool() {
+			b = 1
+		}
+		e.uint(opts.order, 1, b)
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.uint(opts.order, int(v.Type().Size()), uint64(v.Int()))
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		e.uint(opts.order, int(v.Type().Size()), v.Uint())
+	case reflect.Float32:
+		e.uint(opts.order, 4, uint64(math.Float32bits(float32(v.Float()))))
+	case reflect.Float64:
+		e.uint(opts.order, 8, math.Float64bits(v.Float()))
+	case reflect.Struct:
+		return e.fields(v)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.Uint8 {
+			return fmt.Errorf("Field %s: unsupported type %v", name, v.Type())
+		}
+		e.buf = append(e.buf, v.Bytes()...)
+	default:
+		return fmt.Errorf("Field %s: unsupported type %v", name, v.Type())
+	}
+
+	return nil
+}
+
+// forFields calls fn for each field of struct v which should be coded.
+// A []byte is only allowed as the last field which is coded.
+func forFields(v reflect.Value, fn func(name string, f reflect.Value, opts options) error) error {
+	type coded struct {
+		idx int
+		opts options
+	}
+
+	t := v.Type()
+	var fields []coded
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+
+		opts, err := parseTag(sf.Tag.Get("datalink"))
+		if err != nil {
+			return fmt.Errorf("Field %s: %v", sf.Name, err)
+		}
+		if opts.skip {
+			continue
+		}
+
+		fields = append(fields, coded{ i, opts })
+	}
+
+	// Fields which aren't coded can follow the slice
+	for n, c := range fields {
+		sf := t.Field(c.idx)
+		if sf.Type.Kind() == reflect.Slice && n != len(fields) - 1 {
+			return fmt.Errorf("Field %s: a slice must be the last field", sf.Name)
+		}
+	}
+
+	for _, c := range fields {
+		err := fn(t.Field(c.idx).Name, v.Field(c.idx), c.opts)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (e *encoder) fields(v reflect.Value) error {
+	return forFields(v, func(name string, f reflect.Value, opts options) error {
+		err := e.value(name, f, opts)
+		e.buf = append(e.buf, make([]byte, opts.pad)...)
+		return err
+	})
+}
+
+func structValue(v interface{}) (reflect.Value, error) {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Struct {
+		return rv, fmt.Errorf("Expected a struct, got %T", v)
+	}
+	return rv, nil
+}
+
+// Marshal encodes v, which must be a struct or a pointer to one
+func Marshal(v interface{}) ([]byte, error) {
+	rv, err := structValue(v)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &encoder{ buf: []byte{} }
+	err = e.fields(rv)
+	if err != nil {
+		return nil, err
+	}
+
+	return e.buf, nil
+}
+
+type decoder struct {
+	data []byte
+}
+
+func (d *decoder) take(name string, n int) ([]byte, error) {
+	if len(d.data) < n {
+		return nil, fmt.Errorf("Short data for field %s. Need %d bytes, have %d", name, n, len(d.data))
+	}
+
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b, nil
+}
+
+func (d *decoder) uint(name string, order binary.ByteOrder, size int) (uint64, error) {
+	b, err := d.take(name, size)
+	if err != nil {
+		return 0, err
+	}
+
+	switch size {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(order.Uint16(b)), nil
+	case 4:
+		return uint64(order.Uint32(b)), nil
+	}
+	return order.Uint64(b), nil
+}
+
+func (d *decoder) value(name string, v reflect.Value, opts options) error {
+	if v.Kind() == reflect.Array {
+		for i := 0; i < v.Len(); i++ {
+			err := d.value(fmt.Sprintf("%s[%d]", name, i), v.Index(i), opts)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if opts.fixed >= 0 {
+		if v.Kind() != reflect.Float32 && v.Kind() != reflect.Float64 {
+			return fmt.Errorf("Field %s: fixed needs a float, not %v", name, v.Type())
+		}
+
+		u, err := d.uint(name, opts.order, 4)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(float64(int32(uint32(u))) / float64(int64(1) << opts.fixed))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		u, err := d.uint(name, opts.order, 1)
+		if err != nil {
+			return err
+		}
+		v.SetBool(u != 0)
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		size := int(v.Type().Size())
+		u, err := d.uint(name, opts.order, size)
+		if err != nil {
+			return err
+		}
+		// Sign extend
+		shift := uint(64 - size * 8)
+		v.SetInt(int64(u << shift) >> shift)
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := d.uint(name, opts.order, int(v.Type().Size()))
+		if err != nil {
+			return err
+		}
+		v.SetUint(u)
+	case reflect.Float32:
+		u, err := d.uint(name, opts.order, 4)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(float64(math.Float32frombits(uint32(u))))
+	case reflect.Float64:
+		u, err := d.uint(name, opts.order, 8)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(math.Float64frombits(u))
+	case reflect.Struct:
+		return d.fields(v)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.Uint8 {
+			return fmt.Errorf("Field %s: unsupported type %v", name, v.Type())
+		}
+		v.SetBytes(append([]byte{}, d.data...))
+		d.data = nil
+	default:
+		return fmt.Errorf("Field %s: unsupported type %v", name, v.Type())
+	}
+
+	return nil
+}
+
+func (d *decoder) fields(v reflect.Value) error {
+	return forFields(v, func(name string, f reflect.Value, opts options) error {
+		err := d.value(name, f, opts)
+		if err != nil {
+			return err
+		}
+
+		_, err = d.take(name + " padding", opts.pad)
+		return err
+	})
+}
+
+// Unmarshal decodes data into v, which must be a pointer to a struct. It's
+// an error for data to be shorter than v, or longer unless the extra bytes
+// are all zero, as they are when a frame is padded.
+func Unmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("Expected a pointer to a struct, got %T", v)
+	}
+
+	rv, err := structValue(v)
+	if err != nil {
+		return err
+	}
+
+	d := &decoder{ data }
+	err = d.fields(rv)
+	if err != nil {
+		return err
+	}
+
+	for _, b := range d.data {
+		if b != 0 {
+			return fmt.Errorf("%d bytes of trailing data", len(d.data))
+		}
+	}
+
+	return nil
+}
+
+// Encode marshals v into a Packet for ep
+func Encode(ep uint8, v interface{}) (datalink.Packet, error) {
+	data, err := Marshal(v)
+	return datalink.Packet{ Endpoint: ep, Data: data }, err
+}
+
+// Request marshals req, sends it with c.Request, and unmarshals the
+// response into resp
+func Request(c *datalink.Client, req, resp interface{}) error {
+	data, err := Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	data, err = c.Request(data)
+	if err != nil {
+		return err
+	}
+
+	return Unmarshal(data, resp)
+}
@@ -0,0 +1,162 @@
+// Copyright 2017 Brian Starkey <stark3y@gmail.com>
+
+package codec
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type inner struct {
+	A int16 `datalink:"be"`
+	B bool
+}
+
+type everything struct {
+	U8 uint8
+	I16 int16
+	U32 uint32 `datalink:"be"`
+	I64 int64
+	F32 float32
+	Gain float64 `datalink:"fixed=16"`
+	Neg float32 `datalink:"fixed=8,pad=2"`
+	Arr [3]uint16
+	FixedArr [2]float32 `datalink:"fixed=4"`
+	Nested inner
+	Ignored int `datalink:"-"`
+	private int
+	Rest []byte
+}
+
+func TestRoundTrip(t *testing.T) {
+	in := everything{
+		U8: 0x12,
+		I16: -2,
+		U32: 0x01020304,
+		I64: -1 << 40,
+		F32: 1.5,
+		Gain: 2.25,
+		Neg: -1.5,
+		Arr: [3]uint16{ 1, 2, 0xffff },
+		FixedArr: [2]float32{ 0.5, -2 },
+		Nested: inner{ -300, true },
+		Rest: []byte{ 9, 8, 7 },
+	}
+
+	data, err := Marshal(&in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(data) != 1 + 2 + 4 + 8 + 4 + 4 + 4 + 2 + 6 + 8 + 3 + 3 {
+		t.Errorf("Unexpected length %d\n", len(data))
+	}
+
+	var out everything
+	err = Unmarshal(data, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("Round trip mismatch:\n  Expected: %+v\n       Got: %+v\n", in, out)
+	}
+}
+
+func TestEncoding(t *testing.T) {
+	v := struct {
+		BE uint16 `datalink:"be"`
+		LE uint16
+		Fixed float64 `datalink:"fixed=16,pad=1"`
+	}{ 0x0102, 0x0304, 1.5 }
+
+	data, err := Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []byte{ 0x01, 0x02, 0x04, 0x03, 0x00, 0x80, 0x01, 0x00, 0x00 }
+	if !bytes.Equal(data, expected) {
+		t.Errorf("Data mismatch:\n  Expected: %x\n       Got: %x\n", expected, data)
+	}
+}
+
+type errCase struct {
+	name string
+	err error
+	prefix string
+}
+
+func TestErrors(t *testing.T) {
+	var v struct {
+		A uint32
+	}
+
+	tests := []errCase{
+		{ "short", Unmarshal([]byte{ 1, 2 }, &v), "Short data for field A" },
+		{ "trailing", Unmarshal([]byte{ 1, 2, 3, 4, 5 }, &v), "1 bytes of trailing data" },
+		{ "not pointer", Unmarshal([]byte{ 1, 2, 3, 4 }, v), "Expected a pointer" },
+	}
+
+	_, err := Marshal(struct{ S string }{})
+	tests = append(tests, errCase{
+		"string", err, "Field S: unsupported type",
+	})
+
+	_, err = Marshal(struct{ A uint8 `datalink:"bogus"` }{})
+	tests = append(tests, errCase{
+		"bad tag", err, "Field A: Unknown option",
+	})
+
+	_, err = Marshal(struct{ A float64 `datalink:"fixed=16"` }{ 1e6 })
+	tests = append(tests, errCase{
+		"range", err, "Field A: 1e+06 out of range",
+	})
+
+	_, err = Marshal(struct{ B []byte; A uint8 }{})
+	tests = append(tests, errCase{
+		"slice", err, "Field B: a slice must be the last field",
+	})
+
+	for _, tc := range tests {
+		if tc.err == nil || !strings.HasPrefix(tc.err.Error(), tc.prefix) {
+			t.Errorf("%s: expected '%s' error, got: %v\n", tc.name, tc.prefix, tc.err)
+		}
+	}
+}
+
+func TestSliceBeforeUncoded(t *testing.T) {
+	type tail struct {
+		A uint8
+		Rest []byte
+		Ignored int `datalink:"-"`
+		private int
+	}
+
+	data, err := Marshal(tail{ A: 1, Rest: []byte{ 2, 3 } })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, []byte{ 1, 2, 3 }) {
+		t.Errorf("Data mismatch:\n  Expected: %x\n       Got: %x\n", []byte{ 1, 2, 3 }, data)
+	}
+}
+
+func TestTrailingZeros(t *testing.T) {
+	var v struct {
+		A uint16
+	}
+
+	// Frames from legacy firmware are padded with zeros
+	err := Unmarshal([]byte{ 1, 2, 0, 0, 0 }, &v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v.A != 0x0201 {
+		t.Errorf("Expected 0x0201, got 0x%04x\n", v.A)
+	}
+}
@@ -1,6 +1,14 @@
 // Copyright 2017 Brian Starkey <stark3y@gmail.com>
 package datalink
 
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
 type Packet struct {
 	Endpoint uint8
 	Data []byte
@@ -10,6 +18,22 @@ type Transactor interface {
 	Transact([]Packet) ([]Packet, error)
 }
 
+// ContextTransactor is a Transactor which can also take a context, which
+// carries the trace span the transaction belongs to
+type ContextTransactor interface {
+	Transactor
+	TransactContext(context.Context, []Packet) ([]Packet, error)
+}
+
+// TransactContext calls t.TransactContext if t is a ContextTransactor, or
+// t.Transact otherwise
+func TransactContext(ctx context.Context, t Transactor, packets []Packet) ([]Packet, error) {
+	if ct, ok := t.(ContextTransactor); ok {
+		return ct.TransactContext(ctx, packets)
+	}
+	return t.Transact(packets)
+}
+
 type Protocol interface {
 	Serialise([]Packet) []byte
 	DeSerialise([]byte) ([]Packet, error)
@@ -19,27 +43,155 @@ type Transport interface {
 	Transfer([]byte) ([]byte, error)
 }
 
+// TransferError wraps errors from the Transport when they're passed to
+// Observers, to tell them from Protocol errors
+type TransferError struct {
+	Err error
+}
+
+func (e *TransferError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *TransferError) Unwrap() error {
+	return e.Err
+}
+
+// Observer is told about each stage of a transaction. Observers may be
+// called concurrently, and must not modify their arguments.
+type Observer interface {
+	OnSerialise(tx []Packet, data []byte)
+	OnTransfer(tx, rx []byte, elapsed time.Duration)
+	OnDeSerialise(data []byte, rx []Packet)
+	OnError(err error)
+}
+
+// RetryObserver may be implemented by an Observer which also wants to
+// know when a Protocol retransmits data
+type RetryObserver interface {
+	OnRetry(ep uint8)
+}
+
+// Connection is safe for concurrent use. Transactions are serialised.
 type Connection struct {
 	protocol Protocol
 	transport Transport
+	observers []Observer
+	stats *statsRecorder
+
+	// mu serialises use of the protocol and transport
+	mu sync.Mutex
 }
 
 func NewConnection(proto Protocol, xport Transport) *Connection {
-	return &Connection{ proto, xport }
+	stats := newStatsRecorder()
+	return &Connection{
+		protocol: proto,
+		transport: xport,
+		observers: []Observer{ stats },
+		stats: stats,
+	}
+}
+
+// Stats returns statistics about c's transactions so far. It's safe to
+// call concurrently with Transact.
+func (c *Connection) Stats() Stats {
+	return c.stats.get()
+}
+
+// AddObserver attaches o to c. It must not be called concurrently with
+// Transact.
+func (c *Connection) AddObserver(o Observer) {
+	c.observers = append(c.observers, o)
+}
+
+// Retried is called by Protocols which do their own retransmissions, to
+// tell any RetryObservers about them
+func (c *Connection) Retried(ep uint8) {
+	for _, o := range c.observers {
+		if r, ok := o.(RetryObserver); ok {
+			r.OnRetry(ep)
+		}
+	}
+}
+
+func (c *Connection) error(err error) error {
+	for _, o := range c.observers {
+		o.OnError(err)
+	}
+	return err
 }
 
 func (c *Connection) Transact(packets []Packet) ([]Packet, error) {
-	tx := c.protocol.Serialise(packets)
+	return c.TransactContext(context.Background(), packets)
+}
 
+// transfer makes one transfer, telling the observers about it. c.mu must
+// be held.
+func (c *Connection) transfer(ctx context.Context, tx []byte) ([]byte, error) {
+	_, span := tracer().Start(ctx, "datalink.Transfer")
+	span.SetAttributes(attribute.Int("datalink.tx.wire_bytes", len(tx)))
+
+	start := time.Now()
 	rx, err := c.transport.Transfer(tx)
+	span.SetAttributes(attribute.Int("datalink.rx.wire_bytes", len(rx)))
+	EndSpan(span, err)
 	if err != nil {
+		c.error(&TransferError{ err })
 		return nil, err
 	}
 
-	rxPkts, err := c.protocol.DeSerialise(rx)
+	elapsed := time.Since(start)
+	for _, o := range c.observers {
+		o.OnTransfer(tx, rx, elapsed)
+	}
+
+	return rx, nil
+}
+
+// Exclusive runs fn with sole use of c's Transport, for Protocols which
+// make transfers of their own, like spiconn's Streams. Transfers made with
+// the function passed to fn are traced and observed like those made by
+// Transact.
+func (c *Connection) Exclusive(ctx context.Context, fn func(transfer func(tx []byte) ([]byte, error)) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return fn(func(tx []byte) ([]byte, error) {
+		return c.transfer(ctx, tx)
+	})
+}
+
+// TransactContext is Transact, recording a span as a child of any in ctx
+func (c *Connection) TransactContext(ctx context.Context, packets []Packet) (rxPkts []Packet, err error) {
+	ctx, span := tracer().Start(ctx, "datalink.Transact")
+	span.SetAttributes(PacketAttributes("tx", packets)...)
+	defer func() {
+		span.SetAttributes(PacketAttributes("rx", rxPkts)...)
+		EndSpan(span, err)
+	}()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tx := c.protocol.Serialise(packets)
+	for _, o := range c.observers {
+		o.OnSerialise(packets, tx)
+	}
+
+	rx, err := c.transfer(ctx, tx)
 	if err != nil {
 		return nil, err
 	}
 
+	rxPkts, err = c.protocol.DeSerialise(rx)
+	if err != nil {
+		return nil, c.error(err)
+	}
+
+	for _, o := range c.observers {
+		o.OnDeSerialise(rx, rxPkts)
+	}
+
 	return rxPkts, nil
 }
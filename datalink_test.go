@@ -0,0 +1,182 @@
+// Copyright 2017 Brian Starkey <stark3y@gmail.com>
+package datalink
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+// echoProto serialises each packet as [ep, len, data...]
+type echoProto struct { }
+
+func (p echoProto) Serialise(pkts []Packet) []byte {
+	buf := []byte{}
+	for _, pkt := range pkts {
+		buf = append(buf, pkt.Endpoint, byte(len(pkt.Data)))
+		buf = append(buf, pkt.Data...)
+	}
+	return buf
+}
+
+func (p echoProto) DeSerialise(data []byte) ([]Packet, error) {
+	pkts := []Packet{}
+	for len(data) > 0 {
+		if len(data) < 2 || len(data) < 2 + int(data[1]) {
+			return nil, fmt.Errorf("Short data")
+		}
+		pkts = append(pkts, Packet{ Endpoint: data[0], Data: data[2:2 + data[1]] })
+		data = data[2 + data[1]:]
+	}
+	return pkts, nil
+}
+
+type echoTransport struct {
+	err error
+}
+
+func (t echoTransport) Transfer(tx []byte) ([]byte, error) {
+	return tx, t.err
+}
+
+type recorder struct {
+	events []string
+}
+
+func (r *recorder) OnSerialise(tx []Packet, data []byte) {
+	r.events = append(r.events, fmt.Sprintf("serialise %d %x", len(tx), data))
+}
+
+func (r *recorder) OnTransfer(tx, rx []byte, elapsed time.Duration) {
+	r.events = append(r.events, fmt.Sprintf("transfer %x %x", tx, rx))
+}
+
+func (r *recorder) OnDeSerialise(data []byte, rx []Packet) {
+	r.events = append(r.events, fmt.Sprintf("deserialise %x %d", data, len(rx)))
+}
+
+func (r *recorder) OnError(err error) {
+	r.events = append(r.events, "error " + err.Error())
+}
+
+func TestObserver(t *testing.T) {
+	rec := &recorder{}
+	c := NewConnection(echoProto{}, echoTransport{})
+	c.AddObserver(rec)
+
+	_, err := c.Transact([]Packet{ { Endpoint: 1, Data: []byte{ 0xaa } } })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"serialise 1 0101aa",
+		"transfer 0101aa 0101aa",
+		"deserialise 0101aa 1",
+	}
+	if strings.Join(rec.events, ";") != strings.Join(expected, ";") {
+		t.Errorf("Events mismatch:\n  Expected: %v\n       Got: %v\n", expected, rec.events)
+	}
+
+	rec.events = nil
+	c = NewConnection(echoProto{}, echoTransport{ errors.New("Broken") })
+	c.AddObserver(rec)
+
+	_, err = c.Transact([]Packet{ { Endpoint: 1 } })
+	if err == nil {
+		t.Errorf("Expected an error\n")
+	}
+
+	if len(rec.events) != 2 || rec.events[1] != "error Broken" {
+		t.Errorf("Expected serialise and error events, got: %v\n", rec.events)
+	}
+}
+
+func TestLogObserver(t *testing.T) {
+	buf := &bytes.Buffer{}
+	h := slog.NewTextHandler(buf, &slog.HandlerOptions{ Level: slog.LevelDebug })
+
+	c := NewConnection(echoProto{}, echoTransport{})
+	c.AddObserver(NewLogObserver(slog.New(h)))
+
+	_, err := c.Transact([]Packet{ { Endpoint: 2, Data: []byte{ 0x12, 0x34 } } })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []string{ "msg=serialise", "msg=transfer", "msg=deserialise", "data=02021234", "packets=[2:1234]" } {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("Expected %q in log:\n%s\n", s, buf.String())
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	c := NewConnection(echoProto{}, echoTransport{})
+
+	for i := 0; i < 4; i++ {
+		c.Transact([]Packet{ { Endpoint: 1, Data: []byte{ 1, 2 } } })
+	}
+
+	c.Transact([]Packet{ { Endpoint: 1, Data: []byte{ 1, 2 } } })
+
+	// Truncated, so DeSerialise fails
+	c.protocol = shortProto{ echoProto{} }
+	c.Transact([]Packet{ { Endpoint: 1, Data: []byte{ 1, 2 } } })
+
+	c.transport = echoTransport{ errors.New("Broken") }
+	c.Transact([]Packet{ { Endpoint: 1, Data: []byte{ 1, 2 } } })
+	c.Retried(1)
+
+	s := c.Stats()
+	if s.Transfers != 6 {
+		t.Errorf("Expected 6 transfers, got %d\n", s.Transfers)
+	}
+	if s.ProtocolErrors != 1 || s.TransferErrors != 1 {
+		t.Errorf("Expected 1 protocol and 1 transfer error, got %d and %d\n",
+			s.ProtocolErrors, s.TransferErrors)
+	}
+	if s.Retries != 1 {
+		t.Errorf("Expected 1 retry, got %d\n", s.Retries)
+	}
+	if s.TxBytes != 14 || s.RxBytes != 10 {
+		t.Errorf("Expected 14 bytes sent and 10 received, got %d and %d\n",
+			s.TxBytes, s.RxBytes)
+	}
+	if s.Latency.Samples != 6 || s.Latency.P50 > s.Latency.P99 || s.Latency.P99 > s.Latency.Max {
+		t.Errorf("Bad latency stats: %+v\n", s.Latency)
+	}
+}
+
+func TestStatsExclusive(t *testing.T) {
+	xport := &echoTransport{}
+	c := NewConnection(echoProto{}, xport)
+
+	// A transfer which isn't followed by DeSerialise mustn't make the
+	// next transfer error count as a protocol error
+	c.Exclusive(context.Background(), func(transfer func(tx []byte) ([]byte, error)) error {
+		transfer([]byte{ 1 })
+		xport.err = errors.New("Broken")
+		transfer([]byte{ 2 })
+		return nil
+	})
+
+	s := c.Stats()
+	if s.ProtocolErrors != 0 || s.TransferErrors != 1 {
+		t.Errorf("Expected 0 protocol and 1 transfer error, got %d and %d\n",
+			s.ProtocolErrors, s.TransferErrors)
+	}
+}
+
+type shortProto struct {
+	echoProto
+}
+
+func (p shortProto) DeSerialise(data []byte) ([]Packet, error) {
+	return p.echoProto.DeSerialise(data[:len(data) - 1])
+}
@@ -0,0 +1,233 @@
+// Copyright 2017 Brian Starkey <stark3y@gmail.com>
+package dfu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"github.com/usedbytes/bot_matrix/datalink"
+)
+
+/*
+The bootloader protocol is carried on a single endpoint. Each request
+starts with an op byte, and is answered by a reply starting with the same
+op and a status byte. All values are little-endian, and checksums are
+IEEE CRC-32.
+
+OpStart:  u32 addr, u32 size, u32 crc -> u32 offset
+	Begin an update. If the bootloader already holds part of this same
+	image, offset says how much, and the update resumes from there.
+OpWrite:  u32 offset, data... -> u32 offset, u32 crc
+	Write a chunk. The reply holds the CRC of the chunk read back from
+	flash.
+OpFinish: -> u32 crc
+	Complete the update. The reply holds the CRC of the whole image.
+OpNop: -> (no reply)
+	Used to poll for replies which haven't arrived yet.
+*/
+
+const (
+	OpNop uint8 = iota
+	OpStart
+	OpWrite
+	OpFinish
+)
+
+// DefaultEndpoint is the bootloader's endpoint
+const DefaultEndpoint uint8 = 0xf0
+
+type Status uint8
+
+const (
+	StatusOK Status = iota
+	StatusBadImage
+	StatusBadOffset
+	StatusFlashError
+	StatusNotStarted
+)
+
+func (s Status) Error() string {
+	switch s {
+	case StatusOK:
+		return "OK"
+	case StatusBadImage:
+		return "Image rejected by bootloader"
+	case StatusBadOffset:
+		return "Bad write offset"
+	case StatusFlashError:
+		return "Flash error"
+	case StatusNotStarted:
+		return "Update not started"
+	}
+	return fmt.Sprintf("Bootloader error %d", uint8(s))
+}
+
+type Updater struct {
+	t datalink.Transactor
+
+	Endpoint uint8
+	// ChunkSize is the number of image bytes sent in each OpWrite. It
+	// must be more than 0, and if the Transactor has a MaxPacketLen
+	// method, each OpWrite must fit in that.
+	ChunkSize int
+	// Retries is the number of times to retry a chunk which fails
+	// verification
+	Retries int
+	// Polls is the number of times to poll for each reply
+	Polls int
+	// Progress, if set, is called after each chunk is written
+	Progress func(done, total int)
+}
+
+func NewUpdater(t datalink.Transactor) *Updater {
+	return &Updater{
+		t: t,
+		Endpoint: DefaultEndpoint,
+		ChunkSize: 128,
+		Retries: 3,
+		Polls: 8,
+	}
+}
+
+func le(v ...interface{}) []byte {
+	buf := new(bytes.Buffer)
+	for _, x := range v {
+		binary.Write(buf, binary.LittleEndian, x)
+	}
+	return buf.Bytes()
+}
+
+// call sends a request and waits for its reply, returning the reply's
+// arguments
+func (u *Updater) call(op uint8, args []byte, replyLen int) ([]byte, error) {
+	req := []datalink.Packet{
+		{
+			Endpoint: u.Endpoint,
+			Data: append([]byte{ op }, args...),
+		},
+	}
+	poll := []datalink.Packet{
+		{
+			Endpoint: u.Endpoint,
+			Data: []byte{ OpNop },
+		},
+	}
+
+	for i := 0; i <= u.Polls; i++ {
+		pkts, err := u.t.Transact(req)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, pkt := range pkts {
+			if pkt.Endpoint != u.Endpoint || len(pkt.Data) < 2 || pkt.Data[0] != op {
+				continue
+			}
+
+			if status := Status(pkt.Data[1]); status != StatusOK {
+				return nil, status
+			}
+
+			if len(pkt.Data) < 2 + replyLen {
+				return nil, fmt.Errorf("Short reply to op %d", op)
+			}
+
+			return pkt.Data[2:], nil
+		}
+
+		req = poll
+	}
+
+	return nil, fmt.Errorf("No reply to op %d", op)
+}
+
+func (u *Updater) writeChunk(offset uint32, chunk []byte) error {
+	var err error
+
+	for try := 0; try <= u.Retries; try++ {
+		var reply []byte
+
+		reply, err = u.call(OpWrite, append(le(offset), chunk...), 8)
+		if err == nil {
+			roff := binary.LittleEndian.Uint32(reply[0:])
+			rcrc := binary.LittleEndian.Uint32(reply[4:])
+
+			if roff != offset {
+				err = fmt.Errorf("Write at 0x%x acknowledged at 0x%x", offset, roff)
+			} else if rcrc != crc32.ChecksumIEEE(chunk) {
+				err = fmt.Errorf("Verify failed at 0x%x", offset)
+			} else {
+				return nil
+			}
+		}
+
+		if _, ok := err.(Status); ok && err != StatusFlashError {
+			return err
+		}
+	}
+
+	return err
+}
+
+// packetLimiter is implemented by Transactors which can only carry packets
+// up to a certain length, like *spiconn.SPIConn
+type packetLimiter interface {
+	MaxPacketLen() int
+}
+
+// OpWrite requests have an op and an offset before the chunk
+const writeHeaderLen = 5
+
+// Update writes img to the bootloader, resuming a previous, interrupted
+// update of the same image if possible.
+func (u *Updater) Update(img *Image) error {
+	if u.ChunkSize <= 0 {
+		return fmt.Errorf("Invalid chunk size %d", u.ChunkSize)
+	}
+	if l, ok := u.t.(packetLimiter); ok && writeHeaderLen + u.ChunkSize > l.MaxPacketLen() {
+		return fmt.Errorf("Chunk size %d too large, the link carries at most %d bytes per packet",
+			u.ChunkSize, l.MaxPacketLen() - writeHeaderLen)
+	}
+
+	size := uint32(len(img.Data))
+	crc := crc32.ChecksumIEEE(img.Data)
+
+	reply, err := u.call(OpStart, le(img.Addr, size, crc), 4)
+	if err != nil {
+		return fmt.Errorf("Start failed: %v", err)
+	}
+
+	offset := binary.LittleEndian.Uint32(reply)
+	if offset > size {
+		return fmt.Errorf("Bootloader resumed at 0x%x, past end of image", offset)
+	}
+
+	for offset < size {
+		end := offset + uint32(u.ChunkSize)
+		if end > size {
+			end = size
+		}
+
+		err = u.writeChunk(offset, img.Data[offset:end])
+		if err != nil {
+			return err
+		}
+
+		offset = end
+		if u.Progress != nil {
+			u.Progress(int(offset), int(size))
+		}
+	}
+
+	reply, err = u.call(OpFinish, nil, 4)
+	if err != nil {
+		return fmt.Errorf("Finish failed: %v", err)
+	}
+
+	if rcrc := binary.LittleEndian.Uint32(reply); rcrc != crc {
+		return fmt.Errorf("Image checksum mismatch. Expected %08x got %08x", crc, rcrc)
+	}
+
+	return nil
+}
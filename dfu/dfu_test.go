@@ -0,0 +1,303 @@
+// Copyright 2017 Brian Starkey <stark3y@gmail.com>
+
+package dfu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"strings"
+	"testing"
+
+	"github.com/usedbytes/bot_matrix/datalink"
+)
+
+// simBootloader is a simulated bootloader. Replies are returned on the
+// transaction after the request, like the real thing over SPI.
+type simBootloader struct {
+	addr, size, crc uint32
+	flash           []byte
+	have            uint32
+	started         bool
+	pending         []datalink.Packet
+
+	writes    int
+	failAfter int
+	corrupt   map[uint32]int
+}
+
+func newSimBootloader() *simBootloader {
+	return &simBootloader{
+		failAfter: -1,
+		corrupt:   make(map[uint32]int),
+	}
+}
+
+func reply(op uint8, status Status, args ...interface{}) datalink.Packet {
+	return datalink.Packet{
+		Endpoint: DefaultEndpoint,
+		Data:     append([]byte{op, uint8(status)}, le(args...)...),
+	}
+}
+
+func (b *simBootloader) handle(data []byte) []datalink.Packet {
+	switch data[0] {
+	case OpStart:
+		addr := binary.LittleEndian.Uint32(data[1:])
+		size := binary.LittleEndian.Uint32(data[5:])
+		crc := binary.LittleEndian.Uint32(data[9:])
+
+		if addr != b.addr || size != b.size || crc != b.crc {
+			b.addr, b.size, b.crc = addr, size, crc
+			b.flash = make([]byte, size)
+			b.have = 0
+		}
+		b.started = true
+
+		return []datalink.Packet{reply(OpStart, StatusOK, b.have)}
+	case OpWrite:
+		if !b.started {
+			return []datalink.Packet{reply(OpWrite, StatusNotStarted)}
+		}
+
+		off := binary.LittleEndian.Uint32(data[1:])
+		chunk := data[5:]
+		if off > b.have || off+uint32(len(chunk)) > b.size {
+			return []datalink.Packet{reply(OpWrite, StatusBadOffset)}
+		}
+
+		copy(b.flash[off:], chunk)
+		if b.corrupt[off] > 0 {
+			b.corrupt[off]--
+			b.flash[off] ^= 0xff
+		}
+
+		if off+uint32(len(chunk)) > b.have {
+			b.have = off + uint32(len(chunk))
+		}
+		b.writes++
+
+		crc := crc32.ChecksumIEEE(b.flash[off : off+uint32(len(chunk))])
+		return []datalink.Packet{reply(OpWrite, StatusOK, off, crc)}
+	case OpFinish:
+		if !b.started {
+			return []datalink.Packet{reply(OpFinish, StatusNotStarted)}
+		}
+
+		b.started = false
+		return []datalink.Packet{reply(OpFinish, StatusOK, crc32.ChecksumIEEE(b.flash))}
+	}
+
+	return nil
+}
+
+func (b *simBootloader) Transact(pkts []datalink.Packet) ([]datalink.Packet, error) {
+	if b.writes == b.failAfter {
+		b.failAfter = -1
+		return nil, fmt.Errorf("link down")
+	}
+
+	rx := b.pending
+	b.pending = nil
+
+	for _, pkt := range pkts {
+		if pkt.Endpoint == DefaultEndpoint && len(pkt.Data) > 0 {
+			b.pending = append(b.pending, b.handle(pkt.Data)...)
+		}
+	}
+
+	return rx, nil
+}
+
+func testImage(n int) *Image {
+	img := &Image{Addr: 0x08004000, Data: make([]byte, n)}
+	for i := range img.Data {
+		img.Data[i] = byte(i * 13)
+	}
+	return img
+}
+
+func TestUpdate(t *testing.T) {
+	b := newSimBootloader()
+	img := testImage(1000)
+
+	err := NewUpdater(b).Update(img)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if b.addr != img.Addr || !bytes.Equal(b.flash, img.Data) {
+		t.Errorf("Flash doesn't match image\n")
+	}
+}
+
+func TestUpdateVerifyRetry(t *testing.T) {
+	b := newSimBootloader()
+	img := testImage(1000)
+	b.corrupt[256] = 2
+
+	err := NewUpdater(b).Update(img)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !bytes.Equal(b.flash, img.Data) {
+		t.Errorf("Flash doesn't match image\n")
+	}
+
+	b = newSimBootloader()
+	b.corrupt[256] = 10
+
+	err = NewUpdater(b).Update(img)
+	if err == nil {
+		t.Errorf("Expected error, got none.\n")
+		return
+	}
+
+	if !strings.HasPrefix(err.Error(), "Verify failed") {
+		t.Errorf("Unexpected error, expected 'Verify failed', got: %s.\n",
+			err.Error())
+	}
+}
+
+func TestUpdateResume(t *testing.T) {
+	b := newSimBootloader()
+	img := testImage(1000)
+	b.failAfter = 3
+
+	u := NewUpdater(b)
+	u.Retries = 0
+
+	err := u.Update(img)
+	if err == nil {
+		t.Errorf("Expected error, got none.\n")
+		return
+	}
+
+	var resumed int
+	first := true
+	u.Progress = func(done, total int) {
+		if first {
+			resumed = done - u.ChunkSize
+			first = false
+		}
+	}
+
+	err = u.Update(img)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if resumed != 3*u.ChunkSize {
+		t.Errorf("Expected to resume at %d, resumed at %d\n",
+			3*u.ChunkSize, resumed)
+	}
+
+	if !bytes.Equal(b.flash, img.Data) {
+		t.Errorf("Flash doesn't match image\n")
+	}
+
+	// A different image must start from scratch
+	img = testImage(900)
+	first = true
+
+	err = u.Update(img)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if resumed != 0 {
+		t.Errorf("Expected to start at 0, started at %d\n", resumed)
+	}
+}
+
+func TestParseIHex(t *testing.T) {
+	src := `:020000040800F2
+:10400000000102030405060708090A0B0C0D0E0F38
+:044014001415161752
+:0400000508004000AF
+:00000001FF
+`
+	img, err := ParseIHex(strings.NewReader(src))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	expect := []byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07,
+		0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f,
+		0xff, 0xff, 0xff, 0xff, 0x14, 0x15, 0x16, 0x17}
+
+	if img.Addr != 0x08004000 {
+		t.Errorf("Unexpected address. Expected 0x%x, got 0x%x\n",
+			0x08004000, img.Addr)
+	}
+
+	if !bytes.Equal(img.Data, expect) {
+		t.Errorf("Data mismatch:\n  Expected: %x\n       Got: %x\n",
+			expect, img.Data)
+	}
+
+	_, err = ParseIHex(strings.NewReader(":0400000508004000AE\n:00000001FF\n"))
+	if err == nil || !strings.Contains(err.Error(), "Checksum error") {
+		t.Errorf("Expected checksum error, got: %v\n", err)
+	}
+
+	// Records at either end of flash would need a 128 MiB image
+	src = `:020000040800F2
+:0100000001FE
+:020000041000EA
+:0100000002FD
+:00000001FF
+`
+	_, err = ParseIHex(strings.NewReader(src))
+	if err == nil || !strings.HasPrefix(err.Error(), "Image too large") {
+		t.Errorf("Expected 'Image too large', got: %v\n", err)
+	}
+}
+
+type limitedBootloader struct {
+	*simBootloader
+	max int
+}
+
+func (l limitedBootloader) MaxPacketLen() int {
+	return l.max
+}
+
+func TestUpdateChunkSize(t *testing.T) {
+	b := limitedBootloader{ newSimBootloader(), 64 }
+	img := testImage(1000)
+	u := NewUpdater(b)
+
+	for _, tc := range []struct{
+		size int
+		prefix string
+	}{
+		{ 0, "Invalid chunk size" },
+		{ -1, "Invalid chunk size" },
+		{ 60, "Chunk size 60 too large" },
+	} {
+		u.ChunkSize = tc.size
+		err := u.Update(img)
+		if err == nil || !strings.HasPrefix(err.Error(), tc.prefix) {
+			t.Errorf("Chunk size %d: expected '%s' error, got: %v\n", tc.size, tc.prefix, err)
+		}
+	}
+
+	u.ChunkSize = 59
+	err := u.Update(img)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !bytes.Equal(b.flash, img.Data) {
+		t.Errorf("Flash doesn't match image\n")
+	}
+}
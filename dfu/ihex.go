@@ -0,0 +1,153 @@
+// Copyright 2017 Brian Starkey <stark3y@gmail.com>
+package dfu
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+type Image struct {
+	// Addr is the address of the first byte of Data
+	Addr uint32
+	Data []byte
+}
+
+// MaxImageSize is the largest image ParseIHex will build, including the
+// gaps between records
+const MaxImageSize = 16 * 1024 * 1024
+
+type segment struct {
+	addr uint32
+	data []byte
+}
+
+// ParseIHex reads an Intel HEX file. Gaps between records are filled
+// with 0xff, the erased value of flash, so records which are far apart
+// are rejected rather than building a huge image.
+func ParseIHex(r io.Reader) (*Image, error) {
+	var segs []segment
+	var base uint32
+	eof := false
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		rec := strings.TrimSpace(scanner.Text())
+		if len(rec) == 0 {
+			continue
+		}
+
+		if eof {
+			return nil, fmt.Errorf("line %d: Data after EOF record", line)
+		}
+
+		if rec[0] != ':' {
+			return nil, fmt.Errorf("line %d: Missing start code", line)
+		}
+
+		raw, err := hex.DecodeString(rec[1:])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+
+		if len(raw) < 5 || len(raw) != int(raw[0]) + 5 {
+			return nil, fmt.Errorf("line %d: Bad record length", line)
+		}
+
+		sum := byte(0)
+		for _, b := range raw {
+			sum += b
+		}
+		if sum != 0 {
+			return nil, fmt.Errorf("line %d: Checksum error", line)
+		}
+
+		addr := uint32(raw[1]) << 8 | uint32(raw[2])
+		data := raw[4:len(raw) - 1]
+
+		switch raw[3] {
+		case 0x00:
+			segs = append(segs, segment{ base + addr, data })
+		case 0x01:
+			eof = true
+		case 0x02:
+			if len(data) != 2 {
+				return nil, fmt.Errorf("line %d: Bad segment address record", line)
+			}
+			base = (uint32(data[0]) << 8 | uint32(data[1])) << 4
+		case 0x04:
+			if len(data) != 2 {
+				return nil, fmt.Errorf("line %d: Bad linear address record", line)
+			}
+			base = (uint32(data[0]) << 8 | uint32(data[1])) << 16
+		case 0x03, 0x05:
+			// Start address, not needed.
+		default:
+			return nil, fmt.Errorf("line %d: Unknown record type %d", line, raw[3])
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if !eof {
+		return nil, fmt.Errorf("Missing EOF record")
+	}
+
+	if len(segs) == 0 {
+		return nil, fmt.Errorf("No data")
+	}
+
+	// end can be past the top of the 32-bit address space
+	start, end := segs[0].addr, uint64(segs[0].addr)
+	for _, s := range segs {
+		if s.addr < start {
+			start = s.addr
+		}
+		if uint64(s.addr) + uint64(len(s.data)) > end {
+			end = uint64(s.addr) + uint64(len(s.data))
+		}
+	}
+
+	if end - uint64(start) > MaxImageSize {
+		return nil, fmt.Errorf("Image too large. Records span 0x%08x to 0x%08x, more than %d bytes",
+			start, end, MaxImageSize)
+	}
+
+	img := &Image{
+		Addr: start,
+		Data: bytes.Repeat([]byte{ 0xff }, int(end - uint64(start))),
+	}
+	for _, s := range segs {
+		copy(img.Data[s.addr - start:], s.data)
+	}
+
+	return img, nil
+}
+
+// LoadImage reads a firmware image. Files ending in .hex or .ihex are
+// parsed as Intel HEX, anything else is treated as a raw binary to be
+// loaded at addr.
+func LoadImage(path string, addr uint32) (*Image, error) {
+	if strings.HasSuffix(path, ".hex") || strings.HasSuffix(path, ".ihex") {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		return ParseIHex(f)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Image{ addr, data }, nil
+}
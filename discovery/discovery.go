@@ -0,0 +1,243 @@
+// Copyright 2017 Brian Starkey <stark3y@gmail.com>
+
+// Package discovery asks a peer which endpoints it has, and what they
+// carry. The answer is returned as a schema.Schema. Field docs aren't
+// sent, to keep the replies short.
+package discovery
+
+import (
+	"fmt"
+
+	"github.com/usedbytes/bot_matrix/datalink"
+	"github.com/usedbytes/bot_matrix/datalink/schema"
+)
+
+/*
+Discovery is carried on Endpoint. Each request starts with an op byte, and
+is answered by a reply starting with the same op and a status byte. Values
+are little-endian, and strings are a u8 length followed by that many bytes.
+
+OpDevice: -> u16 version, u8 count, str name, str doc
+	Describe the device. count is the number of endpoints.
+OpEndpoint: u8 index -> u8 index, u8 endpoint, u8 direction, u8 version,
+                        u8 nfields, u8 nresponse, str name, str doc
+	Describe endpoint number index, counting from 0 up to count.
+	direction is an index into Directions.
+OpField: u8 index, u8 field -> u8 index, u8 field, u8 type, u8 flags,
+                               u8 fixed, u8 count, u8 pad, str name,
+                               str units
+	Describe a field of endpoint number index. The request fields are
+	numbered first, followed by the response fields. type is an index
+	into Types.
+OpNop: -> (no reply)
+	Used to poll for replies which haven't arrived yet.
+*/
+
+const (
+	OpNop uint8 = iota
+	OpDevice
+	OpEndpoint
+	OpField
+)
+
+// Endpoint is reserved for discovery
+const Endpoint uint8 = 0xfe
+
+// FlagBigEndian is set in a field's flags if it's big endian
+const FlagBigEndian uint8 = 1 << 0
+
+// Types lists the field types, indexed by their value in OpField replies
+var Types = []string{
+	"bool",
+	"uint8", "int8",
+	"uint16", "int16",
+	"uint32", "int32",
+	"uint64", "int64",
+	"float32", "float64",
+}
+
+// Directions lists the endpoint directions, indexed by their value in
+// OpEndpoint replies
+var Directions = []schema.Direction{ schema.Out, schema.In, schema.InOut }
+
+type Status uint8
+
+const (
+	StatusOK Status = iota
+	StatusBadOp
+	StatusBadIndex
+)
+
+func (s Status) Error() string {
+	switch s {
+	case StatusOK:
+		return "OK"
+	case StatusBadOp:
+		return "Discovery op not supported by peer"
+	case StatusBadIndex:
+		return "Bad discovery index"
+	}
+	return fmt.Sprintf("Discovery error %d", uint8(s))
+}
+
+type reader struct {
+	data []byte
+	err error
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.err != nil {
+		return make([]byte, n)
+	}
+	if len(r.data) < n {
+		r.err = fmt.Errorf("Short reply")
+		return make([]byte, n)
+	}
+
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *reader) u8() uint8 {
+	return r.bytes(1)[0]
+}
+
+func (r *reader) u16() uint16 {
+	b := r.bytes(2)
+	return uint16(b[0]) | uint16(b[1]) << 8
+}
+
+func (r *reader) str() string {
+	return string(r.bytes(int(r.u8())))
+}
+
+func call(c *datalink.Client, op uint8, args ...byte) (*reader, error) {
+	reply, err := c.Request(append([]byte{ op }, args...))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(reply) < 2 || reply[0] != op {
+		return nil, fmt.Errorf("Unexpected reply to op %d: %x", op, reply)
+	}
+
+	if status := Status(reply[1]); status != StatusOK {
+		return nil, status
+	}
+
+	return &reader{ data: reply[2:] }, nil
+}
+
+func field(c *datalink.Client, idx, n uint8) (schema.Field, error) {
+	r, err := call(c, OpField, idx, n)
+	if err != nil {
+		return schema.Field{}, err
+	}
+
+	if r.u8() != idx || r.u8() != n {
+		return schema.Field{}, fmt.Errorf("Reply for the wrong field")
+	}
+
+	f := schema.Field{}
+	typ, flags := r.u8(), r.u8()
+	f.Fixed, f.Count, f.Pad = int(r.u8()), int(r.u8()), int(r.u8())
+	f.Name, f.Units = r.str(), r.str()
+	if r.err != nil {
+		return f, r.err
+	}
+
+	if int(typ) >= len(Types) {
+		return f, fmt.Errorf("Field %s has unknown type %d", f.Name, typ)
+	}
+	f.Type = Types[typ]
+
+	if flags & FlagBigEndian != 0 {
+		f.Endian = "be"
+	}
+
+	return f, nil
+}
+
+func endpoint(c *datalink.Client, idx uint8) (schema.Endpoint, error) {
+	r, err := call(c, OpEndpoint, idx)
+	if err != nil {
+		return schema.Endpoint{}, err
+	}
+
+	if r.u8() != idx {
+		return schema.Endpoint{}, fmt.Errorf("Reply for the wrong endpoint")
+	}
+
+	e := schema.Endpoint{}
+	e.Endpoint = r.u8()
+	dir := r.u8()
+	e.Version = r.u8()
+	nfields, nresponse := r.u8(), r.u8()
+	e.Name, e.Doc = r.str(), r.str()
+	if r.err != nil {
+		return e, r.err
+	}
+
+	if int(dir) >= len(Directions) {
+		return e, fmt.Errorf("Endpoint %s has unknown direction %d", e.Name, dir)
+	}
+	e.Direction = Directions[dir]
+
+	for n := 0; n < int(nfields) + int(nresponse); n++ {
+		f, err := field(c, idx, uint8(n))
+		if err != nil {
+			return e, fmt.Errorf("Endpoint %s: %v", e.Name, err)
+		}
+
+		if n < int(nfields) {
+			e.Fields = append(e.Fields, f)
+		} else {
+			e.Response = append(e.Response, f)
+		}
+	}
+
+	return e, nil
+}
+
+// DiscoverClient asks the peer to describe itself, using c, which must be
+// registered for Endpoint
+func DiscoverClient(c *datalink.Client) (*schema.Schema, error) {
+	r, err := call(c, OpDevice)
+	if err != nil {
+		return nil, fmt.Errorf("Discovery failed: %v", err)
+	}
+
+	s := &schema.Schema{}
+	s.Version = r.u16()
+	count := r.u8()
+	s.Name, s.Doc = r.str(), r.str()
+	if r.err != nil {
+		return nil, fmt.Errorf("Discovery failed: %v", r.err)
+	}
+
+	for i := uint8(0); i < count; i++ {
+		e, err := endpoint(c, i)
+		if err != nil {
+			return nil, fmt.Errorf("Discovery failed: %v", err)
+		}
+		s.Endpoints = append(s.Endpoints, e)
+	}
+
+	err = s.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("Peer described an invalid schema: %v", err)
+	}
+
+	return s, nil
+}
+
+// Discover asks the peer on t to describe itself
+func Discover(t datalink.Transactor) (*schema.Schema, error) {
+	c, err := datalink.NewMux(t, nil).Register(Endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return DiscoverClient(c)
+}
@@ -0,0 +1,75 @@
+// Copyright 2017 Brian Starkey <stark3y@gmail.com>
+
+package discovery_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/usedbytes/bot_matrix/datalink/discovery"
+	"github.com/usedbytes/bot_matrix/datalink/schema"
+	"github.com/usedbytes/bot_matrix/datalink/sim"
+)
+
+const testSchema = `{
+	"name": "Test",
+	"doc": "test device",
+	"version": 258,
+	"endpoints": [
+		{ "name": "Mode", "endpoint": 1, "direction": "out", "version": 2,
+		  "fields": [ { "name": "Mode", "type": "uint8" } ] },
+		{ "name": "Telemetry", "endpoint": 7, "direction": "in", "doc": "latest readings",
+		  "response": [
+			{ "name": "Speed", "type": "int32", "units": "rpm", "endian": "be" },
+			{ "name": "Current", "type": "float32", "units": "A", "fixed": 16, "pad": 2 }
+		  ] },
+		{ "name": "Echo", "endpoint": 9, "direction": "inout",
+		  "fields": [ { "name": "In", "type": "uint16", "count": 3 } ],
+		  "response": [ { "name": "Out", "type": "bool" } ] }
+	]
+}`
+
+func TestDiscover(t *testing.T) {
+	expected, err := schema.Parse(strings.NewReader(testSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer := sim.NewPeer()
+	peer.Handle(discovery.Endpoint, discovery.Responder(expected))
+
+	s, err := discovery.Discover(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(s, expected) {
+		t.Errorf("Schema mismatch:\n  Expected: %+v\n       Got: %+v\n", expected, s)
+	}
+}
+
+func TestDiscoverErrors(t *testing.T) {
+	peer := sim.NewPeer()
+
+	_, err := discovery.Discover(peer)
+	if err == nil || !strings.HasPrefix(err.Error(), "Discovery failed: No response") {
+		t.Errorf("Expected 'No response' error, got: %v\n", err)
+	}
+
+	// A peer which claims more endpoints than it has
+	s := &schema.Schema{ Name: "Liar" }
+	respond := discovery.Responder(s)
+	peer.Handle(discovery.Endpoint, func(req []byte) []byte {
+		reply := respond(req)
+		if req[0] == discovery.OpDevice {
+			reply[4] = 1
+		}
+		return reply
+	})
+
+	_, err = discovery.Discover(peer)
+	if err == nil || !strings.HasPrefix(err.Error(), "Discovery failed: " + discovery.StatusBadIndex.Error()) {
+		t.Errorf("Expected bad index error, got: %v\n", err)
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2017 Brian Starkey <stark3y@gmail.com>
+
+package discovery
+
+import (
+	"github.com/usedbytes/bot_matrix/datalink/schema"
+)
+
+type writer struct {
+	buf []byte
+}
+
+func (w *writer) u8(v ...uint8) {
+	w.buf = append(w.buf, v...)
+}
+
+func (w *writer) u16(v uint16) {
+	w.buf = append(w.buf, uint8(v), uint8(v >> 8))
+}
+
+// Strings longer than 255 bytes are truncated
+func (w *writer) str(s string) {
+	if len(s) > 255 {
+		s = s[:255]
+	}
+	w.u8(uint8(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+func indexOf(types []string, t string) uint8 {
+	for i, v := range types {
+		if v == t {
+			return uint8(i)
+		}
+	}
+	return 0xff
+}
+
+func describeField(w *writer, f schema.Field) {
+	flags := uint8(0)
+	if f.Endian == "be" {
+		flags |= FlagBigEndian
+	}
+
+	w.u8(indexOf(Types, f.Type), flags, uint8(f.Fixed), uint8(f.Count), uint8(f.Pad))
+	w.str(f.Name)
+	w.str(f.Units)
+}
+
+func describeEndpoint(w *writer, e schema.Endpoint) {
+	dir := uint8(0)
+	for i, d := range Directions {
+		if d == e.Direction {
+			dir = uint8(i)
+		}
+	}
+
+	w.u8(e.Endpoint, dir, e.Version, uint8(len(e.Fields)), uint8(len(e.Response)))
+	w.str(e.Name)
+	w.str(e.Doc)
+}
+
+// Responder answers discovery requests by describing s, as the firmware
+// does. It takes the data of each request on Endpoint, and returns the
+// data of the reply, or nil if there isn't one.
+func Responder(s *schema.Schema) func(req []byte) []byte {
+	return func(req []byte) []byte {
+		if len(req) == 0 || req[0] == OpNop {
+			return nil
+		}
+
+		w := &writer{}
+		status := func(s Status) []byte {
+			return []byte{ req[0], uint8(s) }
+		}
+
+		switch req[0] {
+		case OpDevice:
+			w.u8(OpDevice, uint8(StatusOK))
+			w.u16(s.Version)
+			w.u8(uint8(len(s.Endpoints)))
+			w.str(s.Name)
+			w.str(s.Doc)
+		case OpEndpoint:
+			if len(req) < 2 || int(req[1]) >= len(s.Endpoints) {
+				return status(StatusBadIndex)
+			}
+
+			w.u8(OpEndpoint, uint8(StatusOK), req[1])
+			describeEndpoint(w, s.Endpoints[req[1]])
+		case OpField:
+			if len(req) < 3 || int(req[1]) >= len(s.Endpoints) {
+				return status(StatusBadIndex)
+			}
+
+			e := s.Endpoints[req[1]]
+			fields := append(append([]schema.Field{}, e.Fields...), e.Response...)
+			if int(req[2]) >= len(fields) {
+				return status(StatusBadIndex)
+			}
+
+			w.u8(OpField, uint8(StatusOK), req[1], req[2])
+			describeField(w, fields[req[2]])
+		default:
+			return status(StatusBadOp)
+		}
+
+		return w.buf
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2017 Brian Starkey <stark3y@gmail.com>
+package datalink
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+type hexBytes []byte
+
+func (h hexBytes) LogValue() slog.Value {
+	return slog.StringValue(hex.EncodeToString(h))
+}
+
+type packetList []Packet
+
+func (p packetList) LogValue() slog.Value {
+	strs := make([]string, 0, len(p))
+	for _, pkt := range p {
+		strs = append(strs, fmt.Sprintf("%d:%s", pkt.Endpoint, hex.EncodeToString(pkt.Data)))
+	}
+	return slog.StringValue("[" + strings.Join(strs, " ") + "]")
+}
+
+// LogObserver is an Observer which logs hex dumps and decoded packets at
+// debug level, and errors at warning level. Byte buffers which are nil
+// aren't logged, so it can also be used where only packets are known,
+// like RPCServ.
+type LogObserver struct {
+	l *slog.Logger
+}
+
+func NewLogObserver(l *slog.Logger) *LogObserver {
+	return &LogObserver{ l }
+}
+
+func (o *LogObserver) OnSerialise(tx []Packet, data []byte) {
+	args := []any{ "packets", packetList(tx) }
+	if data != nil {
+		args = append(args, "data", hexBytes(data))
+	}
+	o.l.Debug("serialise", args...)
+}
+
+func (o *LogObserver) OnTransfer(tx, rx []byte, elapsed time.Duration) {
+	o.l.Debug("transfer", "tx", hexBytes(tx), "rx", hexBytes(rx), "elapsed", elapsed)
+}
+
+func (o *LogObserver) OnDeSerialise(data []byte, rx []Packet) {
+	args := []any{ "packets", packetList(rx) }
+	if data != nil {
+		args = append(args, "data", hexBytes(data))
+	}
+	o.l.Debug("deserialise", args...)
+}
+
+func (o *LogObserver) OnRetry(ep uint8) {
+	o.l.Debug("retry", "endpoint", ep)
+}
+
+func (o *LogObserver) OnError(err error) {
+	o.l.Warn("error", "err", err)
+}
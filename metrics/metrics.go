@@ -0,0 +1,152 @@
+// Copyright 2017 Brian Starkey <stark3y@gmail.com>
+
+// Package metrics provides Prometheus metrics for the health of a
+// datalink.Connection.
+package metrics
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/usedbytes/bot_matrix/datalink"
+	"github.com/usedbytes/bot_matrix/datalink/spiconn"
+)
+
+// Link is a datalink.Observer which records metrics about a Connection.
+// It's also a prometheus.Collector, so it must be registered to be
+// exported.
+type Link struct {
+	// FrameLen, if set, returns the length of each frame on the wire, so
+	// that frames can be counted. For an SPIConn, use its FrameLen method.
+	FrameLen func() int
+
+	transactions prometheus.Counter
+	framesTx prometheus.Counter
+	framesRx prometheus.Counter
+	errors *prometheus.CounterVec
+	retries *prometheus.CounterVec
+	latency prometheus.Histogram
+	bytes *prometheus.CounterVec
+}
+
+// Values of the "type" label on the errors metric
+const (
+	ErrorCRC = "crc"
+	ErrorID = "id"
+	ErrorShortData = "short_data"
+	ErrorLength = "length"
+	ErrorOther = "other"
+)
+
+// NewLink creates a Link whose metric names are prefixed with namespace
+func NewLink(namespace string) *Link {
+	return &Link{
+		transactions: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name: "transactions_total",
+			Help: "Completed transfers",
+		}),
+		framesTx: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name: "frames_sent_total",
+			Help: "Frames sent, including null frames",
+		}),
+		framesRx: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name: "frames_received_total",
+			Help: "Frames received, including null frames",
+		}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name: "errors_total",
+			Help: "Link errors, by type",
+		}, []string{ "type" }),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name: "retries_total",
+			Help: "Retransmissions, by endpoint",
+		}, []string{ "endpoint" }),
+		latency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name: "transfer_seconds",
+			Help: "Time taken by each transfer",
+			// 50us to ~100ms
+			Buckets: prometheus.ExponentialBuckets(50e-6, 2, 12),
+		}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name: "packet_bytes_total",
+			Help: "Packet payload bytes, by endpoint and direction",
+		}, []string{ "endpoint", "direction" }),
+	}
+}
+
+func (l *Link) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		l.transactions, l.framesTx, l.framesRx, l.errors,
+		l.retries, l.latency, l.bytes,
+	}
+}
+
+func (l *Link) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range l.collectors() {
+		c.Describe(ch)
+	}
+}
+
+func (l *Link) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range l.collectors() {
+		c.Collect(ch)
+	}
+}
+
+func (l *Link) countBytes(pkts []datalink.Packet, dir string) {
+	for _, p := range pkts {
+		ep := strconv.Itoa(int(p.Endpoint))
+		l.bytes.WithLabelValues(ep, dir).Add(float64(len(p.Data)))
+	}
+}
+
+func (l *Link) OnSerialise(tx []datalink.Packet, data []byte) {
+	l.countBytes(tx, "tx")
+}
+
+func (l *Link) OnTransfer(tx, rx []byte, elapsed time.Duration) {
+	l.transactions.Inc()
+	l.latency.Observe(elapsed.Seconds())
+
+	if l.FrameLen != nil {
+		if n := l.FrameLen(); n > 0 {
+			l.framesTx.Add(float64(len(tx) / n))
+			l.framesRx.Add(float64(len(rx) / n))
+		}
+	}
+}
+
+func (l *Link) OnDeSerialise(data []byte, rx []datalink.Packet) {
+	l.countBytes(rx, "rx")
+}
+
+func (l *Link) OnRetry(ep uint8) {
+	l.retries.WithLabelValues(strconv.Itoa(int(ep))).Inc()
+}
+
+func errorType(err error) string {
+	switch {
+	case errors.Is(err, spiconn.ErrCRC):
+		return ErrorCRC
+	case errors.Is(err, spiconn.ErrID):
+		return ErrorID
+	case errors.Is(err, spiconn.ErrShortData):
+		return ErrorShortData
+	case errors.Is(err, spiconn.ErrLength):
+		return ErrorLength
+	}
+	return ErrorOther
+}
+
+func (l *Link) OnError(err error) {
+	l.errors.WithLabelValues(errorType(err)).Inc()
+}
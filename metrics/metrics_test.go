@@ -0,0 +1,62 @@
+// Copyright 2017 Brian Starkey <stark3y@gmail.com>
+
+package metrics
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/usedbytes/bot_matrix/datalink"
+	"github.com/usedbytes/bot_matrix/datalink/spiconn"
+)
+
+func TestLink(t *testing.T) {
+	l := NewLink("test")
+	l.FrameLen = func() int { return 4 }
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(l)
+
+	tx := []datalink.Packet{ { Endpoint: 1, Data: []byte{ 1, 2, 3 } } }
+	l.OnSerialise(tx, make([]byte, 8))
+	l.OnTransfer(make([]byte, 8), make([]byte, 8), time.Millisecond)
+	l.OnDeSerialise(make([]byte, 8), []datalink.Packet{ { Endpoint: 2, Data: []byte{ 1 } } })
+	l.OnRetry(1)
+	l.OnError(fmt.Errorf("%w in packet 2", spiconn.ErrCRC))
+	l.OnError(fmt.Errorf("%w. Have 3 bytes, need 4", spiconn.ErrShortData))
+	l.OnError(fmt.Errorf("Something else"))
+
+	checks := []struct{
+		name string
+		c prometheus.Collector
+		expected float64
+	}{
+		{ "transactions", l.transactions, 1 },
+		{ "frames sent", l.framesTx, 2 },
+		{ "frames received", l.framesRx, 2 },
+		{ "tx bytes", l.bytes.WithLabelValues("1", "tx"), 3 },
+		{ "rx bytes", l.bytes.WithLabelValues("2", "rx"), 1 },
+		{ "retries", l.retries.WithLabelValues("1"), 1 },
+		{ "CRC errors", l.errors.WithLabelValues(ErrorCRC), 1 },
+		{ "short data errors", l.errors.WithLabelValues(ErrorShortData), 1 },
+		{ "ID errors", l.errors.WithLabelValues(ErrorID), 0 },
+		{ "other errors", l.errors.WithLabelValues(ErrorOther), 1 },
+	}
+
+	for _, c := range checks {
+		if v := testutil.ToFloat64(c.c); v != c.expected {
+			t.Errorf("%s: expected %v, got %v\n", c.name, c.expected, v)
+		}
+	}
+
+	n, err := testutil.GatherAndCount(reg, "test_transfer_seconds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("Expected latency histogram to be exported\n")
+	}
+}
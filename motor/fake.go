@@ -0,0 +1,75 @@
+// Copyright 2017 Brian Starkey <stark3y@gmail.com>
+
+package motor
+
+// Fake is an in-memory Device, for tests. It keeps the last value sent to
+// each endpoint, as it would go on the wire, and returns Telemetry from
+// GetTelemetry, after calling Measure if it's set.
+//
+// Fake isn't safe for concurrent use, but a MotorController serialises its
+// calls, so its fields can be read when no calls are in progress.
+type Fake struct {
+	// Err, if not nil, is returned by every call, and nothing is recorded
+	Err error
+	// Calls counts the successful calls
+	Calls int
+
+	LED LED
+	Freq Freq
+	Duty map[uint8]Duty
+	Gains Gains
+	Setpoint Setpoint
+	Ilimit Ilimit
+
+	Telemetry TelemetryResponse
+	Measure func(f *Fake)
+}
+
+func NewFake() *Fake {
+	return &Fake{ Duty: make(map[uint8]Duty) }
+}
+
+func (f *Fake) record(fn func()) error {
+	if f.Err != nil {
+		return f.Err
+	}
+
+	fn()
+	f.Calls++
+	return nil
+}
+
+func (f *Fake) SetLED(v LED) error {
+	return f.record(func() { f.LED = v })
+}
+
+func (f *Fake) SetFreq(v Freq) error {
+	return f.record(func() { f.Freq = v })
+}
+
+func (f *Fake) SetDuty(v Duty) error {
+	return f.record(func() { f.Duty[v.Channel] = v })
+}
+
+func (f *Fake) SetGains(v Gains) error {
+	return f.record(func() { f.Gains = v })
+}
+
+func (f *Fake) SetSetpoint(v Setpoint) error {
+	return f.record(func() { f.Setpoint = v })
+}
+
+func (f *Fake) SetIlimit(v Ilimit) error {
+	return f.record(func() { f.Ilimit = v })
+}
+
+func (f *Fake) GetTelemetry() (TelemetryResponse, error) {
+	if f.Err != nil {
+		return TelemetryResponse{}, f.Err
+	}
+
+	if f.Measure != nil {
+		f.Measure(f)
+	}
+	return f.Telemetry, nil
+}
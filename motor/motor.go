@@ -0,0 +1,279 @@
+// Copyright 2017 Brian Starkey <stark3y@gmail.com>
+
+// Package motor is a client for the motor controller firmware.
+//
+// The wire types and the low level MotorClient are generated from
+// motor.json by dlgen, which also generates motor.h for the firmware.
+// MotorController wraps a Device (usually a MotorClient) with checked,
+// typed, setters, and remembers what it has set.
+package motor
+
+//go:generate go run ../cmd/dlgen -schema motor.json -go motor_gen.go -c motor.h
+
+import (
+	"bytes"
+	_ "embed"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/usedbytes/bot_matrix/datalink"
+	"github.com/usedbytes/bot_matrix/datalink/schema"
+)
+
+//go:embed motor.json
+var schemaJSON []byte
+
+// Schema returns the parsed motor.json
+func Schema() *schema.Schema {
+	s, err := schema.Parse(bytes.NewReader(schemaJSON))
+	if err != nil {
+		// motor.json is checked by go generate and the tests
+		panic(err)
+	}
+	return s
+}
+
+// ErrInvalid is wrapped by the errors for settings which fail validation
+var ErrInvalid = errors.New("Invalid setting")
+
+// Device sends settings to, and reads telemetry from, the firmware.
+// *MotorClient implements it over a datalink connection, and *Fake in
+// memory.
+type Device interface {
+	SetLED(LED) error
+	SetFreq(Freq) error
+	SetDuty(Duty) error
+	SetGains(Gains) error
+	SetSetpoint(Setpoint) error
+	SetIlimit(Ilimit) error
+	GetTelemetry() (TelemetryResponse, error)
+}
+
+type Direction uint8
+
+const (
+	Forward Direction = 0
+	Reverse Direction = 1
+)
+
+func (d Direction) String() string {
+	switch d {
+	case Forward:
+		return "forward"
+	case Reverse:
+		return "reverse"
+	}
+	return fmt.Sprintf("Direction(%d)", uint8(d))
+}
+
+// Limits bounds the values a MotorController will send
+type Limits struct {
+	// Channels is the number of PWM channels, numbered from 0
+	Channels uint8
+	// MinFreq and MaxFreq bound the PWM frequency, in Hz
+	MinFreq, MaxFreq uint32
+	// MaxGain is the largest magnitude of each PID gain. Gains are sent
+	// as 16.16 fixed point, so it can't be more than 32767.
+	MaxGain float64
+}
+
+var DefaultLimits = Limits{
+	Channels: 2,
+	MinFreq: 100,
+	MaxFreq: 100000,
+	MaxGain: 32767,
+}
+
+// ChannelDuty is the drive on one PWM channel
+type ChannelDuty struct {
+	Dir Direction
+	// Duty is the fraction of each period which is on, from 0 to 1
+	Duty float64
+}
+
+// Settings are the values last sent by a MotorController. The firmware
+// can't report its settings, so anything which hasn't been set since the
+// MotorController was created is zero (or missing, for Duty).
+type Settings struct {
+	LED bool
+	Freq uint32
+	Duty map[uint8]ChannelDuty
+	Gains Gains
+	// GainsSet is true once Gains has been sent, so they're known
+	GainsSet bool
+	Setpoint uint32
+	Ilimit uint32
+}
+
+// MotorController is safe for concurrent use. Calls to its Device are
+// serialised.
+type MotorController struct {
+	// Limits are used to validate settings. They're set to DefaultLimits
+	// on creation, and shouldn't be changed once the MotorController is
+	// in use.
+	Limits Limits
+
+	dev Device
+
+	mu sync.Mutex
+	settings Settings
+}
+
+// NewMotorController creates a MotorController with its own Mux over t
+func NewMotorController(t datalink.Transactor) (*MotorController, error) {
+	return NewMotorControllerMux(datalink.NewMux(t, nil))
+}
+
+// NewMotorControllerMux creates a MotorController which registers its
+// endpoints with m
+func NewMotorControllerMux(m *datalink.Mux) (*MotorController, error) {
+	c, err := NewMotorClientMux(m)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewMotorControllerDevice(c), nil
+}
+
+// NewMotorControllerDevice creates a MotorController which sends to dev
+func NewMotorControllerDevice(dev Device) *MotorController {
+	return &MotorController{
+		Limits: DefaultLimits,
+		dev: dev,
+		settings: Settings{ Duty: make(map[uint8]ChannelDuty) },
+	}
+}
+
+// apply calls send, and if it succeeds, record
+func (m *MotorController) apply(send func() error, record func(s *Settings)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	err := send()
+	if err != nil {
+		return err
+	}
+
+	record(&m.settings)
+	return nil
+}
+
+func (m *MotorController) SetLED(on bool) error {
+	return m.apply(func() error {
+		return m.dev.SetLED(LED{ on })
+	}, func(s *Settings) {
+		s.LED = on
+	})
+}
+
+// SetFreq sets the PWM frequency, in Hz
+func (m *MotorController) SetFreq(hz uint32) error {
+	if hz < m.Limits.MinFreq || hz > m.Limits.MaxFreq {
+		return fmt.Errorf("%w: frequency %d Hz, must be %d to %d", ErrInvalid,
+			hz, m.Limits.MinFreq, m.Limits.MaxFreq)
+	}
+
+	return m.apply(func() error {
+		return m.dev.SetFreq(Freq{ hz })
+	}, func(s *Settings) {
+		s.Freq = hz
+	})
+}
+
+// SetDuty sets the direction and duty cycle of channel. duty is a
+// fraction from 0 to 1, which is rounded to the nearest 1/65535.
+func (m *MotorController) SetDuty(channel uint8, dir Direction, duty float64) error {
+	if channel >= m.Limits.Channels {
+		return fmt.Errorf("%w: channel %d, there are %d", ErrInvalid, channel, m.Limits.Channels)
+	}
+	if dir != Forward && dir != Reverse {
+		return fmt.Errorf("%w: direction %d", ErrInvalid, dir)
+	}
+	if !(duty >= 0 && duty <= 1) {
+		return fmt.Errorf("%w: duty %v, must be 0 to 1", ErrInvalid, duty)
+	}
+
+	raw := uint16(math.Round(duty * math.MaxUint16))
+
+	return m.apply(func() error {
+		return m.dev.SetDuty(Duty{ channel, uint8(dir), raw })
+	}, func(s *Settings) {
+		s.Duty[channel] = ChannelDuty{ dir, float64(raw) / math.MaxUint16 }
+	})
+}
+
+// Stop sets the duty cycle of every channel to zero. It tries all of the
+// channels, and returns the first error.
+func (m *MotorController) Stop() error {
+	var first error
+	for ch := uint8(0); ch < m.Limits.Channels; ch++ {
+		err := m.SetDuty(ch, Forward, 0)
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+
+	return first
+}
+
+// SetGains sets the PID gains
+func (m *MotorController) SetGains(g Gains) error {
+	for _, v := range []struct{
+		name string
+		val float64
+	}{ { "Kc", g.Kc }, { "Kd", g.Kd }, { "Ki", g.Ki } } {
+		if !(math.Abs(v.val) <= m.Limits.MaxGain) {
+			return fmt.Errorf("%w: %s %v, magnitude must be at most %v", ErrInvalid,
+				v.name, v.val, m.Limits.MaxGain)
+		}
+	}
+
+	return m.apply(func() error {
+		return m.dev.SetGains(g)
+	}, func(s *Settings) {
+		s.Gains = g
+		s.GainsSet = true
+	})
+}
+
+// SetSetpoint sets the PID set point
+func (m *MotorController) SetSetpoint(sp uint32) error {
+	return m.apply(func() error {
+		return m.dev.SetSetpoint(Setpoint{ sp })
+	}, func(s *Settings) {
+		s.Setpoint = sp
+	})
+}
+
+// SetIlimit sets the limit of the PID integral term
+func (m *MotorController) SetIlimit(il uint32) error {
+	return m.apply(func() error {
+		return m.dev.SetIlimit(Ilimit{ il })
+	}, func(s *Settings) {
+		s.Ilimit = il
+	})
+}
+
+// Telemetry reads the latest measurements
+func (m *MotorController) Telemetry() (TelemetryResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.dev.GetTelemetry()
+}
+
+// Settings returns a copy of the current settings
+func (m *MotorController) Settings() Settings {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := m.settings
+	s.Duty = make(map[uint8]ChannelDuty, len(m.settings.Duty))
+	for ch, d := range m.settings.Duty {
+		s.Duty[ch] = d
+	}
+
+	return s
+}
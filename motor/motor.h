@@ -0,0 +1,58 @@
+/* Code generated by dlgen from motor.json. DO NOT EDIT. */
+#ifndef __MOTOR_H__
+#define __MOTOR_H__
+
+#include <stdint.h>
+
+/* Multi-byte fields are little endian unless noted */
+
+#define MOTOR_EP_LED 1
+#define MOTOR_EP_FREQ 2
+#define MOTOR_EP_DUTY 3
+#define MOTOR_EP_GAINS 4
+#define MOTOR_EP_SETPOINT 5
+#define MOTOR_EP_ILIMIT 6
+#define MOTOR_EP_TELEMETRY 7
+
+/* LED request (out) */
+struct motor_led {
+	uint8_t on;
+} __attribute__((packed));
+
+/* Freq request (out): PWM frequency */
+struct motor_freq {
+	uint32_t freq; /* units: Hz */
+} __attribute__((packed));
+
+/* Duty request (out): PWM duty cycle */
+struct motor_duty {
+	uint8_t channel;
+	uint8_t dir; /* 0 forwards, 1 reverse */
+	uint16_t duty; /* units: 1/65536 */
+} __attribute__((packed));
+
+/* Gains request (out): PID gains */
+struct motor_gains {
+	int32_t kc; /* 16.16 fixed point */
+	int32_t kd; /* 16.16 fixed point */
+	int32_t ki; /* 16.16 fixed point */
+} __attribute__((packed));
+
+/* Setpoint request (out): PID set point */
+struct motor_setpoint {
+	uint32_t setpoint;
+} __attribute__((packed));
+
+/* Ilimit request (out): PID integral limit */
+struct motor_ilimit {
+	uint32_t ilimit;
+} __attribute__((packed));
+
+/* Telemetry response (in): latest measurements */
+struct motor_telemetry_response {
+	uint32_t speed; /* in set point units */
+	uint16_t current; /* units: mA */
+	uint16_t duty; /* PWM output, units: 1/65536 */
+} __attribute__((packed));
+
+#endif /* __MOTOR_H__ */
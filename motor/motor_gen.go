@@ -0,0 +1,181 @@
+// Code generated by dlgen from motor.json. DO NOT EDIT.
+
+package motor
+
+import (
+	"github.com/usedbytes/bot_matrix/datalink"
+	"github.com/usedbytes/bot_matrix/datalink/codec"
+)
+
+const (
+	EndpointLED       uint8 = 1
+	EndpointFreq      uint8 = 2
+	EndpointDuty      uint8 = 3
+	EndpointGains     uint8 = 4
+	EndpointSetpoint  uint8 = 5
+	EndpointIlimit    uint8 = 6
+	EndpointTelemetry uint8 = 7
+)
+
+// LED is the request to EndpointLED
+type LED struct {
+	On bool
+}
+
+// Freq is the request to EndpointFreq: PWM frequency
+type Freq struct {
+	Freq uint32 // units: Hz
+}
+
+// Duty is the request to EndpointDuty: PWM duty cycle
+type Duty struct {
+	Channel uint8
+	Dir     uint8  // 0 forwards, 1 reverse
+	Duty    uint16 // units: 1/65536
+}
+
+// Gains is the request to EndpointGains: PID gains
+type Gains struct {
+	Kc float64 `datalink:"fixed=16"` // 16.16 fixed point
+	Kd float64 `datalink:"fixed=16"` // 16.16 fixed point
+	Ki float64 `datalink:"fixed=16"` // 16.16 fixed point
+}
+
+// Setpoint is the request to EndpointSetpoint: PID set point
+type Setpoint struct {
+	Setpoint uint32
+}
+
+// Ilimit is the request to EndpointIlimit: PID integral limit
+type Ilimit struct {
+	Ilimit uint32
+}
+
+// TelemetryResponse is the response from EndpointTelemetry
+type TelemetryResponse struct {
+	Speed   uint32 // in set point units
+	Current uint16 // units: mA
+	Duty    uint16 // PWM output, units: 1/65536
+}
+
+// MotorClient has a method for each endpoint of the motor controller
+type MotorClient struct {
+	epLED       *datalink.Client
+	epFreq      *datalink.Client
+	epDuty      *datalink.Client
+	epGains     *datalink.Client
+	epSetpoint  *datalink.Client
+	epIlimit    *datalink.Client
+	epTelemetry *datalink.Client
+}
+
+// NewMotorClient creates a client with its own Mux over t
+func NewMotorClient(t datalink.Transactor) (*MotorClient, error) {
+	return NewMotorClientMux(datalink.NewMux(t, nil))
+}
+
+// NewMotorClientMux creates a client which registers its endpoints
+// with m
+func NewMotorClientMux(m *datalink.Mux) (*MotorClient, error) {
+	c := &MotorClient{}
+
+	var err error
+	c.epLED, err = m.Register(EndpointLED, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.epFreq, err = m.Register(EndpointFreq, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.epDuty, err = m.Register(EndpointDuty, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.epGains, err = m.Register(EndpointGains, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.epSetpoint, err = m.Register(EndpointSetpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.epIlimit, err = m.Register(EndpointIlimit, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.epTelemetry, err = m.Register(EndpointTelemetry, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// SetLED sends v to EndpointLED
+func (c *MotorClient) SetLED(v LED) error {
+	data, err := codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return c.epLED.Send(data)
+}
+
+// SetFreq sends v to EndpointFreq
+func (c *MotorClient) SetFreq(v Freq) error {
+	data, err := codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return c.epFreq.Send(data)
+}
+
+// SetDuty sends v to EndpointDuty
+func (c *MotorClient) SetDuty(v Duty) error {
+	data, err := codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return c.epDuty.Send(data)
+}
+
+// SetGains sends v to EndpointGains
+func (c *MotorClient) SetGains(v Gains) error {
+	data, err := codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return c.epGains.Send(data)
+}
+
+// SetSetpoint sends v to EndpointSetpoint
+func (c *MotorClient) SetSetpoint(v Setpoint) error {
+	data, err := codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return c.epSetpoint.Send(data)
+}
+
+// SetIlimit sends v to EndpointIlimit
+func (c *MotorClient) SetIlimit(v Ilimit) error {
+	data, err := codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return c.epIlimit.Send(data)
+}
+
+// GetTelemetry reads from EndpointTelemetry
+func (c *MotorClient) GetTelemetry() (TelemetryResponse, error) {
+	var resp TelemetryResponse
+	err := codec.Request(c.epTelemetry, struct{}{}, &resp)
+
+	return resp, err
+}
@@ -0,0 +1,139 @@
+// Copyright 2017 Brian Starkey <stark3y@gmail.com>
+
+package motor
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/usedbytes/bot_matrix/datalink"
+)
+
+type recorder struct {
+	sent []datalink.Packet
+}
+
+func (r *recorder) Transact(tx []datalink.Packet) ([]datalink.Packet, error) {
+	r.sent = append(r.sent, tx...)
+	return nil, nil
+}
+
+func TestWire(t *testing.T) {
+	r := &recorder{}
+	m, err := NewMotorController(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.SetDuty(1, Reverse, 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.SetGains(Gains{ 1.5, -1, 0.25 })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []datalink.Packet{
+		{ Endpoint: EndpointDuty, Data: []byte{ 1, 1, 0x00, 0x80 } },
+		{ Endpoint: EndpointGains, Data: []byte{
+			0x00, 0x80, 0x01, 0x00,
+			0x00, 0x00, 0xff, 0xff,
+			0x00, 0x40, 0x00, 0x00,
+		} },
+	}
+
+	if len(r.sent) != len(expected) {
+		t.Fatalf("Expected %d packets, got %d\n", len(expected), len(r.sent))
+	}
+
+	for i, p := range expected {
+		if r.sent[i].Endpoint != p.Endpoint || !bytes.Equal(r.sent[i].Data, p.Data) {
+			t.Errorf("Packet %d mismatch:\n  Expected: %d %x\n       Got: %d %x\n",
+				i, p.Endpoint, p.Data, r.sent[i].Endpoint, r.sent[i].Data)
+		}
+	}
+}
+
+func TestValidation(t *testing.T) {
+	f := NewFake()
+	m := NewMotorControllerDevice(f)
+
+	for i, err := range []error{
+		m.SetFreq(m.Limits.MinFreq - 1),
+		m.SetFreq(m.Limits.MaxFreq + 1),
+		m.SetDuty(m.Limits.Channels, Forward, 0),
+		m.SetDuty(0, Direction(2), 0),
+		m.SetDuty(0, Forward, 1.01),
+		m.SetDuty(0, Forward, -0.1),
+		m.SetGains(Gains{ Kd: 40000 }),
+	} {
+		if !errors.Is(err, ErrInvalid) {
+			t.Errorf("%d: expected ErrInvalid, got: %v\n", i, err)
+		}
+	}
+
+	if f.Calls != 0 {
+		t.Errorf("Invalid settings were sent: %d calls\n", f.Calls)
+	}
+}
+
+func TestSettings(t *testing.T) {
+	f := NewFake()
+	m := NewMotorControllerDevice(f)
+
+	err := m.SetFreq(20000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.SetDuty(0, Reverse, 0.25)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.Err = fmt.Errorf("Broken")
+	err = m.SetFreq(10000)
+	if err != f.Err {
+		t.Errorf("Expected the device's error, got: %v\n", err)
+	}
+
+	s := m.Settings()
+	if s.Freq != 20000 {
+		t.Errorf("Expected freq 20000, got %d\n", s.Freq)
+	}
+
+	if d := s.Duty[0]; d.Dir != Reverse || d.Duty != float64(16384) / 65535 {
+		t.Errorf("Unexpected duty %+v\n", d)
+	}
+
+	f.Err = nil
+	err = m.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Duty[0].Duty == 0 {
+		t.Errorf("Settings weren't a copy\n")
+	}
+
+	s = m.Settings()
+	for ch := uint8(0); ch < m.Limits.Channels; ch++ {
+		if s.Duty[ch].Duty != 0 || f.Duty[ch].Duty != 0 {
+			t.Errorf("Channel %d not stopped\n", ch)
+		}
+	}
+}
+
+func TestSchema(t *testing.T) {
+	s := Schema()
+	for _, e := range s.Endpoints {
+		if e.Name == "Duty" && e.Endpoint == EndpointDuty {
+			return
+		}
+	}
+	t.Errorf("Duty endpoint not found in schema\n")
+}
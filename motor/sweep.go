@@ -0,0 +1,173 @@
+// Copyright 2017 Brian Starkey <stark3y@gmail.com>
+
+package motor
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Sweep describes a characterisation run. Every combination of Freqs,
+// Dirs and Duties is set on Channel in turn, with duty changing fastest,
+// and the telemetry measured at each.
+type Sweep struct {
+	Channel uint8
+	// Freqs are the PWM frequencies, in Hz. If empty, the frequency isn't
+	// changed.
+	Freqs []uint32
+	Dirs []Direction
+	// Duties are fractions from 0 to 1
+	Duties []float64
+
+	// Settle is the time to wait after each change before measuring
+	Settle time.Duration
+	// Samples is the number of telemetry readings averaged at each step,
+	// Interval apart. Zero is treated as one.
+	Samples int
+	Interval time.Duration
+}
+
+// SweepPoint is the result of one step of a Sweep. Freq is zero if the
+// Sweep didn't set it.
+type SweepPoint struct {
+	Freq uint32
+	Dir Direction
+	Duty float64
+
+	// Speed and Current are the means of the samples, in set point units
+	// and mA
+	Speed float64
+	Current float64
+}
+
+func (m *MotorController) checkSweep(sw *Sweep) error {
+	if sw.Channel >= m.Limits.Channels {
+		return fmt.Errorf("%w: channel %d, there are %d", ErrInvalid, sw.Channel, m.Limits.Channels)
+	}
+	if len(sw.Dirs) == 0 || len(sw.Duties) == 0 {
+		return fmt.Errorf("%w: sweep needs at least one direction and duty", ErrInvalid)
+	}
+	for _, f := range sw.Freqs {
+		if f < m.Limits.MinFreq || f > m.Limits.MaxFreq {
+			return fmt.Errorf("%w: frequency %d Hz, must be %d to %d", ErrInvalid,
+				f, m.Limits.MinFreq, m.Limits.MaxFreq)
+		}
+	}
+	for _, d := range sw.Dirs {
+		if d != Forward && d != Reverse {
+			return fmt.Errorf("%w: direction %d", ErrInvalid, d)
+		}
+	}
+	for _, d := range sw.Duties {
+		if !(d >= 0 && d <= 1) {
+			return fmt.Errorf("%w: duty %v, must be 0 to 1", ErrInvalid, d)
+		}
+	}
+	return nil
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// measure averages sw.Samples telemetry readings
+func (m *MotorController) measure(ctx context.Context, sw *Sweep, p *SweepPoint) error {
+	n := sw.Samples
+	if n < 1 {
+		n = 1
+	}
+
+	var speed, current float64
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			if err := sleep(ctx, sw.Interval); err != nil {
+				return err
+			}
+		}
+
+		t, err := m.Telemetry()
+		if err != nil {
+			return err
+		}
+		speed += float64(t.Speed)
+		current += float64(t.Current)
+	}
+
+	p.Speed, p.Current = speed / float64(n), current / float64(n)
+	return nil
+}
+
+func (m *MotorController) sweep(ctx context.Context, sw *Sweep, fn func(SweepPoint) error) error {
+	freqs := sw.Freqs
+	if len(freqs) == 0 {
+		freqs = []uint32{ 0 }
+	}
+
+	for _, f := range freqs {
+		if f != 0 {
+			if err := m.SetFreq(f); err != nil {
+				return err
+			}
+		}
+
+		for _, dir := range sw.Dirs {
+			for _, duty := range sw.Duties {
+				if err := m.SetDuty(sw.Channel, dir, duty); err != nil {
+					return err
+				}
+
+				if err := sleep(ctx, sw.Settle); err != nil {
+					return err
+				}
+
+				p := SweepPoint{ Freq: f, Dir: dir, Duty: duty }
+				if err := m.measure(ctx, sw, &p); err != nil {
+					return err
+				}
+
+				if err := fn(p); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Sweep runs sw, calling fn with the result of each step. It stops at
+// the first error, from the device or fn, or when ctx is done. However it
+// finishes, the duty cycle of every channel is set to zero before it
+// returns.
+func (m *MotorController) Sweep(ctx context.Context, sw Sweep, fn func(SweepPoint) error) error {
+	if err := m.checkSweep(&sw); err != nil {
+		return err
+	}
+
+	err := m.sweep(ctx, &sw, fn)
+	if err != nil {
+		err = fmt.Errorf("Sweep aborted: %w", err)
+	}
+
+	if serr := m.Stop(); serr != nil {
+		if err == nil {
+			return serr
+		}
+		return fmt.Errorf("%w, and stopping failed: %v", err, serr)
+	}
+
+	return err
+}
@@ -0,0 +1,122 @@
+// Copyright 2017 Brian Starkey <stark3y@gmail.com>
+
+package motor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSweep(t *testing.T) {
+	f := NewFake()
+	// Speed follows the duty, with alternate samples reading one higher
+	n := 0
+	f.Measure = func(f *Fake) {
+		n++
+		d := f.Duty[1]
+		f.Telemetry.Speed = uint32(d.Duty / 65) + uint32(n % 2)
+		f.Telemetry.Current = uint16(d.Dir) * 100
+	}
+	m := NewMotorControllerDevice(f)
+
+	sw := Sweep{
+		Channel: 1,
+		Freqs: []uint32{ 1000, 20000 },
+		Dirs: []Direction{ Forward, Reverse },
+		Duties: []float64{ 0, 1 },
+		Samples: 2,
+	}
+
+	var points []SweepPoint
+	err := m.Sweep(context.Background(), sw, func(p SweepPoint) error {
+		if f.Freq.Freq != p.Freq {
+			return fmt.Errorf("Frequency %d not set", p.Freq)
+		}
+		points = append(points, p)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []SweepPoint{}
+	for _, freq := range sw.Freqs {
+		for _, dir := range sw.Dirs {
+			expected = append(expected,
+				SweepPoint{ freq, dir, 0, 0.5, float64(dir) * 100 },
+				SweepPoint{ freq, dir, 1, 1008.5, float64(dir) * 100 })
+		}
+	}
+
+	if !reflect.DeepEqual(points, expected) {
+		t.Errorf("Expected:\n%v\ngot:\n%v\n", expected, points)
+	}
+
+	if f.Duty[0].Duty != 0 || f.Duty[1].Duty != 0 {
+		t.Errorf("Duty not zeroed: %v\n", f.Duty)
+	}
+}
+
+func TestSweepAbort(t *testing.T) {
+	sw := Sweep{ Dirs: []Direction{ Forward }, Duties: []float64{ 0.5, 1 } }
+
+	f := NewFake()
+	m := NewMotorControllerDevice(f)
+
+	// An error from fn stops the sweep
+	steps := 0
+	errStop := errors.New("Enough")
+	err := m.Sweep(context.Background(), sw, func(p SweepPoint) error {
+		steps++
+		return errStop
+	})
+	if !errors.Is(err, errStop) || steps != 1 {
+		t.Errorf("Expected one step and errStop, got %d and %v\n", steps, err)
+	}
+	if f.Duty[0].Duty != 0 {
+		t.Errorf("Duty not zeroed after error: %v\n", f.Duty[0])
+	}
+
+	// As does cancelling the context
+	ctx, cancel := context.WithCancel(context.Background())
+	sw.Samples, sw.Interval = 2, 1e9
+	f.Measure = func(f *Fake) { cancel() }
+	err = m.Sweep(ctx, sw, func(p SweepPoint) error {
+		t.Errorf("Unexpected step %v\n", p)
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v\n", err)
+	}
+	if f.Duty[0].Duty != 0 {
+		t.Errorf("Duty not zeroed after cancel: %v\n", f.Duty[0])
+	}
+
+	// Nothing is sent for an invalid sweep
+	calls := f.Calls
+	for _, bad := range []Sweep{
+		{ Channel: 2, Dirs: sw.Dirs, Duties: sw.Duties },
+		{ Dirs: sw.Dirs },
+		{ Freqs: []uint32{ 10 }, Dirs: sw.Dirs, Duties: sw.Duties },
+		{ Dirs: sw.Dirs, Duties: []float64{ 1.5 } },
+	} {
+		err = m.Sweep(context.Background(), bad, nil)
+		if !errors.Is(err, ErrInvalid) {
+			t.Errorf("%v: expected ErrInvalid, got %v\n", bad, err)
+		}
+	}
+	if f.Calls != calls {
+		t.Errorf("Invalid sweeps made %d calls\n", f.Calls - calls)
+	}
+
+	// A failing device is reported, along with the failure to stop
+	f.Err = errors.New("Broken")
+	err = m.Sweep(context.Background(), sw, nil)
+	if err == nil || !strings.HasPrefix(err.Error(), "Sweep aborted: Broken, and stopping failed") {
+		t.Errorf("Expected stop failure, got %v\n", err)
+	}
+}
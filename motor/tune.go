@@ -0,0 +1,268 @@
+// Copyright 2017 Brian Starkey <stark3y@gmail.com>
+
+package motor
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+)
+
+// The gains computed here are in the firmware's units: the PID's output is
+// in 1/65535ths of full duty, its error in set point units, and Ki and Kd
+// are per second and in seconds.
+
+// Sample is one reading of the speed during an experiment
+type Sample struct {
+	// T is the time since the start of the experiment
+	T time.Duration
+	Speed float64
+}
+
+// Experiment controls how a tuning experiment is recorded
+type Experiment struct {
+	// Duration is how long to record for, and Interval the time between
+	// readings
+	Duration, Interval time.Duration
+	// Now timestamps the samples. If nil, time.Now is used.
+	Now func() time.Time
+}
+
+// record reads the speed until e.Duration has passed. start is called
+// after the first sample.
+func (m *MotorController) record(ctx context.Context, e Experiment, start func() error) ([]Sample, error) {
+	now := e.Now
+	if now == nil {
+		now = time.Now
+	}
+
+	var samples []Sample
+	t0 := now()
+	for t := time.Duration(0); t <= e.Duration; t = now().Sub(t0) {
+		tel, err := m.Telemetry()
+		if err != nil {
+			return samples, err
+		}
+		samples = append(samples, Sample{ t, float64(tel.Speed) })
+
+		if len(samples) == 1 {
+			if err = start(); err != nil {
+				return samples, err
+			}
+		}
+
+		if err = sleep(ctx, e.Interval); err != nil {
+			return samples, err
+		}
+	}
+
+	return samples, nil
+}
+
+// StepTest drives channel open loop at duty, and records the speed. The
+// motor should be at rest when it's called. It's stopped at the end, or
+// on error, and the samples recorded so far are returned.
+func (m *MotorController) StepTest(ctx context.Context, e Experiment, channel uint8, duty float64) ([]Sample, error) {
+	samples, err := m.record(ctx, e, func() error {
+		return m.SetDuty(channel, Forward, duty)
+	})
+
+	if serr := m.Stop(); err == nil {
+		err = serr
+	}
+	return samples, err
+}
+
+// RelayTest sets the largest allowed proportional gain, so that the PID
+// acts as a relay switching between full forward and full reverse, and
+// records the speed oscillating around setpoint. Afterwards the gains are
+// restored and the motor stopped. The firmware can't report its gains, so
+// they must have been set with SetGains first.
+func (m *MotorController) RelayTest(ctx context.Context, e Experiment, setpoint uint32) ([]Sample, error) {
+	s := m.Settings()
+	if !s.GainsSet {
+		return nil, fmt.Errorf("The current gains aren't known, so couldn't be restored. Set them first")
+	}
+	gains := s.Gains
+
+	err := m.SetGains(Gains{ Kc: m.Limits.MaxGain })
+	if err != nil {
+		return nil, err
+	}
+
+	samples, err := m.record(ctx, e, func() error {
+		return m.SetSetpoint(setpoint)
+	})
+
+	for _, restore := range []func() error{
+		func() error { return m.SetSetpoint(0) },
+		func() error { return m.SetGains(gains) },
+		m.Stop,
+	} {
+		if rerr := restore(); err == nil {
+			err = rerr
+		}
+	}
+
+	return samples, err
+}
+
+// crossing returns the time at which the speed next rises through level,
+// after samples[from], interpolating between samples, and the index of the
+// sample after it
+func crossing(samples []Sample, from int, level float64) (time.Duration, int, bool) {
+	for i := from + 1; i < len(samples); i++ {
+		a, b := samples[i - 1], samples[i]
+		if a.Speed < level && b.Speed >= level {
+			frac := (level - a.Speed) / (b.Speed - a.Speed)
+			return a.T + time.Duration(frac * float64(b.T - a.T)), i, true
+		}
+	}
+	return 0, len(samples), false
+}
+
+// FOPDT is a first order plus dead time model of the motor: after a step
+// of u in the output, the speed starts to change Theta later, and
+// approaches K * u with time constant Tau.
+type FOPDT struct {
+	K float64
+	Tau, Theta time.Duration
+}
+
+// FitStep fits a FOPDT model to the result of a StepTest at duty, using
+// the times the speed takes to make 28.3% and 63.2% of its final change.
+// The step is at the first sample, and the final speed is the mean of the
+// last fifth of the samples.
+func FitStep(samples []Sample, duty float64) (FOPDT, error) {
+	if len(samples) < 10 {
+		return FOPDT{}, fmt.Errorf("Too few samples (%d) to fit a model", len(samples))
+	}
+	if duty <= 0 {
+		return FOPDT{}, fmt.Errorf("%w: duty %v, must be more than 0", ErrInvalid, duty)
+	}
+
+	y0 := samples[0].Speed
+	tail := samples[len(samples) * 4 / 5:]
+	final := 0.0
+	for _, s := range tail {
+		final += s.Speed
+	}
+	final /= float64(len(tail))
+
+	delta := final - y0
+	if delta <= 0 {
+		return FOPDT{}, fmt.Errorf("The speed didn't increase")
+	}
+
+	t28, i, ok := crossing(samples, 0, y0 + 0.283 * delta)
+	if !ok {
+		return FOPDT{}, fmt.Errorf("The speed didn't reach 28%% of its final change")
+	}
+	t63, _, ok := crossing(samples, i - 1, y0 + 0.632 * delta)
+	if !ok {
+		return FOPDT{}, fmt.Errorf("The speed didn't reach 63%% of its final change")
+	}
+
+	tau := 3 * (t63 - t28) / 2
+	theta := t63 - samples[0].T - tau
+	if theta <= 0 {
+		return FOPDT{}, fmt.Errorf("No dead time measured (tau %v), try a shorter interval", tau)
+	}
+
+	return FOPDT{
+		K: delta / (duty * math.MaxUint16),
+		Tau: tau,
+		Theta: theta,
+	}, nil
+}
+
+// Rule is a tuning rule for a FOPDT model
+type Rule int
+
+const (
+	// ZieglerNichols is the Ziegler-Nichols process reaction curve method
+	ZieglerNichols Rule = iota
+	// CohenCoon suits processes with relatively long dead times
+	CohenCoon
+)
+
+func (r Rule) String() string {
+	switch r {
+	case ZieglerNichols:
+		return "Ziegler-Nichols"
+	case CohenCoon:
+		return "Cohen-Coon"
+	}
+	return fmt.Sprintf("Rule(%d)", int(r))
+}
+
+// pid converts a gain, and integral and derivative times, to Gains
+func pid(kc float64, ti, td float64) Gains {
+	return Gains{ Kc: kc, Kd: kc * td, Ki: kc / ti }
+}
+
+// Gains computes PID gains for the model, with rule
+func (p FOPDT) Gains(rule Rule) (Gains, error) {
+	if p.K <= 0 || p.Tau <= 0 || p.Theta <= 0 {
+		return Gains{}, fmt.Errorf("%w: model %+v", ErrInvalid, p)
+	}
+
+	tau, theta := p.Tau.Seconds(), p.Theta.Seconds()
+	r := theta / tau
+
+	switch rule {
+	case ZieglerNichols:
+		return pid(1.2 / (p.K * r), 2 * theta, theta / 2), nil
+	case CohenCoon:
+		return pid((4.0 / 3 + r / 4) / (p.K * r),
+			theta * (32 + 6 * r) / (13 + 8 * r),
+			theta * 4 / (11 + 2 * r)), nil
+	}
+
+	return Gains{}, fmt.Errorf("%w: rule %v", ErrInvalid, rule)
+}
+
+// Ultimate finds the ultimate gain and period from the result of a
+// RelayTest at setpoint, using the oscillations in the second half of the
+// experiment
+func Ultimate(samples []Sample, setpoint uint32) (float64, time.Duration, error) {
+	sp := float64(setpoint)
+
+	var first, last time.Duration
+	start, end := 0, 0
+	crossings := 0
+	for i := len(samples) / 2; ; crossings++ {
+		t, next, ok := crossing(samples, i, sp)
+		if !ok {
+			break
+		}
+
+		if crossings == 0 {
+			first, start = t, next
+		}
+		last, end = t, next
+		i = next
+	}
+
+	if crossings < 3 {
+		return 0, 0, fmt.Errorf("Too few oscillations around %d, try a longer duration", setpoint)
+	}
+
+	min, max := sp, sp
+	for _, s := range samples[start:end] {
+		min, max = math.Min(min, s.Speed), math.Max(max, s.Speed)
+	}
+	a := (max - min) / 2
+
+	// The relay switches between full forward and full reverse
+	d := float64(math.MaxUint16)
+
+	return 4 * d / (math.Pi * a), (last - first) / time.Duration(crossings - 1), nil
+}
+
+// UltimateGains computes PID gains from the ultimate gain and period, with
+// the Ziegler-Nichols rule
+func UltimateGains(ku float64, pu time.Duration) Gains {
+	return pid(0.6 * ku, pu.Seconds() / 2, pu.Seconds() / 8)
+}
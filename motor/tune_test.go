@@ -0,0 +1,177 @@
+// Copyright 2017 Brian Starkey <stark3y@gmail.com>
+
+package motor
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func near(a, b, tolerance float64) bool {
+	return math.Abs(a - b) <= tolerance * math.Abs(b)
+}
+
+func TestFitStep(t *testing.T) {
+	// 100 ms of dead time, then a 400 ms time constant, to 1500 at half duty
+	var samples []Sample
+	for ms := 0; ms <= 3000; ms += 5 {
+		speed := 0.0
+		if ms > 100 {
+			speed = 1500 * (1 - math.Exp(-float64(ms - 100) / 400))
+		}
+		samples = append(samples, Sample{ time.Duration(ms) * time.Millisecond, speed })
+	}
+
+	p, err := FitStep(samples, 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !near(p.K, 1500 / (0.5 * math.MaxUint16), 0.01) ||
+		!near(p.Tau.Seconds(), 0.4, 0.02) || !near(p.Theta.Seconds(), 0.1, 0.05) {
+		t.Errorf("Unexpected model %+v\n", p)
+	}
+
+	// A process with no dead time can't be tuned with these rules
+	_, err = FitStep(samples[20:], 0.5)
+	if err == nil {
+		t.Errorf("Expected an error with no dead time\n")
+	}
+
+	_, err = FitStep(samples[:5], 0.5)
+	if err == nil {
+		t.Errorf("Expected an error with too few samples\n")
+	}
+}
+
+func TestGains(t *testing.T) {
+	p := FOPDT{ K: 0.02, Tau: 400 * time.Millisecond, Theta: 100 * time.Millisecond }
+
+	for _, tc := range []struct{
+		rule Rule
+		expected Gains
+	}{
+		// Kc = 1.2 tau / (K theta), Ti = 2 theta, Td = theta / 2
+		{ ZieglerNichols, Gains{ Kc: 240, Kd: 12, Ki: 1200 } },
+		// Kc = (4/3 + theta / 4 tau) tau / (K theta),
+		// Ti = theta (32 + 6 theta / tau) / (13 + 8 theta / tau),
+		// Td = 4 theta / (11 + 2 theta / tau)
+		{ CohenCoon, Gains{ Kc: 279.1667, Kd: 9.7101, Ki: 1250 } },
+	} {
+		g, err := p.Gains(tc.rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !near(g.Kc, tc.expected.Kc, 1e-4) || !near(g.Kd, tc.expected.Kd, 1e-4) ||
+			!near(g.Ki, tc.expected.Ki, 1e-4) {
+			t.Errorf("%v: expected %+v, got %+v\n", tc.rule, tc.expected, g)
+		}
+	}
+
+	_, err := FOPDT{ K: 0.02, Tau: time.Second }.Gains(ZieglerNichols)
+	if !errors.Is(err, ErrInvalid) {
+		t.Errorf("Expected ErrInvalid with no dead time, got %v\n", err)
+	}
+
+	g := UltimateGains(1000, 200 * time.Millisecond)
+	if !near(g.Kc, 600, 1e-9) || !near(g.Ki, 6000, 1e-9) || !near(g.Kd, 15, 1e-9) {
+		t.Errorf("Unexpected ultimate gains %+v\n", g)
+	}
+}
+
+func TestUltimate(t *testing.T) {
+	// A settling transient, then oscillation of 50 around 500, every 80 ms
+	var samples []Sample
+	for ms := 0; ms <= 2000; ms++ {
+		speed := 500 + 50 * math.Sin(2 * math.Pi * float64(ms) / 80)
+		if ms < 500 {
+			speed = float64(ms)
+		}
+		samples = append(samples, Sample{ time.Duration(ms) * time.Millisecond, speed })
+	}
+
+	ku, pu, err := Ultimate(samples, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !near(ku, 4 * math.MaxUint16 / (math.Pi * 50), 0.01) || !near(pu.Seconds(), 0.08, 0.01) {
+		t.Errorf("Unexpected ku %v, pu %v\n", ku, pu)
+	}
+
+	_, _, err = Ultimate(samples, 600)
+	if err == nil {
+		t.Errorf("Expected an error with no oscillation\n")
+	}
+}
+
+func TestExperiments(t *testing.T) {
+	now := time.Unix(0, 0)
+	e := Experiment{
+		Duration: 100 * time.Millisecond,
+		Now: func() time.Time {
+			now = now.Add(10 * time.Millisecond)
+			return now
+		},
+	}
+
+	f := NewFake()
+	f.Measure = func(f *Fake) {
+		f.Telemetry.Speed = uint32(f.Duty[1].Duty / 100)
+	}
+	m := NewMotorControllerDevice(f)
+
+	samples, err := m.StepTest(context.Background(), e, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first sample is taken before the step
+	if len(samples) != 11 || samples[0].Speed != 0 || samples[1].Speed != 655 ||
+		samples[10].T != e.Duration {
+		t.Errorf("Unexpected samples %v\n", samples)
+	}
+	if f.Duty[1].Duty != 0 {
+		t.Errorf("Expected duty to be zeroed, got %v\n", f.Duty[1])
+	}
+
+	// The gains can't be restored until they're known
+	_, err = m.RelayTest(context.Background(), e, 500)
+	if err == nil || !strings.HasPrefix(err.Error(), "The current gains aren't known") {
+		t.Errorf("Expected 'The current gains aren't known', got: %v\n", err)
+	}
+	if f.Gains != (Gains{}) {
+		t.Errorf("Expected gains to be left alone, got %v\n", f.Gains)
+	}
+
+	gains := Gains{ Kc: 1, Kd: 2, Ki: 3 }
+	m.SetGains(gains)
+
+	var set []Gains
+	f.Measure = func(f *Fake) {
+		set = append(set, f.Gains)
+	}
+	samples, err = m.RelayTest(context.Background(), e, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(samples) != 11 || set[0] != (Gains{ Kc: m.Limits.MaxGain }) || f.Setpoint.Setpoint != 0 {
+		t.Errorf("Unexpected relay test: samples %v, gains %v, set point %v\n",
+			samples, set[0], f.Setpoint)
+	}
+	if f.Gains != gains || m.Settings().Gains != gains {
+		t.Errorf("Expected gains to be restored, got %v\n", f.Gains)
+	}
+
+	f.Err = errors.New("Broken")
+	_, err = m.RelayTest(context.Background(), e, 500)
+	if err != f.Err {
+		t.Errorf("Expected device error, got %v\n", err)
+	}
+}
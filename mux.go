@@ -0,0 +1,171 @@
+// Copyright 2017 Brian Starkey <stark3y@gmail.com>
+package datalink
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Handler is called with packets which nobody is waiting for
+type Handler func(Packet)
+
+// Mux shares a Transactor between subsystems, each of which registers a
+// Client for its endpoint. Received packets are routed to the Client for
+// their endpoint: to a pending Request if there is one, or else to the
+// Client's Handler. Packets for endpoints without a Client, or whose
+// Client has no Handler, go to the fallback Handler.
+//
+// Mux is safe for concurrent use. Transactions are serialised.
+type Mux struct {
+	t Transactor
+	fallback Handler
+
+	// Polls is the number of extra, empty, transactions a Request will
+	// make while waiting for its response
+	Polls int
+
+	mu sync.Mutex
+	clients map[uint8]*Client
+}
+
+// NewMux creates a Mux over t. fallback may be nil, in which case
+// unclaimed packets are dropped.
+func NewMux(t Transactor, fallback Handler) *Mux {
+	return &Mux{
+		t: t,
+		fallback: fallback,
+		Polls: 8,
+		clients: make(map[uint8]*Client),
+	}
+}
+
+type Client struct {
+	mux *Mux
+	ep uint8
+	handler Handler
+
+	// Only one Request at a time
+	req sync.Mutex
+	// Set while a Request is waiting. Protected by mux.mu
+	waiting chan Packet
+}
+
+// Register creates a Client for ep. Packets received on ep when no
+// Request is waiting are passed to h, if it isn't nil.
+func (m *Mux) Register(ep uint8, h Handler) (*Client, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.clients[ep]; ok {
+		return nil, fmt.Errorf("Endpoint %d already registered", ep)
+	}
+
+	c := &Client{ mux: m, ep: ep, handler: h }
+	m.clients[ep] = c
+
+	return c, nil
+}
+
+// Client returns the Client registered for ep, or nil if there isn't one
+func (m *Mux) Client(ep uint8) *Client {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.clients[ep]
+}
+
+// Unregister releases c's endpoint
+func (m *Mux) Unregister(c *Client) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.clients[c.ep] == c {
+		delete(m.clients, c.ep)
+	}
+}
+
+// transact sends pkts, and routes all the received packets
+func (m *Mux) transact(pkts []Packet) error {
+	m.mu.Lock()
+	rx, err := m.t.Transact(pkts)
+
+	type call struct {
+		h Handler
+		p Packet
+	}
+	calls := make([]call, 0, len(rx))
+
+	for _, p := range rx {
+		c := m.clients[p.Endpoint]
+		switch {
+		case c != nil && c.waiting != nil:
+			c.waiting <- p
+			c.waiting = nil
+		case c != nil && c.handler != nil:
+			calls = append(calls, call{ c.handler, p })
+		case m.fallback != nil:
+			calls = append(calls, call{ m.fallback, p })
+		}
+	}
+	m.mu.Unlock()
+
+	// Handlers may themselves use the Mux
+	for _, c := range calls {
+		c.h(c.p)
+	}
+
+	return err
+}
+
+// Poll makes an empty transaction, to collect any unsolicited packets
+func (m *Mux) Poll() error {
+	return m.transact(nil)
+}
+
+func (c *Client) Endpoint() uint8 {
+	return c.ep
+}
+
+// Send sends data on c's endpoint, without waiting for a response
+func (c *Client) Send(data []byte) error {
+	return c.mux.transact([]Packet{ { Endpoint: c.ep, Data: data } })
+}
+
+// Request sends data on c's endpoint, and returns the next packet
+// received on it, polling for up to mux.Polls more transactions.
+func (c *Client) Request(data []byte) ([]byte, error) {
+	c.req.Lock()
+	defer c.req.Unlock()
+
+	m := c.mux
+	ch := make(chan Packet, 1)
+
+	m.mu.Lock()
+	c.waiting = ch
+	m.mu.Unlock()
+
+	defer func() {
+		m.mu.Lock()
+		c.waiting = nil
+		m.mu.Unlock()
+	}()
+
+	err := m.transact([]Packet{ { Endpoint: c.ep, Data: data } })
+	for i := 0; ; i++ {
+		select {
+		case p := <-ch:
+			return p.Data, nil
+		default:
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if i >= m.Polls {
+			return nil, fmt.Errorf("No response on endpoint %d", c.ep)
+		}
+
+		err = m.transact(nil)
+	}
+}
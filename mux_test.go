@@ -0,0 +1,156 @@
+// Copyright 2017 Brian Starkey <stark3y@gmail.com>
+package datalink
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// delayedPeer answers each packet in the following transaction, with the
+// data inverted. Anything in extra is sent along with the next response.
+type delayedPeer struct {
+	mu sync.Mutex
+	pending []Packet
+	extra []Packet
+	silent map[uint8]bool
+}
+
+func (d *delayedPeer) Transact(tx []Packet) ([]Packet, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	rx := append(d.pending, d.extra...)
+	d.pending, d.extra = nil, nil
+
+	for _, p := range tx {
+		if d.silent[p.Endpoint] {
+			continue
+		}
+
+		data := make([]byte, len(p.Data))
+		for i := range p.Data {
+			data[i] = ^p.Data[i]
+		}
+		d.pending = append(d.pending, Packet{ Endpoint: p.Endpoint, Data: data })
+	}
+
+	return rx, nil
+}
+
+func TestMuxRequest(t *testing.T) {
+	peer := &delayedPeer{}
+	m := NewMux(peer, nil)
+
+	c, err := m.Register(3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rx, err := c.Request([]byte{ 0x0f })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(rx, []byte{ 0xf0 }) {
+		t.Errorf("Data mismatch:\n  Expected: %x\n       Got: %x\n", []byte{ 0xf0 }, rx)
+	}
+
+	_, err = m.Register(3, nil)
+	if err == nil || !strings.HasPrefix(err.Error(), "Endpoint 3 already registered") {
+		t.Errorf("Expected already registered error, got: %v\n", err)
+	}
+
+	if m.Client(3) != c || m.Client(4) != nil {
+		t.Errorf("Client lookup mismatch\n")
+	}
+
+	m.Unregister(c)
+	if m.Client(3) != nil {
+		t.Errorf("Client still registered\n")
+	}
+}
+
+func TestMuxNoResponse(t *testing.T) {
+	peer := &delayedPeer{ silent: map[uint8]bool{ 4: true } }
+	m := NewMux(peer, nil)
+	m.Polls = 2
+
+	c, _ := m.Register(4, nil)
+	_, err := c.Request([]byte{ 0 })
+	if err == nil || !strings.HasPrefix(err.Error(), "No response") {
+		t.Errorf("Expected no response error, got: %v\n", err)
+	}
+}
+
+func TestMuxRouting(t *testing.T) {
+	peer := &delayedPeer{}
+
+	var fallback, handled []Packet
+	m := NewMux(peer, func(p Packet) {
+		fallback = append(fallback, p)
+	})
+
+	c, _ := m.Register(1, func(p Packet) {
+		handled = append(handled, p)
+	})
+	m.Register(2, nil)
+
+	peer.extra = []Packet{
+		{ Endpoint: 1, Data: []byte{ 1 } },
+		{ Endpoint: 2, Data: []byte{ 2 } },
+		{ Endpoint: 9, Data: []byte{ 9 } },
+	}
+	m.Poll()
+
+	if len(handled) != 1 || handled[0].Endpoint != 1 {
+		t.Errorf("Expected endpoint 1 to be handled, got: %v\n", handled)
+	}
+
+	// Endpoint 2 has no handler, and 9 has no client
+	if len(fallback) != 2 || fallback[0].Endpoint != 2 || fallback[1].Endpoint != 9 {
+		t.Errorf("Expected endpoints 2 and 9 in fallback, got: %v\n", fallback)
+	}
+
+	// Responses go to the Request, not the handler
+	handled = nil
+	_, err := c.Request([]byte{ 1 })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(handled) != 0 {
+		t.Errorf("Response went to handler\n")
+	}
+}
+
+func TestMuxConcurrent(t *testing.T) {
+	peer := &delayedPeer{}
+	m := NewMux(peer, nil)
+
+	var wg sync.WaitGroup
+	for ep := uint8(1); ep <= 8; ep++ {
+		c, _ := m.Register(ep, nil)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < 50; i++ {
+				rx, err := c.Request([]byte{ c.Endpoint(), byte(i) })
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				if rx[0] != ^c.Endpoint() || rx[1] != ^byte(i) {
+					t.Errorf("Endpoint %d got the wrong response: %x\n", c.Endpoint(), rx)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+}
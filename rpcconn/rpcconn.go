@@ -2,13 +2,47 @@
 package rpcconn
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net"
 	"net/rpc"
+	"sync/atomic"
+
 	"github.com/usedbytes/bot_matrix/datalink"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// DefaultPort is the TCP port spibridge listens on
+const DefaultPort = 9000
+
+const (
+	TransactMethod = "RPCEndpoint.RPCTransact"
+	TransactContextMethod = "RPCEndpoint.RPCTransactContext"
+	StatsMethod = "RPCEndpoint.RPCStats"
+)
+
+// Methods lists the RPC methods served by RPCServ
+var Methods = []string{
+	TransactMethod,
+	TransactContextMethod,
+	StatsMethod,
+}
+
+// TransactArgs are the arguments to RPCTransactContext
+type TransactArgs struct {
+	Packets []datalink.Packet
+	// Carrier holds the client's trace context, from the global
+	// TextMapPropagator
+	Carrier map[string]string
+}
+
 type RPCEndpoint struct {
 	transactor datalink.Transactor
+	observers []datalink.Observer
+	stats datalink.StatsSource
 }
 
 type RPCServ struct {
@@ -17,20 +51,79 @@ type RPCServ struct {
 	srv *rpc.Server
 }
 
-func (r *RPCEndpoint) RPCTransact(tx []datalink.Packet, rx *[]datalink.Packet) error {
-	pkts, err := r.transactor.Transact(tx)
+func (r *RPCEndpoint) transact(ctx context.Context, tx []datalink.Packet, rx *[]datalink.Packet) error {
+	for _, o := range r.observers {
+		o.OnDeSerialise(nil, tx)
+	}
+
+	pkts, err := datalink.TransactContext(ctx, r.transactor, tx)
+	if err != nil {
+		for _, o := range r.observers {
+			o.OnError(err)
+		}
+	} else {
+		for _, o := range r.observers {
+			o.OnSerialise(pkts, nil)
+		}
+	}
 
 	*rx = pkts
 
 	return err
 }
 
+func (r *RPCEndpoint) RPCTransact(tx []datalink.Packet, rx *[]datalink.Packet) error {
+	return r.transact(context.Background(), tx, rx)
+}
+
+// RPCTransactContext is RPCTransact, continuing the client's trace
+func (r *RPCEndpoint) RPCTransactContext(args TransactArgs, rx *[]datalink.Packet) (err error) {
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(),
+		propagation.MapCarrier(args.Carrier))
+
+	ctx, span := otel.Tracer(datalink.TracerName).Start(ctx, "rpcconn.RPCTransact",
+		trace.WithSpanKind(trace.SpanKindServer))
+	defer func() {
+		span.SetAttributes(datalink.PacketAttributes("rx", *rx)...)
+		datalink.EndSpan(span, err)
+	}()
+	span.SetAttributes(datalink.PacketAttributes("tx", args.Packets)...)
+
+	return r.transact(ctx, args.Packets, rx)
+}
+
+// AddObserver attaches o to r. The packets received from clients are
+// passed to OnDeSerialise, and the responses to OnSerialise, with nil
+// data. It must not be called once r is serving.
+func (r *RPCServ) AddObserver(o datalink.Observer) {
+	r.endpoint.observers = append(r.endpoint.observers, o)
+}
+
+func (r *RPCEndpoint) RPCStats(args struct{}, stats *datalink.Stats) error {
+	if r.stats == nil {
+		return fmt.Errorf("Stats not available")
+	}
+
+	*stats = r.stats.Stats()
+
+	return nil
+}
+
+// SetStats sets where RPCStats gets its Stats from. By default, that's
+// the Transactor passed to NewRPCServ, if it's a StatsSource.
+func (r *RPCServ) SetStats(s datalink.StatsSource) {
+	r.endpoint.stats = s
+}
+
 func (r *RPCServ) Serve(l net.Listener) {
 	r.srv.Accept(l)
 }
 
 func NewRPCServ(conn datalink.Transactor) (*RPCServ, error) {
-	srv := &RPCServ{ endpoint: RPCEndpoint{ conn } }
+	srv := &RPCServ{ endpoint: RPCEndpoint{ transactor: conn } }
+	if s, ok := conn.(datalink.StatsSource); ok {
+		srv.endpoint.stats = s
+	}
 
 	srv.srv = rpc.NewServer()
 	srv.srv.Register(&srv.endpoint)
@@ -40,20 +133,62 @@ func NewRPCServ(conn datalink.Transactor) (*RPCServ, error) {
 
 type RPCClient struct {
 	client *rpc.Client
+	// Set if the server predates RPCTransactContext
+	noContext atomic.Bool
 }
 
-func NewRPCClient(server string) (datalink.Transactor, error) {
+func NewRPCClient(server string) (*RPCClient, error) {
 	client, err := rpc.Dial("tcp", server)
 	if err != nil {
 		return nil, err
 	}
 
-	return &RPCClient{ client }, nil
+	return &RPCClient{ client: client }, nil
+}
+
+// noMethod returns true if err is net/rpc's error for a method the server
+// doesn't have
+func noMethod(err error, method string) bool {
+	var se rpc.ServerError
+	return errors.As(err, &se) && string(se) == "rpc: can't find method " + method
 }
 
 func (c *RPCClient) Transact(tx []datalink.Packet) ([]datalink.Packet, error) {
-	rx := make([]datalink.Packet, 0, len(tx))
-	err := c.client.Call("RPCEndpoint.RPCTransact", tx, &rx)
+	return c.TransactContext(context.Background(), tx)
+}
+
+// TransactContext is Transact, recording a span as a child of any in ctx,
+// and propagating it to the server
+func (c *RPCClient) TransactContext(ctx context.Context, tx []datalink.Packet) (rx []datalink.Packet, err error) {
+	ctx, span := otel.Tracer(datalink.TracerName).Start(ctx, "rpcconn.Transact",
+		trace.WithSpanKind(trace.SpanKindClient))
+	defer func() {
+		span.SetAttributes(datalink.PacketAttributes("rx", rx)...)
+		datalink.EndSpan(span, err)
+	}()
+	span.SetAttributes(datalink.PacketAttributes("tx", tx)...)
+
+	args := TransactArgs{ Packets: tx, Carrier: map[string]string{} }
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(args.Carrier))
+
+	rx = make([]datalink.Packet, 0, len(tx))
+	if !c.noContext.Load() {
+		err = c.client.Call(TransactContextMethod, args, &rx)
+		if !noMethod(err, TransactContextMethod) {
+			return rx, err
+		}
+		c.noContext.Store(true)
+	}
+
+	err = c.client.Call(TransactMethod, tx, &rx)
 
 	return rx, err
 }
+
+// Stats fetches the server's link statistics
+func (c *RPCClient) Stats() (datalink.Stats, error) {
+	var stats datalink.Stats
+	err := c.client.Call(StatsMethod, struct{}{}, &stats)
+
+	return stats, err
+}
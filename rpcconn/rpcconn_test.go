@@ -0,0 +1,207 @@
+// Copyright 2017 Brian Starkey <stark3y@gmail.com>
+
+package rpcconn
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/rpc"
+	"sync"
+	"testing"
+
+	"github.com/usedbytes/bot_matrix/datalink"
+	"github.com/usedbytes/bot_matrix/datalink/capture"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+type loopback struct { }
+
+func (l loopback) Serialise(pkts []datalink.Packet) []byte {
+	buf := []byte{}
+	for _, p := range pkts {
+		buf = append(buf, p.Endpoint, byte(len(p.Data)))
+		buf = append(buf, p.Data...)
+	}
+	return buf
+}
+
+func (l loopback) DeSerialise(data []byte) ([]datalink.Packet, error) {
+	pkts := []datalink.Packet{}
+	for len(data) >= 2 {
+		n := int(data[1])
+		pkts = append(pkts, datalink.Packet{ Endpoint: data[0], Data: data[2:2 + n] })
+		data = data[2 + n:]
+	}
+	return pkts, nil
+}
+
+func (l loopback) Transfer(tx []byte) ([]byte, error) {
+	return tx, nil
+}
+
+func newPair(t *testing.T) *RPCClient {
+	return newWrappedPair(t, func(c datalink.Transactor) datalink.Transactor {
+		return c
+	})
+}
+
+// newWrappedPair serves the Connection through wrap, like spibridge's
+// -capture and -batch
+func newWrappedPair(t *testing.T, wrap func(c datalink.Transactor) datalink.Transactor) *RPCClient {
+	conn := datalink.NewConnection(loopback{}, loopback{})
+	srv, err := NewRPCServ(wrap(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, b := net.Pipe()
+	go srv.srv.ServeConn(a)
+
+	return &RPCClient{ client: rpc.NewClient(b) }
+}
+
+func TestTransact(t *testing.T) {
+	c := newPair(t)
+	defer c.client.Close()
+
+	tx := []datalink.Packet{ { Endpoint: 3, Data: []byte{ 1, 2, 3 } } }
+	rx, err := c.Transact(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rx) != 1 || rx[0].Endpoint != 3 || !bytes.Equal(rx[0].Data, tx[0].Data) {
+		t.Errorf("Packet mismatch:\n  Expected: %v\n       Got: %v\n", tx, rx)
+	}
+}
+
+// legacyEndpoint is an RPCEndpoint from before RPCTransactContext
+type legacyEndpoint struct {
+	transactor datalink.Transactor
+}
+
+func (r *legacyEndpoint) RPCTransact(tx []datalink.Packet, rx *[]datalink.Packet) error {
+	var err error
+	*rx, err = r.transactor.Transact(tx)
+	return err
+}
+
+func TestLegacyServer(t *testing.T) {
+	srv := rpc.NewServer()
+	srv.RegisterName("RPCEndpoint", &legacyEndpoint{ datalink.NewConnection(loopback{}, loopback{}) })
+
+	a, b := net.Pipe()
+	go srv.ServeConn(a)
+
+	c := &RPCClient{ client: rpc.NewClient(b) }
+	defer c.client.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(ep uint8) {
+			defer wg.Done()
+
+			tx := []datalink.Packet{ { Endpoint: ep, Data: []byte{ ep } } }
+			rx, err := c.Transact(tx)
+			if err != nil {
+				t.Error(err)
+			} else if len(rx) != 1 || rx[0].Endpoint != ep {
+				t.Errorf("Packet mismatch:\n  Expected: %v\n       Got: %v\n", tx, rx)
+			}
+		}(uint8(i))
+	}
+	wg.Wait()
+
+	if !c.noContext.Load() {
+		t.Errorf("Expected fallback to %s\n", TransactMethod)
+	}
+}
+
+func TestStats(t *testing.T) {
+	c := newPair(t)
+	defer c.client.Close()
+
+	for i := 0; i < 3; i++ {
+		_, err := c.Transact([]datalink.Packet{ { Endpoint: 1, Data: []byte{ 0xaa } } })
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, err := c.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Transfers != 3 || stats.TxBytes != 3 || stats.RxBytes != 3 {
+		t.Errorf("Unexpected stats: %+v\n", stats)
+	}
+
+	if stats.Latency.Samples != 3 {
+		t.Errorf("Expected 3 latency samples, got %d\n", stats.Latency.Samples)
+	}
+}
+
+func TestTracePropagation(t *testing.T) {
+	testTracePropagation(t, newPair(t))
+}
+
+func TestTracePropagationWrapped(t *testing.T) {
+	w, err := capture.NewWriter(io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testTracePropagation(t, newWrappedPair(t, func(c datalink.Transactor) datalink.Transactor {
+		b, err := datalink.NewBatcher(capture.NewTransactor(c, w), datalink.DefaultBatchConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}))
+}
+
+func testTracePropagation(t *testing.T, c *RPCClient) {
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer func() {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	}()
+
+	defer c.client.Close()
+
+	_, err := c.Transact([]datalink.Packet{ { Endpoint: 1, Data: []byte{ 0xaa } } })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Children end first
+	expected := []string{ "datalink.Transfer", "datalink.Transact", "rpcconn.RPCTransact", "rpcconn.Transact" }
+	spans := rec.Ended()
+	if len(spans) != len(expected) {
+		t.Fatalf("Expected %d spans, got %d\n", len(expected), len(spans))
+	}
+
+	for i, s := range spans {
+		if s.Name() != expected[i] {
+			t.Errorf("Span %d: expected %s, got %s\n", i, expected[i], s.Name())
+		}
+
+		if s.SpanContext().TraceID() != spans[0].SpanContext().TraceID() {
+			t.Errorf("Span %s is in a different trace\n", s.Name())
+		}
+
+		if i > 0 && spans[i - 1].Parent().SpanID() != s.SpanContext().SpanID() {
+			t.Errorf("Span %s isn't the parent of %s\n", s.Name(), spans[i - 1].Name())
+		}
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2017 Brian Starkey <stark3y@gmail.com>
+
+// Package sched schedules transactions on a shared Transactor.
+package sched
+
+import (
+	"sync"
+	"time"
+
+	"github.com/usedbytes/bot_matrix/datalink"
+)
+
+type Priority int
+
+const (
+	PriorityLow Priority = iota
+	PriorityNormal
+	PriorityHigh
+	// PriorityUrgent is for things like emergency stops
+	PriorityUrgent
+)
+
+type ArbiterConfig struct {
+	// Endpoints sets the priority of packets on each endpoint, for
+	// Transact. Endpoints not listed are PriorityNormal.
+	Endpoints map[uint8]Priority
+	// ChunkPackets splits requests into transactions of at most this
+	// many packets. Between chunks, a request can be preempted by one of
+	// higher priority. 0 means requests are never split.
+	ChunkPackets int
+	// AgeStep raises the priority of a waiting request by one level for
+	// each AgeStep it has waited, so low priority requests can't be
+	// starved forever. Ageing stops at PriorityHigh, so PriorityUrgent
+	// requests always go first. 0 disables ageing.
+	AgeStep time.Duration
+}
+
+var DefaultArbiterConfig = ArbiterConfig{
+	ChunkPackets: 4,
+	AgeStep: 50 * time.Millisecond,
+}
+
+type request struct {
+	prio Priority
+	queued time.Time
+	// Sequence number, to keep FIFO order within a priority
+	seq uint64
+
+	pkts []datalink.Packet
+	rx []datalink.Packet
+	err error
+}
+
+// Arbiter is a Transactor which shares another Transactor between
+// concurrent callers, by priority. Only one transaction is in progress at
+// a time, and when it completes, the waiting request with the highest
+// priority goes next.
+type Arbiter struct {
+	t datalink.Transactor
+	cfg ArbiterConfig
+
+	mu sync.Mutex
+	cond *sync.Cond
+	busy bool
+	seq uint64
+	waiting []*request
+}
+
+func NewArbiter(t datalink.Transactor, cfg ArbiterConfig) *Arbiter {
+	a := &Arbiter{ t: t, cfg: cfg }
+	a.cond = sync.NewCond(&a.mu)
+	return a
+}
+
+// Priority returns the priority Transact would use for pkts: the highest
+// of their endpoints' priorities
+func (a *Arbiter) Priority(pkts []datalink.Packet) Priority {
+	if len(pkts) == 0 {
+		return PriorityNormal
+	}
+
+	prio := PriorityLow
+	for _, p := range pkts {
+		ep, ok := a.cfg.Endpoints[p.Endpoint]
+		if !ok {
+			ep = PriorityNormal
+		}
+		if ep > prio {
+			prio = ep
+		}
+	}
+	return prio
+}
+
+func (a *Arbiter) Transact(pkts []datalink.Packet) ([]datalink.Packet, error) {
+	return a.TransactPriority(a.Priority(pkts), pkts)
+}
+
+func (a *Arbiter) effective(r *request, now time.Time) Priority {
+	if a.cfg.AgeStep <= 0 || r.prio >= PriorityHigh {
+		return r.prio
+	}
+
+	aged := r.prio + Priority(now.Sub(r.queued) / a.cfg.AgeStep)
+	if aged > PriorityHigh {
+		aged = PriorityHigh
+	}
+	return aged
+}
+
+// next returns the waiting request which should go next. a.mu must be
+// held.
+func (a *Arbiter) next() *request {
+	now := time.Now()
+
+	var best *request
+	var bestPrio Priority
+	for _, r := range a.waiting {
+		p := a.effective(r, now)
+		if best == nil || p > bestPrio || (p == bestPrio && r.seq < best.seq) {
+			best, bestPrio = r, p
+		}
+	}
+	return best
+}
+
+func (a *Arbiter) remove(r *request) {
+	for i, w := range a.waiting {
+		if w == r {
+			a.waiting = append(a.waiting[:i], a.waiting[i + 1:]...)
+			return
+		}
+	}
+}
+
+// TransactPriority is Transact, with an explicit priority
+func (a *Arbiter) TransactPriority(prio Priority, pkts []datalink.Packet) ([]datalink.Packet, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.seq++
+	r := &request{
+		prio: prio,
+		queued: time.Now(),
+		seq: a.seq,
+		pkts: pkts,
+	}
+	a.waiting = append(a.waiting, r)
+
+	for {
+		for a.busy || a.next() != r {
+			a.cond.Wait()
+		}
+
+		chunk := r.pkts
+		if a.cfg.ChunkPackets > 0 && len(chunk) > a.cfg.ChunkPackets {
+			chunk = chunk[:a.cfg.ChunkPackets]
+		}
+		r.pkts = r.pkts[len(chunk):]
+
+		a.busy = true
+		a.mu.Unlock()
+		rx, err := a.t.Transact(chunk)
+		a.mu.Lock()
+		a.busy = false
+
+		r.rx = append(r.rx, rx...)
+		r.err = err
+		// The rest of the request ages from now, so that a long
+		// request doesn't keep the bus just because it started long ago
+		r.queued = time.Now()
+
+		if err != nil || len(r.pkts) == 0 {
+			a.remove(r)
+			a.cond.Broadcast()
+			return r.rx, r.err
+		}
+
+		a.cond.Broadcast()
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright 2017 Brian Starkey <stark3y@gmail.com>
+
+package sched
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/usedbytes/bot_matrix/datalink"
+)
+
+// slowBus takes perPacket to transfer each packet, and records the
+// endpoint of the first packet of each transaction. If gate is set,
+// transactions wait for it to be closed.
+type slowBus struct {
+	perPacket time.Duration
+	gate chan struct{}
+
+	mu sync.Mutex
+	order []uint8
+}
+
+func (b *slowBus) Transact(tx []datalink.Packet) ([]datalink.Packet, error) {
+	if b.gate != nil {
+		<-b.gate
+	}
+
+	time.Sleep(time.Duration(len(tx)) * b.perPacket)
+
+	b.mu.Lock()
+	if len(tx) > 0 {
+		b.order = append(b.order, tx[0].Endpoint)
+	}
+	b.mu.Unlock()
+
+	return tx, nil
+}
+
+func packets(ep uint8, n int) []datalink.Packet {
+	pkts := make([]datalink.Packet, n)
+	for i := range pkts {
+		pkts[i] = datalink.Packet{ Endpoint: ep, Data: []byte{ byte(i) } }
+	}
+	return pkts
+}
+
+func waitQueued(a *Arbiter, n int) {
+	for {
+		a.mu.Lock()
+		l := len(a.waiting)
+		a.mu.Unlock()
+
+		if l >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestArbiterOrder(t *testing.T) {
+	bus := &slowBus{ gate: make(chan struct{}) }
+	a := NewArbiter(bus, ArbiterConfig{
+		Endpoints: map[uint8]Priority{
+			1: PriorityLow,
+			3: PriorityHigh,
+		},
+	})
+
+	var wg sync.WaitGroup
+	transact := func(ep uint8) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.Transact(packets(ep, 1))
+		}()
+	}
+
+	// Occupies the bus while the others queue up
+	transact(9)
+	waitQueued(a, 1)
+	for _, ep := range []uint8{ 1, 2, 3 } {
+		transact(ep)
+	}
+	waitQueued(a, 4)
+
+	close(bus.gate)
+	wg.Wait()
+
+	expected := []uint8{ 9, 3, 2, 1 }
+	for i := range expected {
+		if bus.order[i] != expected[i] {
+			t.Errorf("Wrong order.\n  Expected: %v\n       Got: %v\n", expected, bus.order)
+			break
+		}
+	}
+}
+
+func TestArbiterPreemption(t *testing.T) {
+	perPacket := 2 * time.Millisecond
+	bus := &slowBus{ perPacket: perPacket }
+	a := NewArbiter(bus, ArbiterConfig{
+		Endpoints: map[uint8]Priority{
+			1: PriorityUrgent,
+			10: PriorityLow,
+		},
+		ChunkPackets: 2,
+	})
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				// 20 packet times, if it weren't split
+				a.Transact(packets(10, 20))
+			}
+		}()
+	}
+
+	// Let the low priority traffic build up
+	time.Sleep(10 * time.Millisecond)
+
+	var worst time.Duration
+	for i := 0; i < 10; i++ {
+		start := time.Now()
+		_, err := a.Transact(packets(1, 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if d := time.Since(start); d > worst {
+			worst = d
+		}
+		time.Sleep(3 * time.Millisecond)
+	}
+
+	close(stop)
+	wg.Wait()
+
+	// At worst, waits for one chunk in progress, then its own transfer,
+	// which is 3 packet times. Allow plenty of slack, but well under one
+	// unsplit low priority request.
+	bound := 10 * perPacket
+	if worst > bound {
+		t.Errorf("Urgent latency too high. Expected at most %v, got %v\n", bound, worst)
+	}
+}
+
+func TestArbiterAgeing(t *testing.T) {
+	bus := &slowBus{ perPacket: time.Millisecond }
+	a := NewArbiter(bus, ArbiterConfig{
+		Endpoints: map[uint8]Priority{
+			1: PriorityHigh,
+			10: PriorityLow,
+		},
+		AgeStep: 5 * time.Millisecond,
+	})
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				a.Transact(packets(1, 1))
+			}
+		}()
+	}
+
+	time.Sleep(5 * time.Millisecond)
+
+	done := make(chan time.Duration)
+	go func() {
+		start := time.Now()
+		a.Transact(packets(10, 1))
+		done <- time.Since(start)
+	}()
+
+	select {
+	case d := <-done:
+		// Two AgeSteps to reach PriorityHigh, plus some transfers
+		if d > 50 * time.Millisecond {
+			t.Errorf("Low priority request took too long: %v\n", d)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Low priority request starved\n")
+	}
+
+	close(stop)
+	wg.Wait()
+}
+
+func TestArbiterAgeingCap(t *testing.T) {
+	bus := &slowBus{ gate: make(chan struct{}) }
+	a := NewArbiter(bus, ArbiterConfig{
+		Endpoints: map[uint8]Priority{
+			1: PriorityUrgent,
+			10: PriorityLow,
+		},
+		AgeStep: time.Millisecond,
+	})
+
+	var wg sync.WaitGroup
+	transact := func(ep uint8) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.Transact(packets(ep, 1))
+		}()
+	}
+
+	// Occupies the bus while the others queue up
+	transact(9)
+	waitQueued(a, 1)
+	for i := 0; i < 3; i++ {
+		transact(10)
+	}
+	waitQueued(a, 4)
+
+	// Many AgeSteps, so without a cap the low requests would outrank
+	// PriorityUrgent
+	time.Sleep(20 * time.Millisecond)
+	transact(1)
+	waitQueued(a, 5)
+
+	close(bus.gate)
+	wg.Wait()
+
+	if len(bus.order) < 2 || bus.order[1] != 1 {
+		t.Errorf("Urgent request didn't go first. Order: %v\n", bus.order)
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright 2017 Brian Starkey <stark3y@gmail.com>
+
+package sched
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/usedbytes/bot_matrix/datalink"
+)
+
+// Job is run every Period by a Periodic
+type Job struct {
+	Name string
+	Period time.Duration
+	// Packets returns the packets to send on each run
+	Packets func() []datalink.Packet
+	// Response, if set, is called after each run with the received
+	// packets on the endpoints the job sent on, or the error
+	Response func(rx []datalink.Packet, err error)
+	// Endpoints are passed to Response as well as those sent on, for
+	// peers which respond in a later transaction
+	Endpoints []uint8
+}
+
+type JobStats struct {
+	Runs int
+	// Overruns counts periods which were skipped, because the job was
+	// still running or the scheduler was late
+	Overruns int
+	// Jitter is how late runs started, relative to their schedule
+	MeanJitter, MaxJitter time.Duration
+}
+
+type job struct {
+	Job
+	due time.Time
+	stats JobStats
+	totalJitter time.Duration
+}
+
+// Periodic runs Jobs against a Transactor. Jobs due within one tick of
+// each other are merged into a single transaction.
+type Periodic struct {
+	t datalink.Transactor
+	tick time.Duration
+
+	mu sync.Mutex
+	jobs []*job
+	// Transactions counts the transactions made
+	transactions int
+}
+
+func NewPeriodic(t datalink.Transactor, tick time.Duration) (*Periodic, error) {
+	if tick <= 0 {
+		return nil, fmt.Errorf("Invalid tick %v", tick)
+	}
+
+	return &Periodic{ t: t, tick: tick }, nil
+}
+
+// Add registers j. Jobs may be added while Run is running, and start one
+// Period later.
+func (p *Periodic) Add(j Job) error {
+	if j.Period <= 0 {
+		return fmt.Errorf("Invalid period %v for job %s", j.Period, j.Name)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, o := range p.jobs {
+		if o.Name == j.Name {
+			return fmt.Errorf("Job %s already exists", j.Name)
+		}
+	}
+
+	p.jobs = append(p.jobs, &job{ Job: j, due: time.Now().Add(j.Period) })
+
+	return nil
+}
+
+// Stats returns the stats for each job, by name
+func (p *Periodic) Stats() map[string]JobStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := make(map[string]JobStats, len(p.jobs))
+	for _, j := range p.jobs {
+		s := j.stats
+		if s.Runs > 0 {
+			s.MeanJitter = j.totalJitter / time.Duration(s.Runs)
+		}
+		stats[j.Name] = s
+	}
+	return stats
+}
+
+// Transactions returns the number of transactions made so far
+func (p *Periodic) Transactions() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.transactions
+}
+
+// due returns the jobs due by the end of the current tick, and moves
+// their schedules on
+func (p *Periodic) due(now time.Time) []*job {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var run []*job
+	for _, j := range p.jobs {
+		if !j.due.After(now.Add(p.tick)) {
+			run = append(run, j)
+
+			jitter := now.Sub(j.due)
+			if jitter < 0 {
+				jitter = 0
+			}
+			j.stats.Runs++
+			j.totalJitter += jitter
+			if jitter > j.stats.MaxJitter {
+				j.stats.MaxJitter = jitter
+			}
+
+			j.due = j.due.Add(j.Period)
+		}
+	}
+
+	return run
+}
+
+// next returns when the next job is due, or the zero Time if there are
+// no jobs
+func (p *Periodic) next() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var next time.Time
+	for _, j := range p.jobs {
+		if next.IsZero() || j.due.Before(next) {
+			next = j.due
+		}
+	}
+
+	return next
+}
+
+// skip moves on the schedule of jobs which missed their next run while
+// the last transaction was in progress
+func (p *Periodic) skip(jobs []*job, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, j := range jobs {
+		for !j.due.After(now) {
+			j.due = j.due.Add(j.Period)
+			j.stats.Overruns++
+		}
+	}
+}
+
+func (p *Periodic) run(jobs []*job) {
+	var tx []datalink.Packet
+	eps := make([]map[uint8]bool, len(jobs))
+	for i, j := range jobs {
+		pkts := j.Packets()
+		eps[i] = make(map[uint8]bool)
+		for _, ep := range j.Endpoints {
+			eps[i][ep] = true
+		}
+		for _, pkt := range pkts {
+			eps[i][pkt.Endpoint] = true
+		}
+		tx = append(tx, pkts...)
+	}
+
+	rx, err := p.t.Transact(tx)
+
+	p.mu.Lock()
+	p.transactions++
+	p.mu.Unlock()
+
+	for i, j := range jobs {
+		if j.Response == nil {
+			continue
+		}
+
+		var mine []datalink.Packet
+		for _, pkt := range rx {
+			if eps[i][pkt.Endpoint] {
+				mine = append(mine, pkt)
+			}
+		}
+		j.Response(mine, err)
+	}
+}
+
+// RunNow runs all the jobs once, in a single transaction. Their schedules
+// and Stats aren't affected.
+func (p *Periodic) RunNow() {
+	p.mu.Lock()
+	jobs := append([]*job{}, p.jobs...)
+	p.mu.Unlock()
+
+	if len(jobs) > 0 {
+		p.run(jobs)
+	}
+}
+
+// Run runs the jobs until ctx is done
+func (p *Periodic) Run(ctx context.Context) error {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		jobs := p.due(time.Now())
+		if len(jobs) > 0 {
+			p.run(jobs)
+			p.skip(jobs, time.Now())
+		}
+
+		// With no jobs, check again each tick in case some are added
+		d := p.tick
+		if next := p.next(); !next.IsZero() {
+			d = time.Until(next)
+		}
+		timer.Reset(d)
+	}
+}
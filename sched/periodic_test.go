@@ -0,0 +1,163 @@
+// Copyright 2017 Brian Starkey <stark3y@gmail.com>
+
+package sched
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/usedbytes/bot_matrix/datalink"
+)
+
+// echoBus returns the packets sent, after delay
+type echoBus struct {
+	delay time.Duration
+}
+
+func (b *echoBus) Transact(tx []datalink.Packet) ([]datalink.Packet, error) {
+	time.Sleep(b.delay)
+	return tx, nil
+}
+
+func runFor(p *Periodic, d time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	p.Run(ctx)
+}
+
+func TestPeriodic(t *testing.T) {
+	p, err := NewPeriodic(&echoBus{}, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	responses := map[string]int{}
+	add := func(name string, period time.Duration, ep uint8) {
+		err := p.Add(Job{
+			Name: name,
+			Period: period,
+			Packets: func() []datalink.Packet {
+				return []datalink.Packet{ { Endpoint: ep } }
+			},
+			Response: func(rx []datalink.Packet, err error) {
+				mu.Lock()
+				defer mu.Unlock()
+
+				if err != nil || len(rx) != 1 || rx[0].Endpoint != ep {
+					t.Errorf("%s: unexpected response %v (%v)\n", name, rx, err)
+				}
+				responses[name]++
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	add("encoders", 5 * time.Millisecond, 7)
+	add("setpoint", 20 * time.Millisecond, 5)
+
+	runFor(p, 205 * time.Millisecond)
+
+	stats := p.Stats()
+	for name, expected := range map[string]int{ "encoders": 40, "setpoint": 10 } {
+		runs, overruns := stats[name].Runs, stats[name].Overruns
+		if n := runs + overruns; n < expected - 2 || n > expected + 1 {
+			t.Errorf("%s: expected about %d periods, got %d\n", name, expected, n)
+		}
+
+		if responses[name] != runs {
+			t.Errorf("%s: %d runs but %d responses\n", name, runs, responses[name])
+		}
+
+		// The odd one is possible on a busy machine
+		if overruns > 2 {
+			t.Errorf("%s: unexpected overruns: %d\n", name, overruns)
+		}
+	}
+
+	// setpoint is always due at the same time as encoders
+	total := stats["encoders"].Runs + stats["setpoint"].Runs
+	if n := p.Transactions(); n != stats["encoders"].Runs {
+		t.Errorf("Expected jobs to be merged into %d transactions, got %d (of %d runs)\n",
+			stats["encoders"].Runs, n, total)
+	}
+}
+
+func TestPeriodicOverrun(t *testing.T) {
+	p, err := NewPeriodic(&echoBus{ delay: 12 * time.Millisecond }, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Add(Job{
+		Name: "fast",
+		Period: 5 * time.Millisecond,
+		Packets: func() []datalink.Packet { return nil },
+	})
+
+	runFor(p, 100 * time.Millisecond)
+
+	s := p.Stats()["fast"]
+	if s.Overruns < s.Runs {
+		t.Errorf("Expected at least one overrun per run, got %d in %d runs\n", s.Overruns, s.Runs)
+	}
+}
+
+func TestPeriodicAdd(t *testing.T) {
+	_, err := NewPeriodic(&echoBus{}, 0)
+	if err == nil || !strings.HasPrefix(err.Error(), "Invalid tick") {
+		t.Errorf("Expected invalid tick error, got: %v\n", err)
+	}
+
+	p, err := NewPeriodic(&echoBus{}, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = p.Add(Job{ Name: "a" })
+	if err == nil || !strings.HasPrefix(err.Error(), "Invalid period") {
+		t.Errorf("Expected invalid period error, got: %v\n", err)
+	}
+
+	p.Add(Job{ Name: "a", Period: time.Second })
+	err = p.Add(Job{ Name: "a", Period: time.Second })
+	if err == nil || !strings.HasPrefix(err.Error(), "Job a already exists") {
+		t.Errorf("Expected duplicate job error, got: %v\n", err)
+	}
+}
+
+func TestPeriodicRunNow(t *testing.T) {
+	p, err := NewPeriodic(&echoBus{}, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rx []datalink.Packet
+	for _, ep := range []uint8{ 1, 2 } {
+		ep := ep
+		p.Add(Job{
+			Name: fmt.Sprint(ep),
+			Period: time.Hour,
+			Packets: func() []datalink.Packet {
+				return []datalink.Packet{ { Endpoint: ep } }
+			},
+			Response: func(pkts []datalink.Packet, err error) {
+				rx = append(rx, pkts...)
+			},
+		})
+	}
+
+	p.RunNow()
+
+	if len(rx) != 2 || p.Transactions() != 1 {
+		t.Errorf("Expected 2 responses from 1 transaction, got %v from %d\n", rx, p.Transactions())
+	}
+	if s := p.Stats()["1"]; s.Runs != 0 {
+		t.Errorf("Expected RunNow not to count as a run, got %+v\n", s)
+	}
+}
@@ -0,0 +1,282 @@
+// Copyright 2017 Brian Starkey <stark3y@gmail.com>
+
+// Package schema describes a device's endpoints and their payloads, in a
+// JSON file shared between host tools and firmware.
+//
+// An example:
+//
+//	{
+//		"name": "Motor",
+//		"endpoints": [
+//			{
+//				"name": "Freq",
+//				"endpoint": 2,
+//				"direction": "out",
+//				"doc": "PWM frequency",
+//				"fields": [
+//					{ "name": "Freq", "type": "uint32", "units": "Hz" }
+//				]
+//			}
+//		]
+//	}
+//
+// Field types are Go's fixed-size numeric types and bool. Fields may also
+// set "endian": "be", "fixed" (fractional bits, for a float sent as fixed
+// point), "count" (for an array) and "pad" (zero bytes after the field),
+// which have the same meaning as the codec package's tags.
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"regexp"
+)
+
+type Direction string
+
+const (
+	// Out endpoints take data from the host, with no response
+	Out Direction = "out"
+	// In endpoints return data when polled with an empty request
+	In Direction = "in"
+	// InOut endpoints take a request, and return a response
+	InOut Direction = "inout"
+)
+
+type Field struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Units string `json:"units,omitempty"`
+	Doc string `json:"doc,omitempty"`
+	Endian string `json:"endian,omitempty"`
+	Fixed int `json:"fixed,omitempty"`
+	Count int `json:"count,omitempty"`
+	Pad int `json:"pad,omitempty"`
+}
+
+type Endpoint struct {
+	Name string `json:"name"`
+	Endpoint uint8 `json:"endpoint"`
+	Direction Direction `json:"direction"`
+	Doc string `json:"doc,omitempty"`
+	// Version of the endpoint's payload format
+	Version uint8 `json:"version,omitempty"`
+	// Fields of the request. Must be empty for In endpoints.
+	Fields []Field `json:"fields,omitempty"`
+	// Fields of the response, for In and InOut endpoints
+	Response []Field `json:"response,omitempty"`
+}
+
+type Schema struct {
+	Name string `json:"name"`
+	Doc string `json:"doc,omitempty"`
+	// Version of the device's firmware interface
+	Version uint16 `json:"version,omitempty"`
+	Endpoints []Endpoint `json:"endpoints"`
+}
+
+// Types maps the supported field types to their size in bytes
+var Types = map[string]int{
+	"bool": 1,
+	"uint8": 1, "int8": 1,
+	"uint16": 2, "int16": 2,
+	"uint32": 4, "int32": 4,
+	"uint64": 8, "int64": 8,
+	"float32": 4, "float64": 8,
+}
+
+var identRe = regexp.MustCompile(`^[A-Z][A-Za-z0-9]*$`)
+
+func validateFields(ep string, fields []Field) error {
+	names := make(map[string]bool)
+	for _, f := range fields {
+		if !identRe.MatchString(f.Name) {
+			return fmt.Errorf("Endpoint %s: invalid field name %q", ep, f.Name)
+		}
+		if names[f.Name] {
+			return fmt.Errorf("Endpoint %s: duplicate field %s", ep, f.Name)
+		}
+		names[f.Name] = true
+
+		if _, ok := Types[f.Type]; !ok {
+			return fmt.Errorf("Endpoint %s: field %s has unknown type %q", ep, f.Name, f.Type)
+		}
+
+		if f.Endian != "" && f.Endian != "le" && f.Endian != "be" {
+			return fmt.Errorf("Endpoint %s: field %s has invalid endian %q", ep, f.Name, f.Endian)
+		}
+
+		if f.Fixed != 0 && f.Type != "float32" && f.Type != "float64" {
+			return fmt.Errorf("Endpoint %s: field %s is fixed point, so must be a float", ep, f.Name)
+		}
+
+		if f.Fixed < 0 || f.Fixed > 31 || f.Count < 0 || f.Pad < 0 {
+			return fmt.Errorf("Endpoint %s: field %s has an invalid size", ep, f.Name)
+		}
+	}
+
+	return nil
+}
+
+// Validate checks that s is well formed
+func (s *Schema) Validate() error {
+	if !identRe.MatchString(s.Name) {
+		return fmt.Errorf("Invalid schema name %q", s.Name)
+	}
+
+	names := make(map[string]bool)
+	eps := make(map[uint8]bool)
+	for _, e := range s.Endpoints {
+		if !identRe.MatchString(e.Name) {
+			return fmt.Errorf("Invalid endpoint name %q", e.Name)
+		}
+		if names[e.Name] {
+			return fmt.Errorf("Duplicate endpoint name %s", e.Name)
+		}
+		if eps[e.Endpoint] {
+			return fmt.Errorf("Duplicate endpoint number %d", e.Endpoint)
+		}
+		names[e.Name], eps[e.Endpoint] = true, true
+
+		switch e.Direction {
+		case Out:
+			if len(e.Response) > 0 {
+				return fmt.Errorf("Endpoint %s: out endpoints have no response", e.Name)
+			}
+		case In:
+			if len(e.Fields) > 0 {
+				return fmt.Errorf("Endpoint %s: in endpoints have no request fields", e.Name)
+			}
+			fallthrough
+		case InOut:
+			if len(e.Response) == 0 {
+				return fmt.Errorf("Endpoint %s: %s endpoints need response fields", e.Name, e.Direction)
+			}
+		default:
+			return fmt.Errorf("Endpoint %s: invalid direction %q", e.Name, e.Direction)
+		}
+
+		if err := validateFields(e.Name, e.Fields); err != nil {
+			return err
+		}
+		if err := validateFields(e.Name, e.Response); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Parse reads and validates a schema
+func Parse(r io.Reader) (*Schema, error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+
+	s := &Schema{}
+	err := dec.Decode(s)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func Load(path string) (*Schema, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return Parse(f)
+}
+
+// structTag returns the codec struct tag for f, or "" if it doesn't need one
+func (f Field) structTag() reflect.StructTag {
+	opts := ""
+	add := func(o string) {
+		if opts != "" {
+			opts += ","
+		}
+		opts += o
+	}
+
+	if f.Endian == "be" {
+		add("be")
+	}
+	if f.Fixed > 0 {
+		add(fmt.Sprintf("fixed=%d", f.Fixed))
+	}
+	if f.Pad > 0 {
+		add(fmt.Sprintf("pad=%d", f.Pad))
+	}
+
+	if opts == "" {
+		return ""
+	}
+	return reflect.StructTag(fmt.Sprintf("datalink:\"%s\"", opts))
+}
+
+// Tag returns the codec struct tag for f, quoted for Go source, or "" if
+// it doesn't need one
+func (f Field) Tag() string {
+	if tag := f.structTag(); tag != "" {
+		return "`" + string(tag) + "`"
+	}
+	return ""
+}
+
+// Size returns the encoded size of f in bytes, including padding
+func (f Field) Size() int {
+	size := Types[f.Type]
+	if f.Fixed > 0 {
+		size = 4
+	}
+	if f.Count > 0 {
+		size *= f.Count
+	}
+	return size + f.Pad
+}
+
+var kinds = map[string]reflect.Type{
+	"bool": reflect.TypeOf(false),
+	"uint8": reflect.TypeOf(uint8(0)), "int8": reflect.TypeOf(int8(0)),
+	"uint16": reflect.TypeOf(uint16(0)), "int16": reflect.TypeOf(int16(0)),
+	"uint32": reflect.TypeOf(uint32(0)), "int32": reflect.TypeOf(int32(0)),
+	"uint64": reflect.TypeOf(uint64(0)), "int64": reflect.TypeOf(int64(0)),
+	"float32": reflect.TypeOf(float32(0)), "float64": reflect.TypeOf(float64(0)),
+}
+
+// GoType returns the Go type of f, which is an array if f.Count is set
+func (f Field) GoType() reflect.Type {
+	t := kinds[f.Type]
+	if f.Count > 0 {
+		t = reflect.ArrayOf(f.Count, t)
+	}
+	return t
+}
+
+// StructOf returns a struct type with a field for each of fields, tagged
+// for the codec package. It's the same as the type dlgen would generate,
+// for encoding and decoding payloads which aren't known until run time.
+// fields must be valid.
+func StructOf(fields []Field) reflect.Type {
+	sf := make([]reflect.StructField, 0, len(fields))
+	for _, f := range fields {
+		sf = append(sf, reflect.StructField{
+			Name: f.Name,
+			Type: f.GoType(),
+			Tag: f.structTag(),
+		})
+	}
+
+	return reflect.StructOf(sf)
+}
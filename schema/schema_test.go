@@ -0,0 +1,94 @@
+// Copyright 2017 Brian Starkey <stark3y@gmail.com>
+
+package schema
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/usedbytes/bot_matrix/datalink/codec"
+)
+
+func TestParse(t *testing.T) {
+	s, err := Parse(strings.NewReader(`{
+		"name": "Test",
+		"endpoints": [
+			{ "name": "A", "endpoint": 1, "direction": "out",
+			  "fields": [ { "name": "X", "type": "float32", "fixed": 8, "count": 2, "pad": 1 } ] }
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := s.Endpoints[0].Fields[0]
+	if f.Size() != 9 {
+		t.Errorf("Expected size 9, got %d\n", f.Size())
+	}
+
+	if f.Tag() != "`datalink:\"fixed=8,pad=1\"`" {
+		t.Errorf("Unexpected tag %s\n", f.Tag())
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct{
+		json string
+		prefix string
+	}{
+		{ `{ "name": "lower" }`, "Invalid schema name" },
+		{ `{ "name": "T", "bogus": 1 }`, "json: unknown field" },
+		{ `{ "name": "T", "endpoints": [ { "name": "A", "endpoint": 1, "direction": "out" },
+			{ "name": "B", "endpoint": 1, "direction": "out" } ] }`, "Duplicate endpoint number 1" },
+		{ `{ "name": "T", "endpoints": [ { "name": "A", "endpoint": 1, "direction": "sideways" } ] }`,
+			"Endpoint A: invalid direction" },
+		{ `{ "name": "T", "endpoints": [ { "name": "A", "endpoint": 1, "direction": "in" } ] }`,
+			"Endpoint A: in endpoints need response fields" },
+		{ `{ "name": "T", "endpoints": [ { "name": "A", "endpoint": 1, "direction": "out",
+			"fields": [ { "name": "X", "type": "string" } ] } ] }`,
+			"Endpoint A: field X has unknown type" },
+		{ `{ "name": "T", "endpoints": [ { "name": "A", "endpoint": 1, "direction": "out",
+			"fields": [ { "name": "X", "type": "uint8", "fixed": 4 } ] } ] }`,
+			"Endpoint A: field X is fixed point" },
+	}
+
+	for _, tc := range tests {
+		_, err := Parse(strings.NewReader(tc.json))
+		if err == nil || !strings.HasPrefix(err.Error(), tc.prefix) {
+			t.Errorf("Expected '%s' error, got: %v\n", tc.prefix, err)
+		}
+	}
+}
+
+func TestStructOf(t *testing.T) {
+	fields := []Field{
+		{ Name: "A", Type: "uint16", Endian: "be" },
+		{ Name: "B", Type: "float64", Fixed: 16, Count: 2, Pad: 1 },
+		{ Name: "C", Type: "bool" },
+	}
+
+	typ := StructOf(fields)
+	if f, _ := typ.FieldByName("B"); f.Type != reflect.TypeOf([2]float64{}) || f.Tag.Get("datalink") != "fixed=16,pad=1" {
+		t.Errorf("Unexpected field B: %v %q\n", f.Type, f.Tag)
+	}
+
+	v := reflect.New(typ)
+	v.Elem().Field(0).SetUint(0x0102)
+	v.Elem().Field(1).Index(1).SetFloat(-1)
+	v.Elem().Field(2).SetBool(true)
+
+	data, err := codec.Marshal(v.Interface())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size := 0
+	for _, f := range fields {
+		size += f.Size()
+	}
+
+	if len(data) != size || data[0] != 0x01 || data[9] != 0xff || data[len(data) - 1] != 1 {
+		t.Errorf("Unexpected encoding %x\n", data)
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright 2017 Brian Starkey <stark3y@gmail.com>
+
+package sim
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/usedbytes/bot_matrix/datalink/codec"
+	"github.com/usedbytes/bot_matrix/datalink/discovery"
+	"github.com/usedbytes/bot_matrix/datalink/motor"
+)
+
+// MotorConfig describes a simulated motor
+type MotorConfig struct {
+	// MaxSpeed is the speed at full duty, in set point units
+	MaxSpeed float64
+	// Tau is the time constant of the speed's response to a change in
+	// duty
+	Tau time.Duration
+	// Delay is the dead time between a change in duty and the motor
+	// starting to respond to it
+	Delay time.Duration
+	// StallCurrent is the current at full duty when the motor isn't
+	// turning, and NoLoadCurrent the current when it's turning freely,
+	// both in mA
+	StallCurrent, NoLoadCurrent float64
+	// Period is the interval of the firmware's PID loop
+	Period time.Duration
+}
+
+var DefaultMotorConfig = MotorConfig{
+	MaxSpeed: 1000,
+	Tau: 200 * time.Millisecond,
+	StallCurrent: 2000,
+	NoLoadCurrent: 50,
+	Delay: 20 * time.Millisecond,
+	Period: time.Millisecond,
+}
+
+// change is a duty cycle which the motor hasn't seen yet
+type change struct {
+	at time.Time
+	duty float64
+}
+
+// Motor is a Peer which simulates the motor controller firmware, driving
+// a motor on channel 0, and reporting on EndpointTelemetry. It answers
+// discovery requests with the motor schema. Other endpoints are ignored.
+//
+// Setting a duty cycle on EndpointDuty drives the motor directly. Setting
+// a set point on EndpointSetpoint starts the PID loop, which runs until
+// the next duty cycle is set. The PID's output is in 1/65535ths of full
+// duty (negative for reverse), its error in set point units, and Ki and
+// Kd are per second and in seconds. The integral term is limited to
+// Ilimit, if that's set.
+type Motor struct {
+	*Peer
+
+	cfg MotorConfig
+	// Now returns the current time. It's time.Now, unless replaced to
+	// control the simulation, which must be done before first use.
+	Now func() time.Time
+
+	mu sync.Mutex
+	last time.Time
+	// duty is the output, signed, negative for reverse. The motor sees
+	// it cfg.Delay later, as applied.
+	duty float64
+	pending []change
+	applied float64
+	speed float64
+
+	pid bool
+	gains motor.Gains
+	setpoint, ilimit float64
+	// next is the time of the next run of the PID loop
+	next time.Time
+	integral, prevErr float64
+}
+
+func NewMotor(cfg MotorConfig) (*Motor, error) {
+	if cfg.Period <= 0 {
+		return nil, fmt.Errorf("Invalid PID period %v", cfg.Period)
+	}
+
+	m := &Motor{
+		Peer: NewPeer(),
+		cfg: cfg,
+		Now: time.Now,
+	}
+
+	// out registers a handler for an Out endpoint, which decodes into
+	// v and calls set with m.mu held and the simulation up to date
+	out := func(ep uint8, v interface{}, set func()) {
+		m.Handle(ep, func(data []byte) []byte {
+			if codec.Unmarshal(data, v) != nil {
+				return nil
+			}
+
+			m.mu.Lock()
+			defer m.mu.Unlock()
+
+			m.advance()
+			set()
+			return nil
+		})
+	}
+
+	var duty motor.Duty
+	out(motor.EndpointDuty, &duty, func() {
+		if duty.Channel != 0 {
+			return
+		}
+
+		d := float64(duty.Duty) / math.MaxUint16
+		if motor.Direction(duty.Dir) == motor.Reverse {
+			d = -d
+		}
+		m.pid = false
+		m.setDuty(m.last, d)
+	})
+
+	var sp motor.Setpoint
+	out(motor.EndpointSetpoint, &sp, func() {
+		m.setpoint = float64(sp.Setpoint)
+		if !m.pid {
+			m.pid = true
+			m.next = m.last
+			m.integral, m.prevErr = 0, m.setpoint - m.speed
+		}
+	})
+
+	var g motor.Gains
+	out(motor.EndpointGains, &g, func() {
+		m.gains = g
+	})
+
+	var il motor.Ilimit
+	out(motor.EndpointIlimit, &il, func() {
+		m.ilimit = float64(il.Ilimit)
+	})
+
+	m.Handle(motor.EndpointTelemetry, func(data []byte) []byte {
+		data, _ = codec.Marshal(m.Telemetry())
+		return data
+	})
+
+	m.Handle(discovery.Endpoint, discovery.Responder(motor.Schema()))
+
+	return m, nil
+}
+
+// setDuty sets the output at time at. m.mu must be held.
+func (m *Motor) setDuty(at time.Time, duty float64) {
+	m.duty = duty
+	if m.cfg.Delay == 0 {
+		m.applied = duty
+		return
+	}
+	m.pending = append(m.pending, change{ at, duty })
+}
+
+// integrate moves the motor on to time to. m.mu must be held.
+func (m *Motor) integrate(to time.Time) {
+	dt := to.Sub(m.last)
+	if dt <= 0 {
+		return
+	}
+	m.last = to
+
+	target := m.applied * m.cfg.MaxSpeed
+	m.speed += (target - m.speed) * (1 - math.Exp(-float64(dt) / float64(m.cfg.Tau)))
+}
+
+// plant moves the motor on to time to, applying the output as it reaches
+// the motor. m.mu must be held.
+func (m *Motor) plant(to time.Time) {
+	for len(m.pending) > 0 {
+		at := m.pending[0].at.Add(m.cfg.Delay)
+		if at.After(to) {
+			break
+		}
+
+		m.integrate(at)
+		m.applied = m.pending[0].duty
+		m.pending = m.pending[1:]
+	}
+
+	m.integrate(to)
+}
+
+// control runs the PID loop once. m.mu must be held.
+func (m *Motor) control() {
+	dt := m.cfg.Period.Seconds()
+	e := m.setpoint - m.speed
+
+	m.integral += e * dt
+	iterm := m.gains.Ki * m.integral
+	if m.ilimit > 0 && math.Abs(iterm) > m.ilimit {
+		iterm = math.Copysign(m.ilimit, iterm)
+		m.integral = iterm / m.gains.Ki
+	}
+
+	out := m.gains.Kc * e + iterm + m.gains.Kd * (e - m.prevErr) / dt
+	m.prevErr = e
+
+	m.setDuty(m.last, math.Max(-1, math.Min(1, out / math.MaxUint16)))
+}
+
+// advance moves the simulation on to m.Now(). m.mu must be held.
+func (m *Motor) advance() {
+	now := m.Now()
+	if m.last.IsZero() {
+		m.last = now
+	}
+
+	for m.pid && !m.next.After(now) {
+		m.plant(m.next)
+		m.control()
+		m.next = m.next.Add(m.cfg.Period)
+	}
+
+	m.plant(now)
+}
+
+// Telemetry returns what the firmware would report now
+func (m *Motor) Telemetry() motor.TelemetryResponse {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.advance()
+
+	// The current is driven by the difference between the applied
+	// voltage and the back-EMF, which is proportional to the speed
+	current := math.Abs(m.applied - m.speed / m.cfg.MaxSpeed) * m.cfg.StallCurrent
+	if m.applied != 0 {
+		current += m.cfg.NoLoadCurrent
+	}
+
+	return motor.TelemetryResponse{
+		Speed: uint32(math.Round(math.Abs(m.speed))),
+		Current: uint16(math.Min(current, math.MaxUint16)),
+		Duty: uint16(math.Round(math.Abs(m.duty) * math.MaxUint16)),
+	}
+}
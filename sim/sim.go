@@ -0,0 +1,74 @@
+// Copyright 2017 Brian Starkey <stark3y@gmail.com>
+
+// Package sim simulates the device at the other end of a datalink, for
+// tests, and for trying out tools without hardware.
+package sim
+
+import (
+	"sync"
+
+	"github.com/usedbytes/bot_matrix/datalink"
+)
+
+// Handler is called with the data of each packet received on an endpoint.
+// It returns the data of the response, or nil if there isn't one.
+type Handler func(data []byte) []byte
+
+// Peer is a simulated device, implementing datalink.Transactor. Like the
+// real firmware, responses are sent in the transaction after their
+// request. Packets for endpoints without a Handler are dropped.
+//
+// Peer is safe for concurrent use.
+type Peer struct {
+	mu sync.Mutex
+	handlers map[uint8]Handler
+	pending []datalink.Packet
+}
+
+func NewPeer() *Peer {
+	return &Peer{
+		handlers: make(map[uint8]Handler),
+	}
+}
+
+// Handle sets the Handler for ep, replacing any existing one. A nil
+// Handler removes it.
+func (p *Peer) Handle(ep uint8, h Handler) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if h == nil {
+		delete(p.handlers, ep)
+		return
+	}
+	p.handlers[ep] = h
+}
+
+// Send queues an unsolicited packet, to be sent in the next transaction
+func (p *Peer) Send(pkt datalink.Packet) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.pending = append(p.pending, pkt)
+}
+
+func (p *Peer) Transact(tx []datalink.Packet) ([]datalink.Packet, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	rx := p.pending
+	p.pending = nil
+
+	for _, pkt := range tx {
+		h := p.handlers[pkt.Endpoint]
+		if h == nil {
+			continue
+		}
+
+		if data := h(pkt.Data); data != nil {
+			p.pending = append(p.pending, datalink.Packet{ Endpoint: pkt.Endpoint, Data: data })
+		}
+	}
+
+	return rx, nil
+}
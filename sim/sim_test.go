@@ -0,0 +1,157 @@
+// Copyright 2017 Brian Starkey <stark3y@gmail.com>
+
+package sim
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/usedbytes/bot_matrix/datalink"
+	"github.com/usedbytes/bot_matrix/datalink/motor"
+)
+
+func TestPeer(t *testing.T) {
+	p := NewPeer()
+	p.Handle(1, func(data []byte) []byte {
+		return append([]byte{ 0xaa }, data...)
+	})
+
+	rx, err := p.Transact([]datalink.Packet{
+		{ Endpoint: 1, Data: []byte{ 1, 2 } },
+		{ Endpoint: 2, Data: []byte{ 3 } },
+	})
+	if err != nil || len(rx) != 0 {
+		t.Fatalf("Expected nothing in the first transaction, got %v %v\n", rx, err)
+	}
+
+	p.Send(datalink.Packet{ Endpoint: 3, Data: []byte{ 4 } })
+
+	rx, err = p.Transact(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rx) != 2 || rx[0].Endpoint != 1 || !bytes.Equal(rx[0].Data, []byte{ 0xaa, 1, 2 }) ||
+	   rx[1].Endpoint != 3 {
+		t.Errorf("Unexpected response: %v\n", rx)
+	}
+}
+
+func TestMotor(t *testing.T) {
+	// Without dead time, so the response starts at once
+	cfg := DefaultMotorConfig
+	cfg.Delay = 0
+
+	now := time.Unix(0, 0)
+	sm, err := NewMotor(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.Now = func() time.Time { return now }
+
+	m, err := motor.NewMotorController(sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := motor.NewMotorClient(sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.SetDuty(0, motor.Reverse, 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tel, err := c.GetTelemetry()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Stalled, at half duty
+	if tel.Speed != 0 || tel.Current != 1050 || tel.Duty != 32768 {
+		t.Errorf("Unexpected telemetry at start: %+v\n", tel)
+	}
+
+	now = now.Add(cfg.Tau)
+	tel = sm.Telemetry()
+	if tel.Speed != 316 {
+		t.Errorf("Expected speed 316 after one time constant, got %d\n", tel.Speed)
+	}
+
+	now = now.Add(20 * cfg.Tau)
+	tel = sm.Telemetry()
+	if tel.Speed != 500 || tel.Current != 50 {
+		t.Errorf("Unexpected telemetry when settled: %+v\n", tel)
+	}
+}
+
+func TestMotorPID(t *testing.T) {
+	cfg := DefaultMotorConfig
+
+	now := time.Unix(0, 0)
+	sm, err := NewMotor(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.Now = func() time.Time { return now }
+
+	m, err := motor.NewMotorController(sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The motor doesn't respond until the delay has passed
+	err = m.SetDuty(0, motor.Forward, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(cfg.Delay)
+	if tel := sm.Telemetry(); tel.Speed != 0 || tel.Duty != 65535 {
+		t.Errorf("Unexpected telemetry before the delay: %+v\n", tel)
+	}
+
+	now = now.Add(cfg.Tau)
+	if tel := sm.Telemetry(); tel.Speed != 632 {
+		t.Errorf("Expected speed 632 one time constant after the delay, got %d\n", tel.Speed)
+	}
+
+	// A set point hands control to the PID, which drives the speed to it
+	err = m.SetGains(motor.Gains{ Kc: 500, Ki: 5000 })
+	if err == nil {
+		err = m.SetSetpoint(300)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(2 * time.Second)
+	if tel := sm.Telemetry(); tel.Speed != 300 || tel.Duty != 19661 {
+		t.Errorf("Expected the PID to settle at 300, got %+v\n", tel)
+	}
+
+	// Setting a duty cycle takes control back
+	err = m.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(2 * time.Second)
+	if tel := sm.Telemetry(); tel.Speed != 0 || tel.Duty != 0 {
+		t.Errorf("Expected the motor to stop, got %+v\n", tel)
+	}
+}
+
+func TestMotorConfig(t *testing.T) {
+	cfg := DefaultMotorConfig
+	cfg.Period = 0
+
+	_, err := NewMotor(cfg)
+	if err == nil || !strings.HasPrefix(err.Error(), "Invalid PID period") {
+		t.Errorf("Expected invalid period error, got: %v\n", err)
+	}
+}
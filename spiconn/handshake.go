@@ -0,0 +1,149 @@
+// Copyright 2017 Brian Starkey <stark3y@gmail.com>
+package spiconn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sigurn/crc8"
+	"github.com/usedbytes/bot_matrix/datalink"
+)
+
+/*
+The handshake is carried on EndpointControl, using the original frame
+format (no FlagLength, CRC-8, Config.DataLen). The host sends:
+
+struct handshake_req {
+	uint8_t op; // ControlOpVersion
+	uint8_t version; // Host's ProtocolVersion
+	uint8_t datalen; // Largest datalen the host supports
+	uint8_t caps; // Host's capabilities
+};
+
+and polls with ControlOpNop until the peer replies, with the parameters
+to use from then on:
+
+struct handshake_resp {
+	uint8_t op; // ControlOpVersion
+	uint8_t version;
+	uint8_t datalen;
+	uint8_t crc; // Index into CRCTypes
+	uint8_t caps;
+};
+*/
+
+const (
+	// EndpointControl is reserved for link management
+	EndpointControl uint8 = 0xff
+
+	ControlOpNop uint8 = 0x00
+	ControlOpVersion uint8 = 0x01
+)
+
+// ProtocolVersion is the highest protocol version supported by the host
+const ProtocolVersion uint8 = 1
+
+const (
+	// CapLength means the peer understands FlagLength
+	CapLength uint8 = 1 << 0
+	// CapStream means the peer supports Streams
+	CapStream uint8 = 1 << 1
+)
+
+const hostCaps = CapLength | CapStream
+
+// CRCTypes lists the CRC algorithms which can be negotiated, indexed by
+// their value in the handshake
+var CRCTypes = []crc8.Params{
+	crc8.CRC8,
+	crc8.CRC8_CDMA2000,
+	crc8.CRC8_DARC,
+	crc8.CRC8_DVB_S2,
+	crc8.CRC8_EBU,
+	crc8.CRC8_I_CODE,
+	crc8.CRC8_ITU,
+	crc8.CRC8_MAXIM,
+	crc8.CRC8_ROHC,
+	crc8.CRC8_WCDMA,
+}
+
+// How many times to poll for the handshake response
+const handshakePolls = 8
+
+// errNoHandshake means the peer didn't answer the handshake, as firmware
+// which predates it doesn't
+var errNoHandshake = errors.New("Handshake failed: no response from peer")
+
+func findResponse(pkts []datalink.Packet) []byte {
+	for _, pkt := range pkts {
+		if pkt.Endpoint == EndpointControl &&
+		   len(pkt.Data) >= 5 && pkt.Data[0] == ControlOpVersion {
+			return pkt.Data
+		}
+	}
+	return nil
+}
+
+// handshake makes its own transfers, so that protocol errors can be told
+// from transport errors. Firmware which predates the handshake may answer
+// with anything, so protocol errors count as no response.
+func handshake(c *datalink.Connection, p *spiProto) error {
+	req := []datalink.Packet{
+		{
+			Endpoint: EndpointControl,
+			Data: []byte{ ControlOpVersion, ProtocolVersion, 0xff, hostCaps },
+		},
+	}
+	poll := []datalink.Packet{
+		{
+			Endpoint: EndpointControl,
+			Data: []byte{ ControlOpNop },
+		},
+	}
+
+	var resp []byte
+	err := c.Exclusive(context.Background(), func(transfer func(tx []byte) ([]byte, error)) error {
+		for i := 0; i <= handshakePolls && resp == nil; i++ {
+			rx, err := transfer(p.Serialise(req))
+			if err != nil {
+				return fmt.Errorf("Handshake failed: %v", err)
+			}
+			req = poll
+
+			pkts, err := p.DeSerialise(rx)
+			if err == nil {
+				resp = findResponse(pkts)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	} else if resp == nil {
+		return errNoHandshake
+	}
+
+	version, datalen, crc, caps := resp[1], resp[2], resp[3], resp[4]
+
+	if version == 0 || version > ProtocolVersion {
+		return fmt.Errorf("Incompatible peer: protocol version %d, host supports up to %d",
+				  version, ProtocolVersion)
+	}
+
+	if datalen == 0 {
+		return fmt.Errorf("Incompatible peer: invalid datalen %d", datalen)
+	}
+
+	if int(crc) >= len(CRCTypes) {
+		return fmt.Errorf("Incompatible peer: unknown CRC type %d", crc)
+	}
+
+	p.datalen = int(datalen)
+	p.crc = crc8.MakeTable(CRCTypes[crc])
+	p.lengths = caps & CapLength != 0
+	// Streams rely on FlagLength for the final frame
+	p.stream = p.lengths && caps & CapStream != 0
+	p.reset()
+
+	return nil
+}
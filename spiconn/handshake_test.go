@@ -0,0 +1,165 @@
+// Copyright 2017 Brian Starkey <stark3y@gmail.com>
+
+package spiconn
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/sigurn/crc8"
+	"github.com/usedbytes/bot_matrix/datalink"
+)
+
+func TestHandshake(t *testing.T) {
+	peer := newSimPeer()
+	peer.datalen = 16
+	peer.crc = 7
+	peer.handlers[0x10] = echo
+
+	proto := &spiProto{
+		datalen: 32,
+		crc:     crc8.MakeTable(crc8.CRC8),
+	}
+	conn := datalink.NewConnection(proto, peer)
+
+	err := handshake(conn, proto)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if proto.datalen != 16 || !proto.lengths {
+		t.Errorf("Unexpected configuration. datalen %d, lengths %v\n",
+			proto.datalen, proto.lengths)
+		return
+	}
+
+	pkt := datalink.Packet{Endpoint: 0x10, Data: []byte{0x0a, 0x0b, 0x0c}}
+	_, err = conn.Transact([]datalink.Packet{pkt})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	res, err := conn.Transact([]datalink.Packet{pkt})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(res) != 1 || !packetsEqual(pkt, res[0]) {
+		t.Errorf("Packet mismatch.\n  Expected: %v\n       Got: %v\n",
+			pkt, res)
+	}
+}
+
+func TestHandshakeIncompatible(t *testing.T) {
+	peer := newSimPeer()
+	peer.version = ProtocolVersion + 1
+
+	_, err := newConn(peer, DefaultConfig)
+	if err == nil {
+		t.Errorf("Expected error, got none.\n")
+		return
+	}
+
+	if !strings.HasPrefix(err.Error(), "Incompatible peer") {
+		t.Errorf("Unexpected error, expected 'Incompatible peer', got: %s.\n",
+			err.Error())
+	}
+
+	peer = newSimPeer()
+	peer.crc = uint8(len(CRCTypes))
+
+	_, err = newConn(peer, DefaultConfig)
+	if err == nil {
+		t.Errorf("Expected error, got none.\n")
+		return
+	}
+
+	if !strings.HasPrefix(err.Error(), "Incompatible peer") {
+		t.Errorf("Unexpected error, expected 'Incompatible peer', got: %s.\n",
+			err.Error())
+	}
+}
+
+func TestHandshakeNoResponse(t *testing.T) {
+	// Firmware which predates the handshake ignores it
+	peer := newSimPeer()
+	peer.silent = true
+	peer.handlers[0x10] = echo
+
+	conn, err := newConn(peer, DefaultConfig)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if conn.proto.lengths || conn.DataLen() != DefaultConfig.DataLen {
+		t.Errorf("Expected legacy configuration. datalen %d, lengths %v\n",
+			conn.DataLen(), conn.proto.lengths)
+		return
+	}
+
+	pkt := datalink.Packet{Endpoint: 0x10, Data: []byte{0x0a, 0x0b, 0x0c}}
+	_, err = conn.Transact([]datalink.Packet{pkt})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	res, err := conn.Transact(nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Without FlagLength, the data is padded to the frame
+	if len(res) != 1 || res[0].Endpoint != pkt.Endpoint ||
+		!bytes.HasPrefix(res[0].Data, pkt.Data) {
+		t.Errorf("Packet mismatch.\n  Expected: %v\n       Got: %v\n",
+			pkt, res)
+	}
+}
+
+// noise answers every transfer with bytes which don't form valid frames
+type noise struct {
+	err error
+}
+
+func (n *noise) Transfer(tx []byte) ([]byte, error) {
+	if n.err != nil {
+		return nil, n.err
+	}
+
+	return bytes.Repeat([]byte{0x5a}, len(tx)), nil
+}
+
+func TestHandshakeGarbage(t *testing.T) {
+	// Firmware which predates the handshake may answer with anything
+	conn, err := newConn(&noise{}, DefaultConfig)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if conn.proto.lengths || !conn.proto.legacy {
+		t.Errorf("Expected legacy configuration. legacy %v, lengths %v\n",
+			conn.proto.legacy, conn.proto.lengths)
+	}
+}
+
+func TestHandshakeTransportError(t *testing.T) {
+	_, err := newConn(&noise{ err: fmt.Errorf("Bus fault") }, DefaultConfig)
+	if err == nil {
+		t.Errorf("Expected error, got none.\n")
+		return
+	}
+
+	if !strings.HasPrefix(err.Error(), "Handshake failed") {
+		t.Errorf("Unexpected error, expected 'Handshake failed', got: %s.\n",
+			err.Error())
+	}
+}
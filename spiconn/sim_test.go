@@ -0,0 +1,260 @@
+// Copyright 2017 Brian Starkey <stark3y@gmail.com>
+
+package spiconn
+
+import (
+	"bytes"
+
+	"github.com/sigurn/crc8"
+	"github.com/usedbytes/bot_matrix/datalink"
+)
+
+// simPeer is a simulated firmware implementing datalink.Transport. Like the
+// real thing, responses are clocked out on the transfer after the request.
+type simPeer struct {
+	proto    *spiProto
+	handlers map[uint8]func(datalink.Packet) []datalink.Packet
+	queue    []datalink.Packet
+
+	// Handshake response, and the framing to switch to once it's sent
+	version, datalen, crc, caps uint8
+	silent                      bool
+	next                        *spiProto
+
+	// Stream state. Received data is collected in in, and out is sent
+	// whenever there's room.
+	window  int
+	acks    []uint8
+	inEp    uint8
+	in      map[int][]byte
+	inBase  int
+	inEnd   int
+	inDone  bool
+	inData  []byte
+	outEp   uint8
+	out     []byte
+	outSent []int
+	outAck  []bool
+	outBase int
+	outNext int
+
+	transfers int
+	// Frame corruption, by frame count in each direction
+	frameIn, frameOut     int
+	corruptIn, corruptOut func(n int) bool
+}
+
+func newSimPeer() *simPeer {
+	return &simPeer{
+		proto: &spiProto{
+			datalen: 32,
+			crc:     crc8.MakeTable(crc8.CRC8),
+		},
+		handlers: make(map[uint8]func(datalink.Packet) []datalink.Packet),
+		version:  ProtocolVersion,
+		datalen:  32,
+		caps:     CapLength | CapStream,
+		window:   DefaultStreamConfig.Window,
+		in:       make(map[int][]byte),
+		inEnd:    -1,
+	}
+}
+
+func (s *simPeer) control(pkt datalink.Packet) []datalink.Packet {
+	if s.silent || len(pkt.Data) == 0 || pkt.Data[0] != ControlOpVersion {
+		return nil
+	}
+
+	if int(s.crc) < len(CRCTypes) {
+		s.next = &spiProto{
+			id:      s.proto.id,
+			datalen: int(s.datalen),
+			crc:     crc8.MakeTable(CRCTypes[s.crc]),
+			lengths: s.caps&CapLength != 0,
+		}
+	}
+
+	return []datalink.Packet{
+		{
+			Endpoint: EndpointControl,
+			Data:     []byte{ControlOpVersion, s.version, s.datalen, s.crc, s.caps},
+		},
+	}
+}
+
+// send queues data to be streamed out on ep
+func (s *simPeer) send(ep uint8, data []byte) {
+	n := (len(data) + s.dlen() - 1) / s.dlen()
+	if n == 0 {
+		n = 1
+	}
+
+	s.outEp = ep
+	s.out = data
+	s.outSent = make([]int, n)
+	s.outAck = make([]bool, n)
+	s.outBase, s.outNext = 0, 0
+}
+
+func (s *simPeer) dlen() int {
+	return s.proto.datalen
+}
+
+func (s *simPeer) streamIn(f frame) {
+	if f.flags&FlagAck != 0 {
+		for _, seq := range f.data {
+			if seq == 0 {
+				break
+			}
+
+			i := seqIndex(s.outBase, seq)
+			if i < s.outNext {
+				s.outAck[i] = true
+			}
+		}
+
+		for s.outBase < len(s.outAck) && s.outAck[s.outBase] {
+			s.outBase++
+		}
+		return
+	}
+
+	s.inEp = f.ep
+	s.acks = append(s.acks, f.id)
+
+	i := seqIndex(s.inBase, f.id)
+	if i >= s.inBase+s.window {
+		return
+	}
+
+	if _, ok := s.in[i]; !ok {
+		s.in[i] = append([]byte{}, f.data...)
+		if f.flags&FlagEnd != 0 {
+			s.inEnd = i
+		}
+	}
+
+	for {
+		d, ok := s.in[s.inBase]
+		if !ok {
+			break
+		}
+		s.inData = append(s.inData, d...)
+		delete(s.in, s.inBase)
+		s.inBase++
+	}
+
+	if s.inEnd >= 0 && s.inBase > s.inEnd {
+		s.inDone = true
+	}
+}
+
+func (s *simPeer) streamOut(buf *bytes.Buffer, idx int) {
+	start := idx * s.dlen()
+	end := start + s.dlen()
+	if end > len(s.out) {
+		end = len(s.out)
+	}
+
+	flags := FlagStream
+	if end-start < s.dlen() {
+		flags |= FlagLength
+	}
+	if idx == len(s.outAck)-1 {
+		flags |= FlagEnd
+	}
+
+	fbuf := new(bytes.Buffer)
+	s.proto.writeFrame(fbuf, seqOf(idx), s.outEp, 0, flags, s.out[start:end])
+	s.frameOut++
+	if s.corruptOut != nil && s.corruptOut(s.frameOut) {
+		fbuf.Bytes()[hdrLen] ^= 0xff
+	}
+	buf.Write(fbuf.Bytes())
+
+	s.outSent[idx] = s.transfers
+}
+
+func (s *simPeer) Transfer(tx []byte) ([]byte, error) {
+	var pkts []datalink.Packet
+	flen := s.proto.frameLen()
+
+	for i := 0; i+flen <= len(tx); i += flen {
+		f := append([]byte{}, tx[i:i+flen]...)
+		if f[0] == 0 {
+			continue
+		}
+
+		s.frameIn++
+		if s.corruptIn != nil && s.corruptIn(s.frameIn) {
+			f[hdrLen] ^= 0xff
+		}
+
+		if f[3]&FlagStream != 0 {
+			sf, err := s.proto.readFrame(f)
+			if err == nil {
+				s.streamIn(sf)
+			}
+			continue
+		}
+
+		p, err := s.proto.DeSerialise(f)
+		if err != nil {
+			return nil, err
+		}
+		pkts = append(pkts, p...)
+	}
+
+	buf := new(bytes.Buffer)
+	if len(s.queue) > 0 {
+		buf.Write(s.proto.Serialise(s.queue))
+		s.queue = nil
+	}
+
+	for len(s.acks) > 0 && buf.Len()+flen <= len(tx) {
+		n := len(s.acks)
+		if n > s.dlen()-1 {
+			n = s.dlen() - 1
+		}
+		s.proto.id = s.proto.nextID(s.proto.id)
+		s.proto.writeFrame(buf, s.proto.id, s.inEp, 0, FlagStream|FlagAck, s.acks[:n])
+		s.acks = s.acks[n:]
+	}
+
+	for i := s.outBase; i < s.outNext && buf.Len()+flen <= len(tx); i++ {
+		if !s.outAck[i] && s.transfers-s.outSent[i] > DefaultStreamConfig.Timeout {
+			s.streamOut(buf, i)
+		}
+	}
+
+	for s.outNext < len(s.outAck) && s.outNext < s.outBase+s.window &&
+		buf.Len()+flen <= len(tx) {
+		s.streamOut(buf, s.outNext)
+		s.outNext++
+	}
+
+	rx := make([]byte, len(tx))
+	copy(rx, buf.Bytes())
+	s.transfers++
+
+	if s.next != nil {
+		s.proto, s.next = s.next, nil
+	}
+
+	for _, pkt := range pkts {
+		h := s.handlers[pkt.Endpoint]
+		if pkt.Endpoint == EndpointControl {
+			h = s.control
+		}
+
+		if h != nil {
+			s.queue = append(s.queue, h(pkt)...)
+		}
+	}
+
+	return rx, nil
+}
+
+func echo(pkt datalink.Packet) []datalink.Packet {
+	return []datalink.Packet{pkt}
+}
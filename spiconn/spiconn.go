@@ -4,6 +4,7 @@ package spiconn
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/ecc1/spi"
 	"github.com/sigurn/crc8"
@@ -21,6 +22,15 @@ struct spi_pl_packet {
 };
 */
 
+// Errors returned by DeSerialise wrap one of these, where applicable, so
+// callers can tell what kind of link error occurred with errors.Is
+var (
+	ErrCRC = errors.New("CRC error")
+	ErrLength = errors.New("Invalid length")
+	ErrShortData = errors.New("Short data")
+	ErrID = errors.New("Invalid packet ID")
+)
+
 type spiXport struct {
 	dev *spi.Device
 }
@@ -45,10 +55,73 @@ func (x *spiXport) Transfer(data []byte) ([]byte, error) {
 	return tmp, err
 }
 
+// FrameField describes one field of a frame, for tools which need to
+// decode them
+type FrameField struct {
+	Name string
+	// Size in bytes. The data field has Size 0, as it depends on the
+	// negotiated datalen.
+	Size int
+	Desc string
+}
+
+// FrameFields lists the fields of a frame, in order
+var FrameFields = []FrameField{
+	{ "id", 1, "Frame ID, or 0 for a null frame" },
+	{ "endpoint", 1, "Endpoint" },
+	{ "nparts", 1, "Frames still to come in this packet" },
+	{ "flags", 1, "Flags" },
+	{ "data", 0, "Data" },
+	{ "crc", 1, "CRC of the preceding bytes" },
+}
+
+const hdrLen = 4
+
+// FrameFlag describes one of the bits in the flags field
+type FrameFlag struct {
+	Name string
+	Mask uint8
+	Desc string
+}
+
+const (
+	// FlagLength is set on a short final frame, in which case the last
+	// byte of the data field holds the number of valid data bytes.
+	FlagLength uint8 = 1 << 0
+	// FlagStream marks frames belonging to a Stream
+	FlagStream uint8 = 1 << 1
+	// FlagAck marks a Stream acknowledgement frame. The data field holds
+	// the IDs of the frames being acknowledged, terminated by a zero.
+	FlagAck uint8 = 1 << 2
+	// FlagEnd marks the last data frame of a Stream
+	FlagEnd uint8 = 1 << 3
+)
+
+var FrameFlags = []FrameFlag{
+	{ "length", FlagLength, "Short frame, length in last data byte" },
+	{ "stream", FlagStream, "Stream frame" },
+	{ "ack", FlagAck, "Stream acknowledgement" },
+	{ "end", FlagEnd, "End of stream" },
+}
+
 type spiProto struct {
 	id uint8
 	datalen int
 	crc *crc8.Table
+	// lengths enables FlagLength, so that payload lengths are preserved.
+	// Without it, short packets are zero-padded, which is all that
+	// older firmware understands.
+	lengths bool
+	// stream is set if the peer supports Streams
+	stream bool
+	// legacy is set for firmware which predates the handshake, whose
+	// frame IDs use all 256 values
+	legacy bool
+
+	// Receive state. A packet may be split across transfers, so this
+	// is kept between calls to DeSerialise.
+	payload []byte
+	rxid, ep, nparts uint8
 }
 
 func writeBuf(buf *bytes.Buffer, v interface{}) error {
@@ -62,41 +135,107 @@ func min(a, b int) int {
 	return b
 }
 
+// writeFrame appends a single frame to into. data must fit in one frame.
+func (p *spiProto) writeFrame(into *bytes.Buffer, id, ep, nparts, flags uint8, data []byte) {
+	start := into.Len()
+
+	hdr := []byte{ id, ep, nparts, flags }
+	writeBuf(into, hdr)
+
+	writeBuf(into, data)
+	if len(data) < p.datalen {
+		// If the frame is short, we've got to pad it with zeroes.
+		// The last byte of padding holds the real length if
+		// FlagLength is set.
+		pad := make([]byte, p.datalen - len(data))
+		if flags & FlagLength != 0 {
+			pad[len(pad) - 1] = byte(len(data))
+		}
+		writeBuf(into, pad)
+	}
+
+	crc := crc8.Checksum(into.Bytes()[start:into.Len()], p.crc)
+	writeBuf(into, crc)
+}
+
+type frame struct {
+	id, ep, nparts, flags uint8
+	data []byte
+}
+
+func (p *spiProto) frameLen() int {
+	return hdrLen + p.datalen + 1
+}
+
+// readFrame parses a single frame from the start of data, which must be at
+// least frameLen() bytes long.
+func (p *spiProto) readFrame(data []byte) (frame, error) {
+	packetLen := p.frameLen()
+
+	crc := crc8.Checksum(data[:packetLen - 1], p.crc)
+	if crc != data[packetLen - 1] {
+		return frame{}, ErrCRC
+	}
+
+	f := frame{
+		id: data[0],
+		ep: data[1],
+		nparts: data[2],
+		flags: data[3],
+	}
+
+	n := p.datalen
+	if f.flags & FlagLength != 0 {
+		n = int(data[packetLen - 2])
+		if f.nparts != 0 || n >= p.datalen {
+			return frame{}, fmt.Errorf("%w %d", ErrLength, n)
+		}
+	}
+	f.data = data[hdrLen:hdrLen + n]
+
+	return f, nil
+}
+
 func (p *spiProto) serialise(into *bytes.Buffer, pkt datalink.Packet) {
-	// Slightly ugly way to handle empty packets.
-	if pkt.Data == nil || len(pkt.Data) == 0 {
-		pkt.Data = make([]byte, 1)
+	data := pkt.Data
+
+	// Without lengths, there's no way to represent an empty packet, so
+	// send a single zero byte instead.
+	if len(data) == 0 && !p.lengths {
+		data = make([]byte, 1)
 	}
 
-	nparts := uint8((len(pkt.Data) + p.datalen - 1) / p.datalen)
+	nparts := (len(data) + p.datalen - 1) / p.datalen
+	if nparts == 0 {
+		nparts = 1
+	}
 
-	for i, start := 0, 0; i < len(pkt.Data); i += p.datalen {
-		p.id += 1
+	for i := 0; nparts > 0; i += p.datalen {
+		p.id = p.nextID(p.id)
 		// nparts is actually "number of parts still to come"
 		// so decrement it before anything
 		nparts -= 1
 
-		hdr := []byte{ p.id, pkt.Endpoint, nparts, byte(0) }
-		writeBuf(into, hdr)
+		end := min(len(data), i + p.datalen)
 
-		end := min(len(pkt.Data), i + p.datalen)
-		writeBuf(into, pkt.Data[i:end])
-		if end - i < p.datalen {
-			// If the last packet is short, we've got to pad it with
-			// zeroes.
-			writeBuf(into, make([]byte, p.datalen - (end - i)))
+		flags := byte(0)
+		if end - i < p.datalen && p.lengths {
+			flags |= FlagLength
 		}
 
-		crc := crc8.Checksum(into.Bytes()[start:into.Len()], p.crc)
-		writeBuf(into, crc)
-
-		start = into.Len()
+		p.writeFrame(into, p.id, pkt.Endpoint, byte(nparts), flags, data[i:end])
 	}
 }
 
+// Serialise with no packets gives a single null frame, so that
+// transacting nothing still polls the peer for data.
 func (p *spiProto) Serialise(pkts []datalink.Packet) []byte {
 	buf := new(bytes.Buffer)
 
+	if len(pkts) == 0 {
+		return make([]byte, p.frameLen())
+	}
+
 	for _, pkt := range pkts {
 		p.serialise(buf, pkt)
 	}
@@ -104,74 +243,195 @@ func (p *spiProto) Serialise(pkts []datalink.Packet) []byte {
 	return buf.Bytes()
 }
 
+// Null frames are all zero, and carry no data. They're used to pad out a
+// transfer when one side has nothing to send. Frame IDs skip 0 when they
+// wrap, so that the header of a real frame is never zero, except with
+// legacy firmware.
+func (p *spiProto) nextID(id uint8) uint8 {
+	id += 1
+	if id == 0 && !p.legacy {
+		id = 1
+	}
+	return id
+}
+
+func isNull(frame []byte) bool {
+	for _, b := range frame {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *spiProto) reset() {
+	p.payload = nil
+}
+
 func (p *spiProto) DeSerialise(data []byte) ([]datalink.Packet, error) {
-	hdrLen := 4
-	packetLen := p.datalen + hdrLen + 1
+	packetLen := p.frameLen()
 
 	pkts := make([]datalink.Packet, 0, len(data) / packetLen)
+	seen := false
 
-	var payload []byte
-	var id, ep, nparts byte
-
-	for i := 0; i < len(data); {
+	for i := 0; i < len(data); i += packetLen {
 		if len(data) < i + packetLen {
-			return pkts, fmt.Errorf("Short data. Have %d bytes, need %d",
+			p.reset()
+			return pkts, fmt.Errorf("%w. Have %d bytes, need %d", ErrShortData,
 						len(data), i + packetLen)
 		}
 
-		crc := crc8.Checksum(data[i:i + packetLen - 1], p.crc)
-		if crc != data[i + packetLen - 1] {
-			return pkts, fmt.Errorf("CRC error in packet %d", len(pkts) + 1)
+		if isNull(data[i:i + packetLen]) {
+			continue
 		}
 
-		if payload == nil {
-			payload = make([]byte, 0, int(data[i + 2]) * p.datalen)
-		} else {
-			if data[i] != id + 1 {
-				return pkts, fmt.Errorf("Invalid packet ID. Expected %d got %d", id + 1, data[i])
-			}
+		f, err := p.readFrame(data[i:])
+		if err != nil {
+			p.reset()
+			return pkts, fmt.Errorf("%w in packet %d", err, len(pkts) + 1)
+		}
+
+		// IDs must be sequential within a transfer, and across
+		// transfers if a packet was split between them.
+		if (seen || p.payload != nil) && f.id != p.nextID(p.rxid) {
+			p.reset()
+			return pkts, fmt.Errorf("%w. Expected %d got %d", ErrID, p.nextID(p.rxid), f.id)
+		}
+		seen = true
 
-			if data[i + 1] != ep {
-				return pkts, fmt.Errorf("Invalid Endpoint. Expected %d got %d", ep, data[i + 1])
+		if p.payload == nil {
+			p.payload = make([]byte, 0, (int(f.nparts) + 1) * p.datalen)
+		} else {
+			if f.ep != p.ep {
+				p.reset()
+				return pkts, fmt.Errorf("Invalid Endpoint. Expected %d got %d", p.ep, f.ep)
 			}
 
-			if data[i + 2] != nparts - 1 {
-				return pkts, fmt.Errorf("Invalid nparts. Expected %d got %d", nparts - 1, data[i + 2])
+			if f.nparts != p.nparts - 1 {
+				p.reset()
+				return pkts, fmt.Errorf("Invalid nparts. Expected %d got %d", p.nparts - 1, f.nparts)
 			}
 		}
 
-		id = data[i]
-		ep = data[i + 1]
-		nparts = data[i + 2]
-		payload = append(payload, data[i + hdrLen:i + packetLen - 1]...)
+		p.rxid = f.id
+		p.ep = f.ep
+		p.nparts = f.nparts
+		p.payload = append(p.payload, f.data...)
 
-		if nparts == 0 {
+		if p.nparts == 0 {
 			pkts = append(pkts, datalink.Packet{
-				Endpoint: ep,
-				Data: payload,
+				Endpoint: p.ep,
+				Data: p.payload,
 			})
-			payload = nil
+			p.reset()
 		}
-
-		i += packetLen
 	}
 
 	return pkts, nil
 }
 
-func NewSPIConn(device string) (datalink.Transactor, error) {
-	proto := spiProto{
+// Config holds the parameters for an SPI connection
+type Config struct {
+	// Speed is the SPI clock frequency, in Hz
+	Speed int
+	// DataLen is the number of data bytes in each frame. If Handshake is
+	// set, this is only used for the handshake itself.
+	DataLen int
+	// Legacy disables FlagLength, for firmware which doesn't support it
+	Legacy bool
+	// Handshake queries the peer's protocol parameters on connect, and
+	// configures the connection to match. If the peer doesn't answer, the
+	// connection falls back to the legacy protocol.
+	Handshake bool
+	// WrapTransport, if set, is applied to the SPI transport before it is
+	// used, e.g. to capture traffic
+	WrapTransport func(datalink.Transport) datalink.Transport
+}
+
+var DefaultConfig = Config{
+	Speed: 1000000,
+	DataLen: 32,
+	Handshake: true,
+}
+
+// LegacyConfig is suitable for firmware which predates the handshake
+var LegacyConfig = Config{
+	Speed: 1000000,
+	DataLen: 32,
+	Legacy: true,
+}
+
+// SPIConn is a datalink.Connection over spidev, which also supports
+// streaming bulk transfers.
+type SPIConn struct {
+	*datalink.Connection
+	proto *spiProto
+}
+
+func newConn(xport datalink.Transport, cfg Config) (*SPIConn, error) {
+	proto := &spiProto{
 		id: 0,
-		datalen: 32,
+		datalen: cfg.DataLen,
 		crc: crc8.MakeTable(crc8.CRC8),
+		lengths: !cfg.Legacy && !cfg.Handshake,
+		legacy: cfg.Legacy,
 	}
 
-	xport, err := newXport(device, 1000000)
+	conn := &SPIConn{
+		Connection: datalink.NewConnection(proto, xport),
+		proto: proto,
+	}
+
+	if cfg.Handshake {
+		err := handshake(conn.Connection, proto)
+		if errors.Is(err, errNoHandshake) {
+			proto.lengths = false
+			proto.legacy = true
+			proto.reset()
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+// NewSPIConnTransport creates an SPIConn over any Transport, such as a
+// capture.Replay
+func NewSPIConnTransport(xport datalink.Transport, cfg Config) (*SPIConn, error) {
+	if cfg.WrapTransport != nil {
+		xport = cfg.WrapTransport(xport)
+	}
+
+	return newConn(xport, cfg)
+}
+
+func NewSPIConnConfig(device string, cfg Config) (*SPIConn, error) {
+	xport, err := newXport(device, cfg.Speed)
 	if err != nil {
 		return nil, err
 	}
 
-	conn := datalink.NewConnection(&proto, xport)
+	return NewSPIConnTransport(xport, cfg)
+}
 
-	return conn, nil
+// FrameLen returns the length in bytes of each frame on the wire, which
+// may change during the handshake
+func (c *SPIConn) FrameLen() int {
+	return c.proto.frameLen()
+}
+
+// DataLen returns the number of data bytes carried by each frame
+func (c *SPIConn) DataLen() int {
+	return c.proto.datalen
+}
+
+// MaxPacketLen returns the largest packet which can be sent, limited by
+// the number of continuation frames nparts can count
+func (c *SPIConn) MaxPacketLen() int {
+	return 256 * c.proto.datalen
+}
+
+func NewSPIConn(device string) (*SPIConn, error) {
+	return NewSPIConnConfig(device, DefaultConfig)
 }
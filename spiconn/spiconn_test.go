@@ -326,6 +326,65 @@ func TestDeSerialiseBadCRC(t *testing.T) {
 	}
 }
 
+func TestDeSerialiseZeroByteBadCRC(t *testing.T) {
+	proto := &spiProto{
+		id:      0,
+		datalen: 4,
+		crc:     crc8.MakeTable(crc8.CRC8),
+	}
+
+	// Only an all-zero frame is null; anything else must pass the CRC
+	data := []byte{0x00, 0x37, 0x00, 0x00, 0x0a, 0x0b, 0x0c, 0x0d}
+	data = append(data, crc8.Checksum(data, proto.crc) - 1)
+
+	_, err := proto.DeSerialise(data)
+	if err == nil {
+		t.Errorf("Expected error, got none.\n")
+		return
+	}
+
+	if !strings.HasPrefix(err.Error(), "CRC error") {
+		t.Errorf("Unexpected error, expected 'CRC error', got: %s.\n",
+			 err.Error())
+	}
+}
+
+func TestDeSerialiseLegacyIDWrap(t *testing.T) {
+	proto := &spiProto{
+		id:      0,
+		datalen: 4,
+		crc:     crc8.MakeTable(crc8.CRC8),
+		legacy:  true,
+	}
+
+	// Legacy firmware uses ID 0 when its IDs wrap
+	data := []byte{0xff, 0x37, 0x01, 0x00, 0x0a, 0x0b, 0x0c, 0x0d}
+	data = append(data, crc8.Checksum(data, proto.crc))
+	data = append(data, []byte{0x00, 0x37, 0x00, 0x00, 0x0e, 0x0f, 0x10, 0x11}...)
+	data = append(data, crc8.Checksum(data[9:], proto.crc))
+	expected := datalink.Packet{
+		Endpoint: 0x37,
+		Data:     []byte{0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10, 0x11},
+	}
+
+	pkts, err := proto.DeSerialise(data)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	if len(pkts) != 1 {
+		t.Errorf("Unexpected number of packets. Expected: %d, got: %d\n",
+			 1, len(pkts))
+		return
+	}
+
+	if !packetsEqual(expected, pkts[0]) {
+		t.Errorf("Packet mismatch.\n  Expected: %v\n       Got: %v\n",
+			 expected, pkts[0])
+	}
+}
+
 func TestDeSerialiseMultiFrame(t *testing.T) {
 	proto := &spiProto{
 		id:      0,
@@ -580,11 +639,166 @@ func TestDeSerialiseSplitFrames(t *testing.T) {
 	}
 }
 
+func TestInnerSerialiseLengths(t *testing.T) {
+	proto := &spiProto{
+		id:      0,
+		datalen: 4,
+		crc:     crc8.MakeTable(crc8.CRC8),
+		lengths: true,
+	}
+
+	buf := new(bytes.Buffer)
+	pkt := datalink.Packet{
+		Endpoint: 0x37,
+		Data:     []byte{0x0a, 0x0b, 0x0c, 0x0d, 0x0e},
+	}
+	expect := []byte{0x01, 0x37, 0x01, 0x00, 0x0a, 0x0b, 0x0c, 0x0d}
+	expect = append(expect, crc8.Checksum(expect, proto.crc))
+	expect = append(expect, []byte{0x02, 0x37, 0x00, FlagLength, 0x0e, 0x00, 0x00, 0x01}...)
+	expect = append(expect, crc8.Checksum(expect[9:], proto.crc))
+
+	proto.serialise(buf, pkt)
+	if !bytes.Equal(buf.Bytes(), expect) {
+		t.Errorf("Data mismatch:\n  Expected: %x\n       Got: %x\n",
+			expect, buf.Bytes())
+	}
+
+	buf.Reset()
+	pkt = datalink.Packet{
+		Endpoint: 0x37,
+		Data:     []byte{},
+	}
+	expect = []byte{0x03, 0x37, 0x00, FlagLength, 0x00, 0x00, 0x00, 0x00}
+	expect = append(expect, crc8.Checksum(expect, proto.crc))
+
+	proto.serialise(buf, pkt)
+	if !bytes.Equal(buf.Bytes(), expect) {
+		t.Errorf("Data mismatch:\n  Expected: %x\n       Got: %x\n",
+			expect, buf.Bytes())
+	}
+}
+
+func TestLengthsRoundTrip(t *testing.T) {
+	proto := &spiProto{
+		id:      0,
+		datalen: 4,
+		crc:     crc8.MakeTable(crc8.CRC8),
+		lengths: true,
+	}
+
+	pkts := []datalink.Packet{
+		{ Endpoint: 0x01, Data: []byte{} },
+		{ Endpoint: 0x02, Data: []byte{0x0a} },
+		{ Endpoint: 0x03, Data: []byte{0x0a, 0x0b, 0x0c} },
+		{ Endpoint: 0x04, Data: []byte{0x0a, 0x0b, 0x0c, 0x0d} },
+		{ Endpoint: 0x05, Data: []byte{0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f} },
+	}
+
+	res, err := proto.DeSerialise(proto.Serialise(pkts))
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	if len(res) != len(pkts) {
+		t.Errorf("Unexpected number of packets. Expected: %d, got: %d\n",
+			 len(pkts), len(res))
+		return
+	}
+
+	for i, p := range res {
+		if !packetsEqual(pkts[i], p) {
+			t.Errorf("Packet %d mismatch.\n  Expected: %v\n       Got: %v\n",
+				 i, pkts[i], p)
+		}
+	}
+}
+
+func TestDeSerialiseBadLength(t *testing.T) {
+	proto := &spiProto{
+		id:      0,
+		datalen: 4,
+		crc:     crc8.MakeTable(crc8.CRC8),
+	}
+
+	data := []byte{0x03, 0x37, 0x00, FlagLength, 0x0a, 0x0b, 0x0c, 0x04}
+	data = append(data, crc8.Checksum(data, proto.crc))
+
+	_, err := proto.DeSerialise(data)
+	if err == nil {
+		t.Errorf("Expected error, got none.\n")
+		return
+	}
+
+	if !strings.HasPrefix(err.Error(), "Invalid length") {
+		t.Errorf("Unexpected error, expected 'Invalid length', got: %s.\n",
+			 err.Error())
+		return
+	}
+}
+
+func TestSerialiseNothing(t *testing.T) {
+	proto := &spiProto{
+		id:      0,
+		datalen: 4,
+		crc:     crc8.MakeTable(crc8.CRC8),
+	}
+
+	data := proto.Serialise(nil)
+	if !bytes.Equal(data, make([]byte, proto.frameLen())) {
+		t.Errorf("Expected a null frame, got: %v\n", data)
+	}
+
+	pkts, err := proto.DeSerialise(data)
+	if err != nil || len(pkts) != 0 {
+		t.Errorf("Expected no packets, got %v (%v)\n", pkts, err)
+	}
+}
+
+func TestFrameFields(t *testing.T) {
+	proto := &spiProto{
+		id:      0,
+		datalen: 4,
+		crc:     crc8.MakeTable(crc8.CRC8),
+	}
+
+	buf := new(bytes.Buffer)
+	proto.writeFrame(buf, 0x01, 0x02, 0x03, 0x04, []byte{0x05, 0x05, 0x05, 0x05})
+
+	off := 0
+	for i, f := range FrameFields {
+		size := f.Size
+		if size == 0 {
+			size = proto.datalen
+		}
+
+		if off+size > buf.Len() {
+			t.Errorf("Field %s overflows the frame\n", f.Name)
+			return
+		}
+
+		for _, b := range buf.Bytes()[off : off+size] {
+			if f.Name != "crc" && b != byte(i+1) {
+				t.Errorf("Field %s at wrong offset %d\n", f.Name, off)
+			}
+		}
+
+		if f.Name == "data" && off != hdrLen {
+			t.Errorf("Data at offset %d, expected %d\n", off, hdrLen)
+		}
+
+		off += size
+	}
+
+	if off != proto.frameLen() {
+		t.Errorf("Fields cover %d bytes, frame is %d\n", off, proto.frameLen())
+	}
+}
+
 var devname string
 
 func init() {
 	flag.StringVar(&devname, "devname", "", "spidev device to use for loopback test")
-	flag.Parse()
 }
 
 func TestSpiconnConnection(t *testing.T) {
@@ -0,0 +1,364 @@
+// Copyright 2017 Brian Starkey <stark3y@gmail.com>
+package spiconn
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+)
+
+/*
+A Stream moves a large buffer to or from a single endpoint, without
+waiting for a response to each transfer. Data frames have FlagStream set,
+and use the frame ID as a sequence number, starting from 1 (skipping 0,
+like all frame IDs). nparts is always 0, and the last frame has FlagEnd.
+
+The receiver acknowledges each good data frame with a FlagStream|FlagAck
+frame on the same endpoint, whose data holds the IDs being acknowledged.
+Up to Window frames can be unacknowledged at once. Frames which aren't
+acknowledged within Timeout transfers are sent again.
+*/
+
+type StreamConfig struct {
+	// Window is the maximum number of unacknowledged frames. Must be
+	// from 1 to 127.
+	Window int
+	// Timeout is the number of transfers to wait for an acknowledgement
+	// before retransmitting a frame. Must be at least 1.
+	Timeout int
+	// MaxIdle is the number of transfers without progress after which
+	// the stream is abandoned. Must be at least 1.
+	MaxIdle int
+}
+
+var DefaultStreamConfig = StreamConfig{
+	Window: 16,
+	Timeout: 2,
+	MaxIdle: 32,
+}
+
+type StreamStats struct {
+	// Frames and Bytes count the data successfully delivered
+	Frames int
+	Bytes int
+	Transfers int
+	Retransmits int
+	// Errors counts received frames which were discarded
+	Errors int
+	Elapsed time.Duration
+}
+
+// Throughput returns the delivered data rate in bytes per second
+func (s StreamStats) Throughput() float64 {
+	if s.Elapsed <= 0 {
+		return 0
+	}
+	return float64(s.Bytes) / s.Elapsed.Seconds()
+}
+
+type Stream struct {
+	conn *SPIConn
+	ep uint8
+	cfg StreamConfig
+}
+
+func (c *SPIConn) Stream(ep uint8, cfg StreamConfig) *Stream {
+	return &Stream{ c, ep, cfg }
+}
+
+// seqOf returns the frame ID used for the idx'th frame of a stream
+func seqOf(idx int) uint8 {
+	return uint8(idx % 255) + 1
+}
+
+// seqIndex returns the frame index for seq, assuming it is at or after
+// base. The result is only meaningful within a window of base.
+func seqIndex(base int, seq uint8) int {
+	return base + (int(seq) - int(seqOf(base)) + 255) % 255
+}
+
+// transferFunc makes one transfer, while a Stream has sole use of the
+// Connection
+type transferFunc func(tx []byte) ([]byte, error)
+
+func (s *Stream) check() error {
+	if !s.conn.proto.stream {
+		return fmt.Errorf("Peer doesn't support streams")
+	}
+	if s.cfg.Window < 1 || s.cfg.Window > 127 {
+		return fmt.Errorf("Invalid stream window %d, must be 1 to 127", s.cfg.Window)
+	}
+	if s.cfg.Timeout < 1 {
+		return fmt.Errorf("Invalid stream timeout %d, must be at least 1", s.cfg.Timeout)
+	}
+	if s.cfg.MaxIdle < 1 {
+		return fmt.Errorf("Invalid stream idle limit %d, must be at least 1", s.cfg.MaxIdle)
+	}
+	// Acknowledgement frames need room for an ID and the terminator
+	if s.conn.proto.datalen < 2 {
+		return fmt.Errorf("Data length %d too short for streams", s.conn.proto.datalen)
+	}
+	return nil
+}
+
+// frames calls fn for each valid non-null frame in data
+func (s *Stream) frames(data []byte, stats *StreamStats, fn func(f frame)) {
+	p := s.conn.proto
+	for i := 0; i + p.frameLen() <= len(data); i += p.frameLen() {
+		if isNull(data[i:i + p.frameLen()]) {
+			continue
+		}
+
+		f, err := p.readFrame(data[i:])
+		if err != nil {
+			stats.Errors++
+			continue
+		}
+
+		if f.ep == s.ep && f.flags & FlagStream != 0 {
+			fn(f)
+		}
+	}
+}
+
+// Write sends data to the stream's endpoint. Other transactions on the
+// connection wait until it's finished.
+func (s *Stream) Write(data []byte) (StreamStats, error) {
+	var stats StreamStats
+	if err := s.check(); err != nil {
+		return stats, err
+	}
+
+	err := s.conn.Exclusive(context.Background(), func(transfer func([]byte) ([]byte, error)) error {
+		var err error
+		stats, err = s.write(transfer, data)
+		return err
+	})
+
+	return stats, err
+}
+
+func (s *Stream) write(transfer transferFunc, data []byte) (StreamStats, error) {
+	var stats StreamStats
+	p := s.conn.proto
+
+	start := time.Now()
+	defer func() {
+		stats.Elapsed = time.Since(start)
+	}()
+
+	n := (len(data) + p.datalen - 1) / p.datalen
+	if n == 0 {
+		n = 1
+	}
+
+	sentAt := make([]int, n)
+	acked := make([]bool, n)
+	base, next, idle := 0, 0, 0
+
+	send := func(buf *bytes.Buffer, idx int) {
+		start := idx * p.datalen
+		end := min(len(data), start + p.datalen)
+
+		flags := FlagStream
+		if end - start < p.datalen {
+			flags |= FlagLength
+		}
+		if idx == n - 1 {
+			flags |= FlagEnd
+		}
+
+		p.writeFrame(buf, seqOf(idx), s.ep, 0, flags, data[start:end])
+		sentAt[idx] = stats.Transfers
+	}
+
+	for base < n {
+		buf := new(bytes.Buffer)
+		nframes := 0
+
+		for i := base; i < next && nframes < s.cfg.Window; i++ {
+			if !acked[i] && stats.Transfers - sentAt[i] > s.cfg.Timeout {
+				send(buf, i)
+				stats.Retransmits++
+				s.conn.Retried(s.ep)
+				nframes++
+			}
+		}
+
+		for next < n && next < base + s.cfg.Window && nframes < s.cfg.Window {
+			send(buf, next)
+			next++
+			nframes++
+		}
+
+		if nframes == 0 {
+			// Nothing to send, but we still need to clock out the
+			// acknowledgements
+			buf.Write(make([]byte, p.frameLen()))
+		}
+
+		rx, err := transfer(buf.Bytes())
+		stats.Transfers++
+		if err != nil {
+			return stats, err
+		}
+
+		progress := false
+		s.frames(rx, &stats, func(f frame) {
+			if f.flags & FlagAck == 0 {
+				return
+			}
+
+			for _, seq := range f.data {
+				if seq == 0 {
+					break
+				}
+
+				i := seqIndex(base, seq)
+				if i < next && !acked[i] {
+					acked[i] = true
+					progress = true
+					stats.Frames++
+					stats.Bytes += min(len(data), (i + 1) * p.datalen) - i * p.datalen
+				}
+			}
+		})
+
+		for base < n && acked[base] {
+			base++
+		}
+
+		if progress {
+			idle = 0
+		} else if idle++; idle > s.cfg.MaxIdle {
+			return stats, fmt.Errorf("Stream stalled. %d of %d frames acknowledged", base, n)
+		}
+	}
+
+	return stats, nil
+}
+
+// writeAcks appends acknowledgement frames for acks to buf, returning the
+// number of frames written
+func (s *Stream) writeAcks(buf *bytes.Buffer, acks []uint8) int {
+	p := s.conn.proto
+	nframes := 0
+
+	for len(acks) > 0 {
+		// Leave room for the terminator
+		n := min(len(acks), p.datalen - 1)
+		p.id = p.nextID(p.id)
+		p.writeFrame(buf, p.id, s.ep, 0, FlagStream | FlagAck, acks[:n])
+		acks = acks[n:]
+		nframes++
+	}
+
+	return nframes
+}
+
+// Read receives data from the stream's endpoint, until the peer sends
+// FlagEnd. The peer must already have been told to start sending. Other
+// transactions on the connection wait until it's finished.
+func (s *Stream) Read() ([]byte, StreamStats, error) {
+	var stats StreamStats
+	if err := s.check(); err != nil {
+		return nil, stats, err
+	}
+
+	var data []byte
+	err := s.conn.Exclusive(context.Background(), func(transfer func([]byte) ([]byte, error)) error {
+		var err error
+		data, stats, err = s.read(transfer)
+		return err
+	})
+
+	return data, stats, err
+}
+
+func (s *Stream) read(transfer transferFunc) ([]byte, StreamStats, error) {
+	var stats StreamStats
+	p := s.conn.proto
+
+	start := time.Now()
+	defer func() {
+		stats.Elapsed = time.Since(start)
+	}()
+
+	received := make(map[int][]byte)
+	var data []byte
+	var acks []uint8
+	base, end, idle := 0, -1, 0
+
+	for end < 0 || base <= end {
+		buf := new(bytes.Buffer)
+		nframes := s.writeAcks(buf, acks)
+		acks = nil
+
+		// Give the peer room to send a full window
+		for ; nframes < s.cfg.Window; nframes++ {
+			buf.Write(make([]byte, p.frameLen()))
+		}
+
+		rx, err := transfer(buf.Bytes())
+		stats.Transfers++
+		if err != nil {
+			return data, stats, err
+		}
+
+		progress := false
+		s.frames(rx, &stats, func(f frame) {
+			if f.flags & FlagAck != 0 {
+				return
+			}
+
+			// Always acknowledge, in case a previous ack was lost
+			acks = append(acks, f.id)
+
+			i := seqIndex(base, f.id)
+			if i >= base + s.cfg.Window {
+				// Stale retransmission
+				return
+			}
+
+			if _, ok := received[i]; !ok {
+				received[i] = append([]byte{}, f.data...)
+				if f.flags & FlagEnd != 0 {
+					end = i
+				}
+				progress = true
+			}
+		})
+
+		for {
+			d, ok := received[base]
+			if !ok {
+				break
+			}
+
+			data = append(data, d...)
+			delete(received, base)
+			stats.Frames++
+			stats.Bytes += len(d)
+			base++
+		}
+
+		if progress {
+			idle = 0
+		} else if idle++; idle > s.cfg.MaxIdle {
+			return data, stats, fmt.Errorf("Stream stalled after %d frames", base)
+		}
+	}
+
+	// Send the final acknowledgements
+	buf := new(bytes.Buffer)
+	if s.writeAcks(buf, acks) > 0 {
+		_, err := transfer(buf.Bytes())
+		stats.Transfers++
+		if err != nil {
+			return data, stats, err
+		}
+	}
+
+	return data, stats, nil
+}
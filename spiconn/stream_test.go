@@ -0,0 +1,282 @@
+// Copyright 2017 Brian Starkey <stark3y@gmail.com>
+
+package spiconn
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/usedbytes/bot_matrix/datalink"
+)
+
+type retryCounter struct {
+	retries map[uint8]int
+}
+
+func (r *retryCounter) OnSerialise(tx []datalink.Packet, data []byte) { }
+func (r *retryCounter) OnTransfer(tx, rx []byte, elapsed time.Duration) { }
+func (r *retryCounter) OnDeSerialise(data []byte, rx []datalink.Packet) { }
+func (r *retryCounter) OnError(err error) { }
+
+func (r *retryCounter) OnRetry(ep uint8) {
+	r.retries[ep]++
+}
+
+func streamData(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func TestStreamWrite(t *testing.T) {
+	peer := newSimPeer()
+	peer.datalen = 8
+	peer.corruptIn = func(n int) bool {
+		return n%13 == 5
+	}
+
+	conn, err := newConn(peer, DefaultConfig)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	rc := &retryCounter{ map[uint8]int{} }
+	conn.AddObserver(rc)
+	before := conn.Stats().Transfers
+
+	// Long enough for the frame IDs to wrap
+	data := streamData(3001)
+	stats, err := conn.Stream(0x20, DefaultStreamConfig).Write(data)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if n := conn.Stats().Transfers - before; n != uint64(stats.Transfers) {
+		t.Errorf("Connection counted %d transfers, stream made %d\n", n, stats.Transfers)
+	}
+
+	if !peer.inDone || !bytes.Equal(peer.inData, data) {
+		t.Errorf("Data mismatch. Expected %d bytes, got %d (done: %v)\n",
+			len(data), len(peer.inData), peer.inDone)
+		return
+	}
+
+	if stats.Bytes != len(data) || stats.Frames != 376 {
+		t.Errorf("Unexpected stats. Expected %d bytes in %d frames, got %d in %d\n",
+			len(data), 376, stats.Bytes, stats.Frames)
+	}
+
+	if stats.Retransmits == 0 {
+		t.Errorf("Expected retransmissions, got none.\n")
+	}
+
+	if rc.retries[0x20] != stats.Retransmits {
+		t.Errorf("Observer saw %d retries, expected %d\n",
+			rc.retries[0x20], stats.Retransmits)
+	}
+}
+
+func TestStreamWriteEmpty(t *testing.T) {
+	peer := newSimPeer()
+
+	conn, err := newConn(peer, DefaultConfig)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = conn.Stream(0x20, DefaultStreamConfig).Write(nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !peer.inDone || len(peer.inData) != 0 {
+		t.Errorf("Expected empty stream, got %d bytes (done: %v)\n",
+			len(peer.inData), peer.inDone)
+	}
+}
+
+func TestStreamRead(t *testing.T) {
+	peer := newSimPeer()
+	peer.datalen = 8
+	peer.corruptOut = func(n int) bool {
+		return n%11 == 3
+	}
+
+	conn, err := newConn(peer, DefaultConfig)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	data := streamData(2045)
+	peer.send(0x21, data)
+
+	res, stats, err := conn.Stream(0x21, DefaultStreamConfig).Read()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !bytes.Equal(res, data) {
+		t.Errorf("Data mismatch. Expected %d bytes, got %d\n",
+			len(data), len(res))
+		return
+	}
+
+	if stats.Errors == 0 {
+		t.Errorf("Expected errors, got none.\n")
+	}
+
+	if peer.outBase != len(peer.outAck) {
+		t.Errorf("Peer has unacknowledged frames. %d of %d acknowledged\n",
+			peer.outBase, len(peer.outAck))
+	}
+}
+
+func TestStreamUnsupported(t *testing.T) {
+	peer := newSimPeer()
+	peer.caps = CapLength
+
+	conn, err := newConn(peer, DefaultConfig)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = conn.Stream(0x20, DefaultStreamConfig).Write([]byte{1})
+	if err == nil {
+		t.Errorf("Expected error, got none.\n")
+		return
+	}
+
+	if !strings.HasPrefix(err.Error(), "Peer doesn't support streams") {
+		t.Errorf("Unexpected error, expected 'Peer doesn't support streams', got: %s.\n",
+			err.Error())
+	}
+}
+
+// overlapDetector is a Transport which records whether any of its
+// Transfers overlapped
+type overlapDetector struct {
+	datalink.Transport
+	busy, overlaps int32
+}
+
+func (o *overlapDetector) Transfer(tx []byte) ([]byte, error) {
+	if !atomic.CompareAndSwapInt32(&o.busy, 0, 1) {
+		atomic.AddInt32(&o.overlaps, 1)
+		return o.Transport.Transfer(tx)
+	}
+	defer atomic.StoreInt32(&o.busy, 0)
+
+	time.Sleep(10 * time.Microsecond)
+	return o.Transport.Transfer(tx)
+}
+
+func TestStreamConcurrent(t *testing.T) {
+	peer := newSimPeer()
+	peer.datalen = 8
+	od := &overlapDetector{ Transport: peer }
+
+	conn, err := newConn(od, DefaultConfig)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			conn.Transact(nil)
+		}
+	}()
+
+	data := streamData(500)
+	_, err = conn.Stream(0x20, DefaultStreamConfig).Write(data)
+	wg.Wait()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !bytes.Equal(peer.inData, data) {
+		t.Errorf("Data mismatch. Expected %d bytes, got %d\n", len(data), len(peer.inData))
+	}
+
+	if od.overlaps != 0 {
+		t.Errorf("%d transfers overlapped\n", od.overlaps)
+	}
+}
+
+func TestStreamWindow(t *testing.T) {
+	conn, err := newConn(newSimPeer(), DefaultConfig)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, w := range []int{ 0, -1, 128 } {
+		cfg := DefaultStreamConfig
+		cfg.Window = w
+
+		_, err = conn.Stream(0x20, cfg).Write([]byte{ 1 })
+		if err == nil || !strings.HasPrefix(err.Error(), "Invalid stream window") {
+			t.Errorf("Window %d: expected 'Invalid stream window', got: %v\n", w, err)
+		}
+
+		_, _, err = conn.Stream(0x20, cfg).Read()
+		if err == nil || !strings.HasPrefix(err.Error(), "Invalid stream window") {
+			t.Errorf("Window %d: expected 'Invalid stream window', got: %v\n", w, err)
+		}
+	}
+}
+
+func TestStreamConfig(t *testing.T) {
+	conn, err := newConn(newSimPeer(), DefaultConfig)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	tests := []struct{
+		mod func(cfg *StreamConfig)
+		msg string
+	}{
+		{ func(cfg *StreamConfig) { cfg.Timeout = 0 }, "Invalid stream timeout" },
+		{ func(cfg *StreamConfig) { cfg.MaxIdle = -1 }, "Invalid stream idle limit" },
+	}
+
+	for _, tc := range tests {
+		cfg := DefaultStreamConfig
+		tc.mod(&cfg)
+
+		_, err = conn.Stream(0x20, cfg).Write([]byte{ 1 })
+		if err == nil || !strings.HasPrefix(err.Error(), tc.msg) {
+			t.Errorf("Expected '%s', got: %v\n", tc.msg, err)
+		}
+
+		_, _, err = conn.Stream(0x20, cfg).Read()
+		if err == nil || !strings.HasPrefix(err.Error(), tc.msg) {
+			t.Errorf("Expected '%s', got: %v\n", tc.msg, err)
+		}
+	}
+
+	// One byte frames leave no room for acknowledgements
+	conn.proto.datalen = 1
+	_, _, err = conn.Stream(0x20, DefaultStreamConfig).Read()
+	if err == nil || !strings.HasPrefix(err.Error(), "Data length 1 too short") {
+		t.Errorf("Expected 'Data length 1 too short', got: %v\n", err)
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2017 Brian Starkey <stark3y@gmail.com>
+package datalink
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LatencyStats summarises the time taken by recent transfers
+type LatencyStats struct {
+	// Samples is the number of transfers the percentiles are taken from
+	Samples int
+	P50, P90, P99, Max time.Duration
+}
+
+// Stats describes the health of a Connection since it was created
+type Stats struct {
+	// Transfers counts calls to the Transport, including those made by
+	// streams and retries, so it can exceed the number of transactions
+	Transfers uint64
+	// TransferErrors are returned by the Transport, and ProtocolErrors
+	// by the Protocol, e.g. CRC errors
+	TransferErrors uint64
+	ProtocolErrors uint64
+	// Retries counts retransmissions done by the Protocol
+	Retries uint64
+	// Packet payload bytes sent and received
+	TxBytes, RxBytes uint64
+	// BusTime is the total time spent in the Transport
+	BusTime time.Duration
+	Uptime time.Duration
+	Latency LatencyStats
+}
+
+// Throughput returns the payload data rate in bytes per second, while
+// the bus is busy
+func (s Stats) Throughput() float64 {
+	if s.BusTime <= 0 {
+		return 0
+	}
+	return float64(s.TxBytes + s.RxBytes) / s.BusTime.Seconds()
+}
+
+// StatsSource is implemented by anything which can report Stats, like
+// Connection
+type StatsSource interface {
+	Stats() Stats
+}
+
+// Percentiles are calculated from this many of the most recent transfers
+const latencySamples = 1024
+
+// statsRecorder is an Observer which Connection always has attached
+type statsRecorder struct {
+	mu sync.Mutex
+	stats Stats
+	created time.Time
+
+	samples []time.Duration
+	next int
+}
+
+func newStatsRecorder() *statsRecorder {
+	return &statsRecorder{
+		created: time.Now(),
+		samples: make([]time.Duration, 0, latencySamples),
+	}
+}
+
+func (s *statsRecorder) OnSerialise(tx []Packet, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, p := range tx {
+		s.stats.TxBytes += uint64(len(p.Data))
+	}
+}
+
+func (s *statsRecorder) OnTransfer(tx, rx []byte, elapsed time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stats.Transfers++
+	s.stats.BusTime += elapsed
+
+	if len(s.samples) < latencySamples {
+		s.samples = append(s.samples, elapsed)
+	} else {
+		s.samples[s.next] = elapsed
+		s.next = (s.next + 1) % latencySamples
+	}
+}
+
+func (s *statsRecorder) OnDeSerialise(data []byte, rx []Packet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, p := range rx {
+		s.stats.RxBytes += uint64(len(p.Data))
+	}
+}
+
+func (s *statsRecorder) OnRetry(ep uint8) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stats.Retries++
+}
+
+func (s *statsRecorder) OnError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var te *TransferError
+	if errors.As(err, &te) {
+		s.stats.TransferErrors++
+	} else {
+		s.stats.ProtocolErrors++
+	}
+}
+
+func percentile(sorted []time.Duration, p int) time.Duration {
+	return sorted[(len(sorted) - 1) * p / 100]
+}
+
+func (s *statsRecorder) get() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := s.stats
+	stats.Uptime = time.Since(s.created)
+
+	if n := len(s.samples); n > 0 {
+		sorted := make([]time.Duration, n)
+		copy(sorted, s.samples)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+		stats.Latency = LatencyStats{
+			Samples: n,
+			P50: percentile(sorted, 50),
+			P90: percentile(sorted, 90),
+			P99: percentile(sorted, 99),
+			Max: sorted[n - 1],
+		}
+	}
+
+	return stats
+}
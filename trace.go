@@ -0,0 +1,44 @@
+// Copyright 2017 Brian Starkey <stark3y@gmail.com>
+package datalink
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerName is the instrumentation name used for datalink's spans. They
+// go to the global TracerProvider, which does nothing unless one has been
+// set up, e.g. with the tracing package.
+const TracerName = "github.com/usedbytes/bot_matrix/datalink"
+
+func tracer() trace.Tracer {
+	return otel.Tracer(TracerName)
+}
+
+// PacketAttributes returns span attributes describing pkts. dir is used
+// in the attribute names, and should be "tx" or "rx".
+func PacketAttributes(dir string, pkts []Packet) []attribute.KeyValue {
+	eps := make([]int, 0, len(pkts))
+	n := 0
+	for _, p := range pkts {
+		eps = append(eps, int(p.Endpoint))
+		n += len(p.Data)
+	}
+
+	return []attribute.KeyValue{
+		attribute.IntSlice("datalink." + dir + ".endpoints", eps),
+		attribute.Int("datalink." + dir + ".packets", len(pkts)),
+		attribute.Int("datalink." + dir + ".bytes", n),
+	}
+}
+
+// EndSpan records err, if there is one, and ends span
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,43 @@
+// Copyright 2017 Brian Starkey <stark3y@gmail.com>
+
+// Package tracing sets up OpenTelemetry tracing, exporting the spans
+// recorded by datalink, rpcconn and friends to an OTLP collector.
+package tracing
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// Setup installs a global TracerProvider which sends spans to the OTLP
+// HTTP collector at endpoint (host:port, without TLS), and a W3C trace
+// context propagator so traces continue across RPC calls.
+//
+// The returned function flushes any buffered spans, and must be called
+// before exiting.
+func Setup(ctx context.Context, service, endpoint string) (func(context.Context) error, error) {
+	exp, err := otlptracehttp.New(ctx,
+		otlptracehttp.WithEndpoint(endpoint),
+		otlptracehttp.WithInsecure(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	res := resource.NewSchemaless(attribute.String("service.name", service))
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+	)
+
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	return tp.Shutdown, nil
+}